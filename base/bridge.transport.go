@@ -1,6 +1,22 @@
 package base
 
+import (
+	"time"
+)
+
 type BridgeTransport interface {
 	Send(_type, flag byte, clientID, connID string, serverType byte, data []byte) (int, error)
 	Close() error
 }
+
+// BridgeHealth is implemented by transports that can tell whether the bridge link is currently usable.
+type BridgeHealth interface {
+	IsAvailable() bool
+	WaitAvailable(timeout time.Duration) bool
+}
+
+// BridgeLinkLost is implemented by transports that declare the bridge link lost after a long outage or on
+// close, every listener is called each time with the reason.
+type BridgeLinkLost interface {
+	OnLinkLost(listener func(reason string))
+}
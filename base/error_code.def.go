@@ -0,0 +1,80 @@
+package base
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// Codes of Notification.Code in ConnectAck, Close and Error, 0 is success.
+const (
+	ErrCodeNone          int32 = 0x00
+	ErrCodeGeneral       int32 = 0x01
+	ErrCodeDialRefused   int32 = 0x02
+	ErrCodeDNSFailure    int32 = 0x03
+	ErrCodeTimeout       int32 = 0x04
+	ErrCodePolicyDenied  int32 = 0x05
+	ErrCodeOverload      int32 = 0x06
+	ErrCodeProtocolError int32 = 0x07
+)
+
+var errCodeNames = map[int32]string{
+	ErrCodeNone:          "none",
+	ErrCodeGeneral:       "general failure",
+	ErrCodeDialRefused:   "dial refused",
+	ErrCodeDNSFailure:    "dns failure",
+	ErrCodeTimeout:       "timeout",
+	ErrCodePolicyDenied:  "policy denied",
+	ErrCodeOverload:      "overload",
+	ErrCodeProtocolError: "protocol error",
+}
+
+var errCodeReps = map[int32]byte{
+	ErrCodeNone:          Socks5RepSuccess,
+	ErrCodeDialRefused:   Socks5RepConnectionRefused,
+	ErrCodeDNSFailure:    Socks5RepHostUnreachable,
+	ErrCodeTimeout:       Socks5RepTTLExpired,
+	ErrCodePolicyDenied:  Socks5RepNotAllowed,
+	ErrCodeOverload:      Socks5RepGeneralFailure,
+	ErrCodeProtocolError: Socks5RepGeneralFailure,
+}
+
+func ErrCodeName(code int32) string {
+	if name, ok := errCodeNames[code]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", code)
+}
+
+// Socks5RepOf is the SOCKS5 reply of a stream failed with code before it was acked, an unknown code
+// is a general failure.
+func Socks5RepOf(code int32) byte {
+	if rep, ok := errCodeReps[code]; ok {
+		return rep
+	}
+	return Socks5RepGeneralFailure
+}
+
+// ErrCodeOf classifies the error of dialing a target, for the server side to report.
+func ErrCodeOf(err error) int32 {
+	if err == nil {
+		return ErrCodeNone
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		if dnsErr.IsTimeout {
+			return ErrCodeTimeout
+		}
+		return ErrCodeDNSFailure
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return ErrCodeDialRefused
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return ErrCodeTimeout
+	}
+	return ErrCodeGeneral
+}
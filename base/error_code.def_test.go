@@ -0,0 +1,59 @@
+package base
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestErrCodeOf(t *testing.T) {
+	for name, c := range map[string]struct {
+		err  error
+		code int32
+	}{
+		"nil":         {nil, ErrCodeNone},
+		"dns":         {&net.DNSError{Err: "no such host", Name: "example.invalid", IsNotFound: true}, ErrCodeDNSFailure},
+		"dns timeout": {&net.DNSError{Err: "timeout", Name: "example.com", IsTimeout: true}, ErrCodeTimeout},
+		"refused": {&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)},
+			ErrCodeDialRefused},
+		"deadline":        {fmt.Errorf("dial: %w", context.DeadlineExceeded), ErrCodeTimeout},
+		"net timeout":     {&net.OpError{Op: "dial", Net: "tcp", Err: timeoutError{}}, ErrCodeTimeout},
+		"other":           {errors.New("boom"), ErrCodeGeneral},
+		"canceled":        {context.Canceled, ErrCodeGeneral},
+		"wrapped dns":     {fmt.Errorf("connect: %w", &net.DNSError{Err: "no such host"}), ErrCodeDNSFailure},
+		"wrapped refused": {fmt.Errorf("connect: %w", syscall.ECONNREFUSED), ErrCodeDialRefused},
+	} {
+		if code := ErrCodeOf(c.err); code != c.code {
+			t.Fatalf("%s: %s, want %s", name, ErrCodeName(code), ErrCodeName(c.code))
+		}
+	}
+}
+
+func TestSocks5RepOf(t *testing.T) {
+	for code, rep := range map[int32]byte{
+		ErrCodeNone:          Socks5RepSuccess,
+		ErrCodeGeneral:       Socks5RepGeneralFailure,
+		ErrCodeDialRefused:   Socks5RepConnectionRefused,
+		ErrCodeDNSFailure:    Socks5RepHostUnreachable,
+		ErrCodeTimeout:       Socks5RepTTLExpired,
+		ErrCodePolicyDenied:  Socks5RepNotAllowed,
+		ErrCodeOverload:      Socks5RepGeneralFailure,
+		ErrCodeProtocolError: Socks5RepGeneralFailure,
+		0x7F:                 Socks5RepGeneralFailure,
+		-1:                   Socks5RepGeneralFailure,
+	} {
+		if got := Socks5RepOf(code); got != rep {
+			t.Fatalf("%s: 0x%02x, want 0x%02x", ErrCodeName(code), got, rep)
+		}
+	}
+}
@@ -1,19 +1,44 @@
 package base
 
 const (
-	Socks5Version     byte = 0x05
-	Socks5NoAuth      byte = 0x00
-	Socks5CmdConnect  byte = 0x01
-	MsgTypeConnect    byte = 0x00
-	MsgTypeConnectAck byte = 0x02
-	MsgTypeData       byte = 0x04
-	MsgTypeClose      byte = 0x08
-	MsgTypeError      byte = 0x0F
-	MsgFlagToServer   byte = 0x0A
-	MsgFlagToClient   byte = 0x0F
-	AddrTypeIPv4      byte = 0x01
-	AddrTypeDomain    byte = 0x03
-	AddrTypeIPv6      byte = 0x04
+	Socks5Version       byte = 0x05
+	Socks5NoAuth        byte = 0x00
+	Socks5CmdConnect    byte = 0x01
+	MsgTypeConnect      byte = 0x00
+	MsgTypeConnectAck   byte = 0x02
+	MsgTypeData         byte = 0x04
+	MsgTypeClose        byte = 0x08
+	MsgTypeError        byte = 0x0F
+	MsgTypeWindowUpdate byte = 0x10
+	MsgTypeHalfClose    byte = 0x11
+	MsgTypeAck          byte = 0x12
+	MsgTypeResume       byte = 0x13
+	MsgTypeResumeAck    byte = 0x14
+	MsgTypeHello        byte = 0x15
+	MsgTypeHelloAck     byte = 0x16
+	MsgTypeBatch        byte = 0x17
+	MsgTypeFragment     byte = 0x18
+	MsgTypeCover        byte = 0x19
+	MsgFlagToServer     byte = 0x0A
+	MsgFlagToClient     byte = 0x0F
+	AddrTypeIPv4        byte = 0x01
+	AddrTypeDomain      byte = 0x03
+	AddrTypeIPv6        byte = 0x04
+)
+
+const (
+	Socks5RepSuccess            byte = 0x00
+	Socks5RepGeneralFailure     byte = 0x01
+	Socks5RepNotAllowed         byte = 0x02
+	Socks5RepNetworkUnreachable byte = 0x03
+	Socks5RepHostUnreachable    byte = 0x04
+	Socks5RepConnectionRefused  byte = 0x05
+	Socks5RepTTLExpired         byte = 0x06
+)
+
+const (
+	StreamInitialWindow         = 256 * 1024
+	StreamWindowUpdateThreshold = StreamInitialWindow / 4
 )
 
 func Socks5AuthLegacy() []byte {
@@ -25,14 +50,15 @@ func Socks5AuthLegacy() []byte {
 // +----+-----+-------+------+----------+----------+
 // | 1  |  1  |  0x00 |  1   | Variable |    2     |
 func Socks5CmdConnectSuccess() []byte {
-	return []byte{Socks5Version, 0x00, 0x00, 0x01,
-		0x00, 0x00, 0x00, 0x00,
-		0x00, 0x00,
-	}
+	return Socks5CmdConnectReply(Socks5RepSuccess)
 }
 
 func Socks5CmdConnectFailed() []byte {
-	return []byte{Socks5Version, 0x01, 0x00, 0x01,
+	return Socks5CmdConnectReply(Socks5RepGeneralFailure)
+}
+
+func Socks5CmdConnectReply(rep byte) []byte {
+	return []byte{Socks5Version, rep, 0x00, 0x01,
 		0x00, 0x00, 0x00, 0x00,
 		0x00, 0x00,
 	}
@@ -0,0 +1,258 @@
+package bridge
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/yangxm/gecko/logger"
+	"maps"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	AuthTokenParam = "X-Bridge-Token"
+
+	authAlgHMAC    = "hs256"
+	authAlgEd25519 = "ed25519"
+
+	authTokenVersion     = "gecko-bridge-v1"
+	authDefaultMaxSkew   = 5 * time.Minute
+	authNonceSize        = 16
+	authNonceCacheMax    = 100000
+	authNoncePrunePeriod = 10 * time.Second
+)
+
+// Authenticator checks the conn params of a new link and returns the client it belongs to.
+type Authenticator func(params map[string]string) (string, error)
+
+// TokenSigner signs the auth tokens of a client.
+type TokenSigner interface {
+	Algorithm() string
+	Sign(payload []byte) ([]byte, error)
+}
+
+type hmacSigner struct {
+	key []byte
+}
+
+func NewHMACSigner(key []byte) TokenSigner {
+	return &hmacSigner{key: key}
+}
+
+func (s *hmacSigner) Algorithm() string {
+	return authAlgHMAC
+}
+
+func (s *hmacSigner) Sign(payload []byte) ([]byte, error) {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write(payload)
+	return mac.Sum(nil), nil
+}
+
+type ed25519Signer struct {
+	key ed25519.PrivateKey
+}
+
+func NewEd25519Signer(key ed25519.PrivateKey) TokenSigner {
+	return &ed25519Signer{key: key}
+}
+
+func (s *ed25519Signer) Algorithm() string {
+	return authAlgEd25519
+}
+
+func (s *ed25519Signer) Sign(payload []byte) ([]byte, error) {
+	if len(s.key) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("illegal ed25519 private key size: %d", len(s.key))
+	}
+	return ed25519.Sign(s.key, payload), nil
+}
+
+// tokenPayload is what gets signed, every field on its own line so none can be shifted into another.
+func tokenPayload(alg, clientID string, timestamp int64, nonce string) []byte {
+	return []byte(strings.Join([]string{authTokenVersion, alg, clientID, strconv.FormatInt(timestamp, 10), nonce}, "\n"))
+}
+
+// NewAuthToken mints a token for clientID, it is only good for one connection.
+// The format is alg.base64url(clientID).timestamp.nonce.base64url(signature).
+func NewAuthToken(signer TokenSigner, clientID string, now time.Time) (string, error) {
+	nonceBytes := make([]byte, authNonceSize)
+	if _, err := rand.Read(nonceBytes); err != nil {
+		return "", fmt.Errorf("generate nonce error: %v", err)
+	}
+	nonce := hex.EncodeToString(nonceBytes)
+	alg := signer.Algorithm()
+	timestamp := now.Unix()
+	signature, err := signer.Sign(tokenPayload(alg, clientID, timestamp, nonce))
+	if err != nil {
+		return "", fmt.Errorf("sign token error: %v", err)
+	}
+	return strings.Join([]string{
+		alg,
+		base64.RawURLEncoding.EncodeToString([]byte(clientID)),
+		strconv.FormatInt(timestamp, 10),
+		nonce,
+		base64.RawURLEncoding.EncodeToString(signature),
+	}, "."), nil
+}
+
+// TokenParamGetter returns a conn param getter that adds a freshly minted token to the params of next,
+// the transports call it on every dial so a reconnect never replays an old token.
+func TokenParamGetter(signer TokenSigner, clientID string, next func() map[string]string) func() map[string]string {
+	return func() map[string]string {
+		params := make(map[string]string)
+		if next != nil {
+			maps.Copy(params, next())
+		}
+		token, err := NewAuthToken(signer, clientID, time.Now())
+		if err != nil {
+			logger.Error("[AUTH] mint token for %s error: %v", clientID, err)
+			return params
+		}
+		params[AuthTokenParam] = token
+		return params
+	}
+}
+
+// TokenVerifier is the server side of the auth tokens. A token is accepted once: it must be signed
+// with the key of its client, not be older or newer than the max skew and carry a nonce not seen before.
+type TokenVerifier struct {
+	maxSkew     time.Duration
+	hmacKeys    func(clientID string) []byte
+	ed25519Keys func(clientID string) ed25519.PublicKey
+	mutex       sync.Mutex
+	nonces      map[string]time.Time
+	lastPrune   time.Time
+}
+
+// NewTokenVerifier creates a verifier, a nil key lookup refuses that algorithm and a lookup returning
+// nil refuses the client. maxSkew 0 uses the default of 5 minutes.
+func NewTokenVerifier(maxSkew time.Duration, hmacKeys func(clientID string) []byte, ed25519Keys func(clientID string) ed25519.PublicKey) *TokenVerifier {
+	if maxSkew <= 0 {
+		maxSkew = authDefaultMaxSkew
+	}
+	return &TokenVerifier{
+		maxSkew:     maxSkew,
+		hmacKeys:    hmacKeys,
+		ed25519Keys: ed25519Keys,
+		nonces:      make(map[string]time.Time),
+	}
+}
+
+// Verify checks token and returns the client it was minted for.
+func (v *TokenVerifier) Verify(token string, now time.Time) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 5 {
+		return "", fmt.Errorf("malformed token")
+	}
+	alg, nonce := parts[0], parts[3]
+	clientIDBytes, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("malformed token client: %v", err)
+	}
+	clientID := string(clientIDBytes)
+	timestamp, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("malformed token timestamp: %v", err)
+	}
+	if _, err := hex.DecodeString(nonce); err != nil || len(nonce) != authNonceSize*2 {
+		return "", fmt.Errorf("malformed token nonce")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[4])
+	if err != nil {
+		return "", fmt.Errorf("malformed token signature: %v", err)
+	}
+
+	payload := tokenPayload(alg, clientID, timestamp, nonce)
+	switch alg {
+	case authAlgHMAC:
+		var key []byte
+		if v.hmacKeys != nil {
+			key = v.hmacKeys(clientID)
+		}
+		if key == nil {
+			return "", fmt.Errorf("no %s key for client %s", alg, clientID)
+		}
+		expected, _ := NewHMACSigner(key).Sign(payload)
+		if !hmac.Equal(signature, expected) {
+			return "", fmt.Errorf("bad token signature")
+		}
+	case authAlgEd25519:
+		var key ed25519.PublicKey
+		if v.ed25519Keys != nil {
+			key = v.ed25519Keys(clientID)
+		}
+		if len(key) != ed25519.PublicKeySize {
+			return "", fmt.Errorf("no %s key for client %s", alg, clientID)
+		}
+		if !ed25519.Verify(key, payload, signature) {
+			return "", fmt.Errorf("bad token signature")
+		}
+	default:
+		return "", fmt.Errorf("unsupported token algorithm: %s", alg)
+	}
+
+	skew := now.Sub(time.Unix(timestamp, 0))
+	if skew > v.maxSkew || skew < -v.maxSkew {
+		return "", fmt.Errorf("token timestamp out of range, skew: %v", skew)
+	}
+	if err := v.useNonce(clientID+"/"+nonce, now); err != nil {
+		return "", err
+	}
+	return clientID, nil
+}
+
+// useNonce remembers the nonce as long as its token could pass the skew check.
+func (v *TokenVerifier) useNonce(nonce string, now time.Time) error {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if now.Sub(v.lastPrune) > authNoncePrunePeriod || len(v.nonces) >= authNonceCacheMax {
+		for n, expireAt := range v.nonces {
+			if now.After(expireAt) {
+				delete(v.nonces, n)
+			}
+		}
+		v.lastPrune = now
+	}
+	if _, ok := v.nonces[nonce]; ok {
+		return fmt.Errorf("token replayed")
+	}
+	if len(v.nonces) >= authNonceCacheMax {
+		return fmt.Errorf("too many tokens in flight")
+	}
+	v.nonces[nonce] = now.Add(2 * v.maxSkew)
+	return nil
+}
+
+// VerifyParams verifies the token in the conn params of a link, it is an Authenticator for the listeners.
+func (v *TokenVerifier) VerifyParams(params map[string]string) (string, error) {
+	token, ok := params[AuthTokenParam]
+	if !ok {
+		token = params[http.CanonicalHeaderKey(AuthTokenParam)]
+	}
+	if token == "" {
+		return "", fmt.Errorf("missing auth token")
+	}
+	return v.Verify(token, time.Now())
+}
+
+// Middleware rejects every request without a valid token before it reaches next, it guards a WebSocket
+// upgrade handler. The bridge listeners take VerifyParams as their Authenticator instead.
+func (v *TokenVerifier) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := v.Verify(r.Header.Get(AuthTokenParam), time.Now()); err != nil {
+			logger.Warn("[AUTH] reject %s: %v", r.RemoteAddr, err)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,172 @@
+package bridge
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestVerifier(t *testing.T, maxSkew time.Duration) (*TokenVerifier, TokenSigner, TokenSigner) {
+	hmacKey := bytes.Repeat([]byte{0x42}, 32)
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier := NewTokenVerifier(maxSkew, func(clientID string) []byte {
+		if clientID == "hmac-client" {
+			return hmacKey
+		}
+		return nil
+	}, func(clientID string) ed25519.PublicKey {
+		if clientID == "ed-client" {
+			return public
+		}
+		return nil
+	})
+	return verifier, NewHMACSigner(hmacKey), NewEd25519Signer(private)
+}
+
+func TestAuthTokenSignVerify(t *testing.T) {
+	verifier, hmacSigner, edSigner := newTestVerifier(t, time.Minute)
+	now := time.Now()
+	for clientID, signer := range map[string]TokenSigner{"hmac-client": hmacSigner, "ed-client": edSigner} {
+		token, err := NewAuthToken(signer, clientID, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(token, signer.Algorithm()+".") {
+			t.Fatalf("token %s of %s", token, signer.Algorithm())
+		}
+		if got, err := verifier.Verify(token, now); err != nil || got != clientID {
+			t.Fatalf("%s: %s, %v", signer.Algorithm(), got, err)
+		}
+	}
+}
+
+func TestAuthTokenRejectsForgeries(t *testing.T) {
+	verifier, hmacSigner, edSigner := newTestVerifier(t, time.Minute)
+	now := time.Now()
+	token := func(signer TokenSigner, clientID string) string {
+		token, err := NewAuthToken(signer, clientID, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+	swapClient := func(token, clientID string) string {
+		parts := strings.Split(token, ".")
+		parts[1] = base64.RawURLEncoding.EncodeToString([]byte(clientID))
+		return strings.Join(parts, ".")
+	}
+	swapAlg := func(token, alg string) string {
+		return alg + token[strings.Index(token, "."):]
+	}
+	shortNonce := func(token string) string {
+		parts := strings.Split(token, ".")
+		parts[3] = parts[3][:8]
+		return strings.Join(parts, ".")
+	}
+	for name, forged := range map[string]string{
+		"hmac with the wrong key":        token(NewHMACSigner([]byte("other")), "hmac-client"),
+		"ed25519 with the wrong key":     token(NewEd25519Signer(otherKey), "ed-client"),
+		"hmac for an ed25519 client":     token(hmacSigner, "ed-client"),
+		"ed25519 for an hmac client":     token(edSigner, "hmac-client"),
+		"signature of another client":    swapClient(token(hmacSigner, "hmac-client"), "ed-client"),
+		"ed25519 signature sold as hmac": swapAlg(token(edSigner, "ed-client"), authAlgHMAC),
+		"unknown algorithm":              swapAlg(token(hmacSigner, "hmac-client"), "none"),
+		"unknown client":                 token(hmacSigner, "nobody"),
+		"malformed":                      "hs256.abc",
+		"short nonce":                    shortNonce(token(hmacSigner, "hmac-client")),
+		"empty":                          "",
+	} {
+		if clientID, err := verifier.Verify(forged, now); err == nil {
+			t.Fatalf("%s accepted for %s", name, clientID)
+		}
+	}
+}
+
+func TestAuthTokenSkew(t *testing.T) {
+	verifier, signer, _ := newTestVerifier(t, time.Minute)
+	now := time.Now()
+	for skew, ok := range map[time.Duration]bool{
+		0:                 true,
+		-50 * time.Second: true,
+		50 * time.Second:  true,
+		-2 * time.Minute:  false,
+		2 * time.Minute:   false,
+	} {
+		token, err := NewAuthToken(signer, "hmac-client", now.Add(skew))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := verifier.Verify(token, now); (err == nil) != ok {
+			t.Fatalf("skew %v: %v", skew, err)
+		}
+	}
+	if defaulted := NewTokenVerifier(0, nil, nil); defaulted.maxSkew != authDefaultMaxSkew {
+		t.Fatalf("default max skew: %v", defaulted.maxSkew)
+	}
+}
+
+func TestAuthTokenNonceReplay(t *testing.T) {
+	verifier, signer, _ := newTestVerifier(t, time.Minute)
+	now := time.Now()
+	token, err := NewAuthToken(signer, "hmac-client", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifier.Verify(token, now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifier.Verify(token, now.Add(time.Second)); err == nil {
+		t.Fatal("replayed token accepted")
+	}
+	// the nonce is kept as long as the token passes the skew check, pruning must not let it back in
+	if _, err := verifier.Verify(token, now.Add(59*time.Second)); err == nil {
+		t.Fatal("replayed token accepted after a prune")
+	}
+	fresh, err := NewAuthToken(signer, "hmac-client", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifier.Verify(fresh, now); err != nil {
+		t.Fatalf("fresh token: %v", err)
+	}
+}
+
+func TestAuthTokenParams(t *testing.T) {
+	verifier, signer, _ := newTestVerifier(t, time.Minute)
+	getter := TokenParamGetter(signer, "hmac-client", func() map[string]string {
+		return map[string]string{"X-Other": "1"}
+	})
+	first, second := getter(), getter()
+	if first["X-Other"] != "1" || first[AuthTokenParam] == "" || first[AuthTokenParam] == second[AuthTokenParam] {
+		t.Fatalf("params: %v, %v", first, second)
+	}
+	for _, params := range []map[string]string{first, second} {
+		if clientID, err := verifier.VerifyParams(params); err != nil || clientID != "hmac-client" {
+			t.Fatalf("verify params: %s, %v", clientID, err)
+		}
+	}
+	if _, err := verifier.VerifyParams(map[string]string{}); err == nil {
+		t.Fatal("params without a token accepted")
+	}
+
+	handler := verifier.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for token, status := range map[string]int{getter()[AuthTokenParam]: http.StatusOK, "": http.StatusUnauthorized} {
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		request.Header.Set(AuthTokenParam, token)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		if recorder.Code != status {
+			t.Fatalf("token %q, status: %d", token, recorder.Code)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package bridge
+
+import (
+	"math"
+	"math/rand/v2"
+	"time"
+)
+
+type BackoffPolicy struct {
+	Initial     time.Duration
+	Max         time.Duration
+	Multiplier  float64
+	Jitter      float64 // fraction of the delay randomly added or removed, 0 ~ 1
+	MaxAttempts int     // 0 means retry forever
+}
+
+func DefaultBackoffPolicy() BackoffPolicy {
+	return BackoffPolicy{
+		Initial:     1 * time.Second,
+		Max:         60 * time.Second,
+		Multiplier:  2,
+		Jitter:      0.2,
+		MaxAttempts: 0,
+	}
+}
+
+// Delay returns the wait before the given attempt, attempt starts at 0.
+func (p BackoffPolicy) Delay(attempt int) time.Duration {
+	initial := max(p.Initial, 0)
+	maxDelay := p.Max
+	if maxDelay <= 0 {
+		maxDelay = initial
+	}
+	multiplier := max(p.Multiplier, 1)
+
+	// computed in float so a large attempt saturates at Max instead of overflowing
+	delay := float64(initial) * math.Pow(multiplier, float64(attempt))
+	if delay > float64(maxDelay) || math.IsInf(delay, 0) || math.IsNaN(delay) {
+		delay = float64(maxDelay)
+	}
+
+	jitter := min(max(p.Jitter, 0), 1)
+	if jitter > 0 {
+		delay += delay * jitter * (rand.Float64()*2 - 1)
+	}
+	return time.Duration(delay)
+}
+
+func (p BackoffPolicy) Exhausted(attempt int) bool {
+	return p.MaxAttempts > 0 && attempt >= p.MaxAttempts
+}
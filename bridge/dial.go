@@ -0,0 +1,91 @@
+package bridge
+
+import (
+	"errors"
+	"fmt"
+	"github.com/yangxm/gecko/base"
+	"github.com/yangxm/gecko/logger"
+	"net/url"
+	"time"
+)
+
+const (
+	pollFallbackDialAttempts = 3
+)
+
+// Dial creates the bridge transport matching the scheme of rawURL.
+func Dial(rawURL string, connParamGetter func() map[string]string, receiver base.BridgeReceiver, opts ...Option) (base.BridgeTransport, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse url error: %v", err)
+	}
+	switch u.Scheme {
+	case "ws", "wss":
+		return dialWs(u, connParamGetter, receiver, opts)
+	case "tls":
+		return asTransport(NewTlsTransport(rawURL, connParamGetter, receiver, opts...))
+	case "h2", "h2c":
+		return asTransport(NewH2Transport(rawURL, connParamGetter, receiver, opts...))
+	case "http", "https":
+		return asTransport(NewPollTransport(rawURL, connParamGetter, receiver, opts...))
+	default:
+		return nil, fmt.Errorf("unsupported bridge scheme: %s", u.Scheme)
+	}
+}
+
+// dialWs falls back to long polling once the WebSocket dial failed a few times in a row at the transport
+// level, on paths where the upgrade never gets through. The reconnects of the transport go by the same rule.
+func dialWs(u *url.URL, connParamGetter func() map[string]string, receiver base.BridgeReceiver, opts []Option) (base.BridgeTransport, error) {
+	o := newOptions(opts)
+	fallback := *u
+	fallback.Scheme = map[string]string{"ws": "http", "wss": "https"}[u.Scheme]
+	fallbackURL := fallback.String()
+	if o.pollFallback != nil {
+		fallbackURL = *o.pollFallback
+	}
+	if fallbackURL == "" {
+		return asTransport(NewWsTransport(u.String(), connParamGetter, receiver, opts...))
+	}
+	wsFallback, err := newWsFallback(fallbackURL, o)
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < pollFallbackDialAttempts; attempt++ {
+		if attempt > 0 {
+			delay := o.backoff.Delay(attempt - 1)
+			logger.Info("[DIAL] websocket dial failed, retry in %v", delay)
+			select {
+			case <-time.After(delay):
+			case <-contextDone(o):
+				return nil, fmt.Errorf("dial canceled, last error: %v", lastErr)
+			}
+		}
+		t, err := newWsTransport(u.String(), wsFallback, connParamGetter, receiver, opts)
+		if err == nil {
+			return t, nil
+		}
+		lastErr = err
+		var rejected *wsRejectedError
+		if errors.As(err, &rejected) {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+func contextDone(o *options) <-chan struct{} {
+	if o.ctx == nil {
+		return nil
+	}
+	return o.ctx.Done()
+}
+
+// asTransport keeps a failed constructor from returning a nil pointer wrapped in a non nil interface.
+func asTransport[T base.BridgeTransport](t T, err error) (base.BridgeTransport, error) {
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
@@ -0,0 +1,118 @@
+package bridge
+
+import (
+	"errors"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/yangxm/gecko/base"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// servePoll serves the polling links of server on a test http server and counts the requests it got.
+func servePoll(t *testing.T, server *testServer) (string, *atomic.Int32) {
+	listener := NewPollListener()
+	go server.serve(listener.Accept)
+	requests := &atomic.Int32{}
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		listener.ServeHTTP(w, r)
+	}))
+	t.Cleanup(func() {
+		httpServer.Close()
+		_ = listener.Close()
+	})
+	return httpServer.URL, requests
+}
+
+func TestDialWsFallsBackToPollingOnReconnect(t *testing.T) {
+	server := newTestServer(t, LinkConditions{})
+	pollURL, _ := servePoll(t, server)
+
+	accepted := make(chan *ServerConn, 4)
+	go server.serve(func() (*ServerConn, error) {
+		conn, ok := <-accepted
+		if !ok {
+			return nil, net.ErrClosed
+		}
+		return conn, nil
+	})
+	wsListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upgrader := websocket.Upgrader{}
+	wsServer := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		accepted <- newServerConn(newWsLink(conn, nil), nil, conn.RemoteAddr())
+	})}
+	go func() {
+		_ = wsServer.Serve(wsListener)
+	}()
+	t.Cleanup(func() { _ = wsServer.Close() })
+
+	policy := BackoffPolicy{Initial: 10 * time.Millisecond, Max: 50 * time.Millisecond, Multiplier: 2}
+	client, err := Dial("ws://"+wsListener.Addr().String(), nil, newTestClientReceiver(), WithPollFallback(pollURL), WithBackoffPolicy(policy))
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+	ws := client.(*WsTransport)
+	if ws.fallback.isPolling() {
+		t.Fatal("fell back with the websocket up")
+	}
+
+	// the websocket path goes away for good, the reconnect has to move to long polling
+	_ = wsServer.Close()
+	server.mutex.Lock()
+	links := server.links
+	server.mutex.Unlock()
+	if links != 1 {
+		t.Fatalf("links: %d", links)
+	}
+	_ = ws.Reconnect()
+	server.waitFor(t, 10*time.Second, func() bool {
+		return server.links == 2
+	})
+	if !ws.fallback.isPolling() {
+		t.Fatal("reconnected without falling back")
+	}
+	if !ws.WaitAvailable(5 * time.Second) {
+		t.Fatal("transport not available over long polling")
+	}
+
+	connID := uuid.New().String()
+	if _, err := client.Send(base.MsgTypeData, base.MsgFlagToServer, "client", connID, 0x00, []byte("polled")); err != nil {
+		t.Fatalf("send error: %v", err)
+	}
+	server.waitFor(t, 5*time.Second, func() bool {
+		return server.received[connID] != nil && server.received[connID].String() == "polled"
+	})
+}
+
+func TestDialWsRejectedDoesNotFallBack(t *testing.T) {
+	server := newTestServer(t, LinkConditions{})
+	pollURL, requests := servePoll(t, server)
+
+	wsServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+	}))
+	t.Cleanup(wsServer.Close)
+
+	policy := BackoffPolicy{Initial: 10 * time.Millisecond, Max: 50 * time.Millisecond, Multiplier: 2}
+	_, err := Dial("ws"+wsServer.URL[len("http"):], nil, newTestClientReceiver(), WithPollFallback(pollURL), WithBackoffPolicy(policy))
+	var rejected *wsRejectedError
+	if !errors.As(err, &rejected) || rejected.code != http.StatusForbidden {
+		t.Fatalf("dial error: %v", err)
+	}
+	if n := requests.Load(); n != 0 {
+		t.Fatalf("fell back to long polling, requests: %d", n)
+	}
+}
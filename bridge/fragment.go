@@ -0,0 +1,92 @@
+package bridge
+
+import (
+	"fmt"
+	"github.com/yangxm/gecko/base"
+	"github.com/yangxm/gecko/coder"
+	"github.com/yangxm/gecko/entity"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	fragmentMinFrameSize = 1024
+	// room left in a frame for the envelope of a fragment
+	fragmentOverhead = 64
+	// a frame is cut in no more fragments than this, so the reassembly is bound by the negotiated max frame size
+	fragmentMaxCount = 128
+	// the largest payload taken by Send, whatever max frame size is negotiated it fits in fragmentMaxCount
+	// fragments with its header and codecs
+	fragmentMaxPayload = 64 * 1024
+)
+
+// maxReassembledSize is the largest frame carried by fragments of maxFrameSize, 0 when no fragments
+// were negotiated.
+func maxReassembledSize(maxFrameSize int) int {
+	if maxFrameSize < fragmentMinFrameSize {
+		return 0
+	}
+	return min(fragmentMaxCount*(maxFrameSize-fragmentOverhead), transportMaxFrameBytes)
+}
+
+// fragment splits a frame larger than the max frame size of the link into Fragment messages. Fragments only
+// live on one link: a frame cut short by a lost link is not acked, so it is retransmitted whole on the next one.
+func fragment(data []byte, maxFrameSize int, flag byte) ([][]byte, error) {
+	if limit := maxReassembledSize(maxFrameSize); len(data) > limit {
+		return nil, fmt.Errorf("frame too large: %d > %d", len(data), limit)
+	}
+	chunkSize := maxFrameSize - fragmentOverhead
+	frames := make([][]byte, 0, (len(data)+chunkSize-1)/chunkSize)
+	for offset := 0; offset < len(data); offset += chunkSize {
+		end := min(offset+chunkSize, len(data))
+		payload, err := proto.Marshal(&entity.Fragment{More: end < len(data), Data: data[offset:end]})
+		if err != nil {
+			return nil, fmt.Errorf("marshal Fragment error: %v", err)
+		}
+		frame, err := coder.Encode(base.MsgTypeFragment, flag, "", "", 0x00, payload)
+		if err != nil {
+			return nil, fmt.Errorf("encode Fragment error: %v", err)
+		}
+		frames = append(frames, frame)
+	}
+	return frames, nil
+}
+
+// reassembler joins the fragments read from one link.
+type reassembler struct {
+	buf     []byte
+	pending bool
+}
+
+// push returns the frame once its last fragment is in, maxFrameSize is the negotiated one.
+func (r *reassembler) push(data []byte, maxFrameSize int) ([]byte, error) {
+	var f entity.Fragment
+	if err := proto.Unmarshal(data, &f); err != nil {
+		r.reset()
+		return nil, fmt.Errorf("unmarshal Fragment error: %v", err)
+	}
+	if limit := maxReassembledSize(maxFrameSize); len(r.buf)+len(f.Data) > limit {
+		r.reset()
+		return nil, fmt.Errorf("reassembled frame larger than %d", limit)
+	}
+	r.pending = f.More
+	r.buf = append(r.buf, f.Data...)
+	if f.More {
+		return nil, nil
+	}
+	frame := r.buf
+	r.buf = nil
+	return frame, nil
+}
+
+// interrupt drops the fragments of a frame cut short by another frame, the fragments of one frame are
+// written back to back. It reports whether there were any.
+func (r *reassembler) interrupt() bool {
+	pending := r.pending
+	r.reset()
+	return pending
+}
+
+func (r *reassembler) reset() {
+	r.buf = nil
+	r.pending = false
+}
@@ -0,0 +1,162 @@
+package bridge
+
+import (
+	"bytes"
+	"github.com/google/uuid"
+	"github.com/yangxm/gecko/base"
+	"github.com/yangxm/gecko/coder"
+	"github.com/yangxm/gecko/entity"
+	"google.golang.org/protobuf/proto"
+	"testing"
+)
+
+// reassemble pushes frames made by fragment and returns the frame they carry.
+func reassemble(t *testing.T, r *reassembler, frames [][]byte, maxFrameSize int) []byte {
+	for i, frame := range frames {
+		message, _, err := coder.ParseFrame(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(frame) > maxFrameSize {
+			t.Fatalf("fragment %d: %d > %d", i, len(frame), maxFrameSize)
+		}
+		data, err := r.push(message.Data, maxFrameSize)
+		if err != nil {
+			t.Fatalf("fragment %d: %v", i, err)
+		}
+		if (data != nil) != (i == len(frames)-1) {
+			t.Fatalf("fragment %d of %d, frame: %v", i, len(frames), data != nil)
+		}
+		if data != nil {
+			return data
+		}
+	}
+	return nil
+}
+
+func TestFragmentBoundaries(t *testing.T) {
+	const maxFrameSize = fragmentMinFrameSize
+	chunk := maxFrameSize - fragmentOverhead
+	for _, size := range []int{1, chunk - 1, chunk, chunk + 1, 3 * chunk, maxReassembledSize(maxFrameSize)} {
+		data := bytes.Repeat([]byte{byte(size)}, size)
+		frames, err := fragment(data, maxFrameSize, base.MsgFlagToServer)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if want := (size + chunk - 1) / chunk; len(frames) != want {
+			t.Fatalf("size %d, fragments: %d, want %d", size, len(frames), want)
+		}
+		if got := reassemble(t, &reassembler{}, frames, maxFrameSize); !bytes.Equal(got, data) {
+			t.Fatalf("size %d, reassembled %d bytes", size, len(got))
+		}
+	}
+}
+
+func TestFragmentOversize(t *testing.T) {
+	const maxFrameSize = fragmentMinFrameSize
+	limit := maxReassembledSize(maxFrameSize)
+	if _, err := fragment(make([]byte, limit+1), maxFrameSize, base.MsgFlagToServer); err == nil {
+		t.Fatal("fragmented a frame over the limit")
+	}
+	// the peer cuts the frame itself, the negotiated size bounds what is kept
+	frames, err := fragment(make([]byte, limit), 2*maxFrameSize, base.MsgFlagToServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &reassembler{}
+	var pushErr error
+	for _, frame := range frames {
+		message, _, _ := coder.ParseFrame(frame)
+		if _, pushErr = r.push(message.Data, maxFrameSize/2); pushErr != nil {
+			break
+		}
+	}
+	if pushErr == nil {
+		t.Fatal("reassembled with fragments not negotiated")
+	}
+	chunk := make([]byte, maxFrameSize-fragmentOverhead)
+	for pushErr = nil; pushErr == nil; {
+		payload, _ := proto.Marshal(&entity.Fragment{More: true, Data: chunk})
+		_, pushErr = r.push(payload, maxFrameSize)
+	}
+	if r.buf != nil || r.interrupt() {
+		t.Fatal("oversize fragments kept")
+	}
+	if maxReassembledSize(1<<30) != transportMaxFrameBytes {
+		t.Fatalf("limit: %d", maxReassembledSize(1<<30))
+	}
+}
+
+func TestFragmentTruncatedSequence(t *testing.T) {
+	recorder := &frameRecorder{}
+	client := newTransport("TEST", "test", nil, nil, recorder, nil)
+	client.negotiated = Negotiated{MessageTypes: []byte{base.MsgTypeFragment}, MaxFrameSize: fragmentMinFrameSize}
+	streams, fragments := newStreamTable(), &reassembler{}
+	first, err := coder.Encode(base.MsgTypeData, base.MsgFlagToClient, "c1", uuid.New().String(), 0x00, bytes.Repeat([]byte("a"), 3000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := coder.Encode(base.MsgTypeData, base.MsgFlagToClient, "c1", uuid.New().String(), 0x00, []byte("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames, err := fragment(first, fragmentMinFrameSize, base.MsgFlagToClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the last fragment never comes, the next frame must not be glued to the ones before
+	for _, frame := range frames[:len(frames)-1] {
+		client.onFrame(frame, streams, fragments, false)
+	}
+	client.onFrame(second, streams, fragments, false)
+	client.onFrame(frames[len(frames)-1], streams, fragments, false)
+	if got := recorder.received(); !bytes.Equal(got, []byte{base.MsgTypeData}) {
+		t.Fatalf("received: %v", got)
+	}
+	for _, frame := range frames {
+		client.onFrame(frame, streams, fragments, false)
+	}
+	if got := recorder.received(); len(got) != 2 {
+		t.Fatalf("whole frame after a truncated one, received: %v", got)
+	}
+}
+
+func TestReassembledLinkFrameRejected(t *testing.T) {
+	client, server := newMemoryLinkPair(LinkConditions{}, nil)
+	defer client.Close()
+	conn := newServerConn(server, nil, memoryAddr("test"))
+	conn.maxFrame = fragmentMinFrameSize
+	recorder := &frameRecorder{}
+	data, err := coder.Encode(base.MsgTypeData, base.MsgFlagToServer, "c1", uuid.New().String(), 0x00, bytes.Repeat([]byte("d"), 2000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames, err := fragment(data, fragmentMinFrameSize, base.MsgFlagToServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, frame := range frames {
+		conn.dispatch(frame, recorder, false)
+	}
+	if got := recorder.received(); !bytes.Equal(got, []byte{base.MsgTypeData}) {
+		t.Fatalf("reassembled frame, received: %v", got)
+	}
+
+	// a Fragment carrying a whole Fragment sequence, and one carrying a Batch
+	inner, err := fragment(data, fragmentMinFrameSize, base.MsgFlagToServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, frame := range [][]byte{inner[len(inner)-1], nestBatch(t, data, 1)} {
+		payload, _ := proto.Marshal(&entity.Fragment{Data: frame})
+		outer, err := coder.Encode(base.MsgTypeFragment, base.MsgFlagToServer, "", "", 0x00, payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.dispatch(outer, recorder, false)
+	}
+	if got := recorder.received(); len(got) != 1 {
+		t.Fatalf("nested frames delivered: %v", got)
+	}
+}
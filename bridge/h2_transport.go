@@ -0,0 +1,342 @@
+package bridge
+
+import (
+	"context"
+	"fmt"
+	"github.com/yangxm/gecko/base"
+	"github.com/yangxm/gecko/logger"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	h2DialTimeout    = 10 * time.Second
+	h2AcceptChanSize = 16
+)
+
+// H2Transport carries the bridge frames over one long lived HTTP/2 POST, the request body is the
+// upstream and the response body the downstream, framed the same way as TlsTransport. It gets through
+// proxies that strip the Upgrade header. h2:// dials HTTP/2 over TLS, h2c:// cleartext HTTP/2.
+type H2Transport struct {
+	*transport
+	endpoint string
+	client   *http.Client
+}
+
+func NewH2Transport(rawURL string, connParamGetter func() map[string]string, receiver base.BridgeReceiver, opts ...Option) (*H2Transport, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse url error: %v", err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("illegal h2 url: %s", rawURL)
+	}
+
+	protocols := new(http.Protocols)
+	switch u.Scheme {
+	case "h2":
+		u.Scheme = "https"
+		protocols.SetHTTP2(true)
+	case "h2c":
+		u.Scheme = "http"
+		protocols.SetUnencryptedHTTP2(true)
+	default:
+		return nil, fmt.Errorf("illegal h2 url: %s", rawURL)
+	}
+
+	t := &H2Transport{endpoint: u.String()}
+	o := newOptions(opts)
+	proxyDial, err := o.proxyDial()
+	if err != nil {
+		return nil, err
+	}
+	httpTransport := &http.Transport{
+		Proxy:             http.ProxyFromEnvironment,
+		TLSClientConfig:   o.tlsConfig,
+		ForceAttemptHTTP2: true,
+		Protocols:         protocols,
+	}
+	if proxyDial != nil {
+		httpTransport.Proxy = nil
+		httpTransport.DialContext = proxyDial
+	}
+	t.client = &http.Client{Transport: httpTransport}
+	t.transport = newTransport("H2TP", rawURL, t.dial, connParamGetter, receiver, opts)
+	if err := t.start(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *H2Transport) dial(ctx context.Context, params map[string]string, onPong func(payload []byte)) (link, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	reader, writer := io.Pipe()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.endpoint, reader)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("new request error: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	for k, v := range params {
+		req.Header.Add(k, v)
+	}
+
+	// Do returns once the response headers arrived, the bodies stay open as the stream
+	timer := time.AfterFunc(h2DialTimeout, cancel)
+	resp, err := t.client.Do(req)
+	timer.Stop()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		cancel()
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	if resp.ProtoMajor != 2 {
+		_ = resp.Body.Close()
+		cancel()
+		return nil, fmt.Errorf("unexpected protocol: %s", resp.Proto)
+	}
+
+	logger.Debug("[H2TP] connected to %s", t.endpoint)
+	return newFramedLink(newStreamConn(resp.Body, writer, func() error {
+		cancel()
+		_ = writer.Close()
+		return resp.Body.Close()
+	}), onPong), nil
+}
+
+func (t *H2Transport) Close() error {
+	err := t.transport.Close()
+	t.client.CloseIdleConnections()
+	return err
+}
+
+// streamConn turns the two bodies of a HTTP/2 stream into a frameConn. The bodies have no deadlines,
+// an expired deadline closes the stream instead, which fails the pending read or write just the same.
+type streamConn struct {
+	reader     io.Reader
+	writer     io.Writer
+	closeFn    func() error
+	mutex      sync.Mutex
+	readTimer  *time.Timer
+	writeLimit time.Time
+	closeOnce  sync.Once
+	closeErr   error
+}
+
+func newStreamConn(reader io.Reader, writer io.Writer, closeFn func() error) *streamConn {
+	return &streamConn{reader: reader, writer: writer, closeFn: closeFn}
+}
+
+func (c *streamConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *streamConn) Write(p []byte) (int, error) {
+	c.mutex.Lock()
+	limit := c.writeLimit
+	c.mutex.Unlock()
+	if !limit.IsZero() {
+		wait := time.Until(limit)
+		if wait <= 0 {
+			return 0, fmt.Errorf("write deadline exceeded")
+		}
+		timer := time.AfterFunc(wait, func() { _ = c.Close() })
+		defer timer.Stop()
+	}
+	return c.writer.Write(p)
+}
+
+func (c *streamConn) SetReadDeadline(deadline time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.readTimer != nil {
+		c.readTimer.Stop()
+		c.readTimer = nil
+	}
+	if !deadline.IsZero() {
+		c.readTimer = time.AfterFunc(time.Until(deadline), func() { _ = c.Close() })
+	}
+	return nil
+}
+
+func (c *streamConn) SetWriteDeadline(deadline time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.writeLimit = deadline
+	return nil
+}
+
+func (c *streamConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.mutex.Lock()
+		if c.readTimer != nil {
+			c.readTimer.Stop()
+		}
+		c.mutex.Unlock()
+		c.closeErr = c.closeFn()
+	})
+	return c.closeErr
+}
+
+// H2Listener is the server side of H2Transport, it is a http.Handler to mount on a HTTP/2 server
+// (or one with unencrypted HTTP/2 enabled for h2c). Every accepted POST becomes a ServerConn.
+type H2Listener struct {
+	acceptChan   chan *ServerConn
+	authenticate Authenticator
+	mutex        sync.Mutex
+	closed       bool
+	done         chan struct{}
+}
+
+func NewH2Listener() *H2Listener {
+	return &H2Listener{
+		acceptChan: make(chan *ServerConn, h2AcceptChanSize),
+		done:       make(chan struct{}),
+	}
+}
+
+func (l *H2Listener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.ProtoMajor != 2 {
+		http.Error(w, "HTTP/2 required", http.StatusHTTPVersionNotSupported)
+		return
+	}
+
+	params := make(map[string]string, len(r.Header))
+	for k := range r.Header {
+		params[k] = r.Header.Get(k)
+	}
+	var clientID string
+	if l.authenticate != nil {
+		var err error
+		if clientID, err = l.authenticate(params); err != nil {
+			logger.Warn("[H2TP] accept %s, authenticate error: %v", r.RemoteAddr, err)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	controller := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(http.StatusOK)
+	if err := controller.Flush(); err != nil {
+		logger.Warn("[H2TP] accept %s, flush error: %v", r.RemoteAddr, err)
+		return
+	}
+
+	handlerDone := make(chan struct{})
+	conn := &handlerConn{body: r.Body, w: w, controller: controller, done: handlerDone}
+	remoteAddr, _ := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	serverConn := newServerConn(newFramedLink(conn, nil), params, remoteAddr)
+	serverConn.clientID = clientID
+
+	select {
+	case l.acceptChan <- serverConn:
+	case <-l.done:
+		return
+	case <-r.Context().Done():
+		return
+	}
+
+	// the stream lives as long as the handler, it ends when the conn is closed or the client went away
+	select {
+	case <-handlerDone:
+	case <-r.Context().Done():
+		_ = serverConn.Close()
+	case <-l.done:
+		_ = serverConn.Close()
+	}
+}
+
+// SetAuthenticator makes the listener refuse the streams whose conn params are refused, call it before serving.
+func (l *H2Listener) SetAuthenticator(authenticate Authenticator) {
+	l.authenticate = authenticate
+}
+
+func (l *H2Listener) Accept() (*ServerConn, error) {
+	select {
+	case conn := <-l.acceptChan:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *H2Listener) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if !l.closed {
+		l.closed = true
+		close(l.done)
+	}
+	return nil
+}
+
+// handlerConn is the server side frameConn of one HTTP/2 stream. The ResponseWriter must not be used
+// once the handler returned, so Close waits for a pending write and refuses any later call.
+type handlerConn struct {
+	body       io.ReadCloser
+	w          http.ResponseWriter
+	controller *http.ResponseController
+	mutex      sync.RWMutex
+	closed     bool
+	closeOnce  sync.Once
+	done       chan struct{}
+}
+
+func (c *handlerConn) Read(p []byte) (int, error) {
+	return c.body.Read(p)
+}
+
+func (c *handlerConn) Write(p []byte) (int, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	n, err := c.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, c.controller.Flush()
+}
+
+func (c *handlerConn) SetReadDeadline(deadline time.Time) error {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	return c.controller.SetReadDeadline(deadline)
+}
+
+func (c *handlerConn) SetWriteDeadline(deadline time.Time) error {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	return c.controller.SetWriteDeadline(deadline)
+}
+
+func (c *handlerConn) Close() error {
+	c.closeOnce.Do(func() {
+		_ = c.body.Close()
+		c.mutex.Lock()
+		c.closed = true
+		c.mutex.Unlock()
+		close(c.done)
+	})
+	return nil
+}
@@ -0,0 +1,349 @@
+package bridge
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/yangxm/gecko/base"
+	"github.com/yangxm/gecko/coder"
+	"github.com/yangxm/gecko/entity"
+	"google.golang.org/protobuf/proto"
+	"slices"
+)
+
+const (
+	ProtocolVersion    uint32 = 3
+	MinProtocolVersion uint32 = 1
+
+	CodecNone = "none"
+
+	handshakeRejected int32 = 1
+
+	handshakeKeyInfo = "gecko-bridge-v1 keys"
+)
+
+// requiredMsgTypes are the message types both ends must know, whatever features they negotiate.
+var requiredMsgTypes = []byte{
+	base.MsgTypeConnect, base.MsgTypeConnectAck, base.MsgTypeData, base.MsgTypeClose, base.MsgTypeError,
+	base.MsgTypeAck, base.MsgTypeResume, base.MsgTypeResumeAck,
+}
+
+// Capabilities is what one end of the bridge offers in the Hello, codecs in order of preference.
+// EncryptionKey is the pre-shared key of the client, any encryption but none needs it on both ends.
+type Capabilities struct {
+	Version       uint32
+	MessageTypes  []byte
+	Compressions  []string
+	Encryptions   []string
+	Obfuscations  []string
+	MaxFrameSize  uint32
+	EncryptionKey []byte
+}
+
+func DefaultCapabilities() Capabilities {
+	return Capabilities{
+		Version: ProtocolVersion,
+		MessageTypes: []byte{
+			base.MsgTypeConnect, base.MsgTypeConnectAck, base.MsgTypeData, base.MsgTypeClose, base.MsgTypeError,
+			base.MsgTypeWindowUpdate, base.MsgTypeHalfClose, base.MsgTypeAck, base.MsgTypeResume, base.MsgTypeResumeAck,
+			base.MsgTypeHello, base.MsgTypeHelloAck, base.MsgTypeBatch, base.MsgTypeFragment, base.MsgTypeCover,
+		},
+		Compressions: []string{coder.CodecDeflateFast, coder.CodecDeflate, CodecNone},
+		Encryptions:  []string{CodecNone},
+		Obfuscations: []string{CodecNone},
+		MaxFrameSize: transportMaxFrameSize,
+	}
+}
+
+func (c Capabilities) hello() *entity.Hello {
+	return &entity.Hello{
+		Version:      c.Version,
+		MsgTypes:     c.MessageTypes,
+		Compressions: c.Compressions,
+		Encryptions:  c.Encryptions,
+		Obfuscations: c.Obfuscations,
+		MaxFrameSize: c.MaxFrameSize,
+	}
+}
+
+// Negotiated is what both ends agreed on in the handshake, with the keys of the link when it is encrypted.
+type Negotiated struct {
+	Version      uint32
+	MessageTypes []byte
+	Compression  string
+	Encryption   string
+	Obfuscation  string
+	MaxFrameSize uint32
+	sealKey      []byte
+	openKey      []byte
+}
+
+func (n Negotiated) Supports(_type byte) bool {
+	return bytes.IndexByte(n.MessageTypes, _type) >= 0
+}
+
+// HandshakeError means the two ends can't talk to each other, reconnecting won't help.
+type HandshakeError struct {
+	Reason string
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("bridge handshake failed: %s", e.Reason)
+}
+
+// Negotiate is the server side of the handshake, it picks the parameters for the Hello of a client.
+// The returned HelloAck is to be sent back in any case, with a non zero code when the client is rejected.
+func Negotiate(local Capabilities, hello *entity.Hello) (*entity.Hello, Negotiated, error) {
+	negotiated, err := negotiate(local, hello)
+	var keyShare, keyConfirm []byte
+	if err == nil && negotiated.Encryption != CodecNone {
+		keyShare, keyConfirm, err = serverKeyExchange(local.EncryptionKey, hello.KeyShare, &negotiated)
+	}
+	if err != nil {
+		return &entity.Hello{Version: local.Version, Code: handshakeRejected, Message: err.Reason}, Negotiated{}, err
+	}
+	return &entity.Hello{
+		Version:      negotiated.Version,
+		MsgTypes:     negotiated.MessageTypes,
+		Compressions: []string{negotiated.Compression},
+		Encryptions:  []string{negotiated.Encryption},
+		Obfuscations: []string{negotiated.Obfuscation},
+		MaxFrameSize: negotiated.MaxFrameSize,
+		KeyShare:     keyShare,
+		KeyConfirm:   keyConfirm,
+	}, negotiated, nil
+}
+
+func negotiate(local Capabilities, hello *entity.Hello) (Negotiated, *HandshakeError) {
+	version := min(local.Version, hello.Version)
+	if version < MinProtocolVersion {
+		return Negotiated{}, &HandshakeError{Reason: fmt.Sprintf("protocol version %d not supported, local: %d ~ %d", hello.Version, MinProtocolVersion, local.Version)}
+	}
+
+	var msgTypes []byte
+	for _, _type := range hello.MsgTypes {
+		if bytes.IndexByte(local.MessageTypes, _type) >= 0 {
+			msgTypes = append(msgTypes, _type)
+		}
+	}
+	for _, _type := range requiredMsgTypes {
+		if bytes.IndexByte(msgTypes, _type) < 0 {
+			return Negotiated{}, &HandshakeError{Reason: fmt.Sprintf("message type 0x%02x not supported by both ends", _type)}
+		}
+	}
+
+	compression, ok := pickCodec(hello.Compressions, local.Compressions)
+	if !ok {
+		return Negotiated{}, &HandshakeError{Reason: fmt.Sprintf("no common compression codec, remote: %v, local: %v", hello.Compressions, local.Compressions)}
+	}
+	encryption, ok := pickCodec(hello.Encryptions, local.Encryptions)
+	if !ok {
+		return Negotiated{}, &HandshakeError{Reason: fmt.Sprintf("no common encryption codec, remote: %v, local: %v", hello.Encryptions, local.Encryptions)}
+	}
+	// a peer older than the obfuscations offers none
+	obfuscation := CodecNone
+	if len(hello.Obfuscations) > 0 {
+		if obfuscation, ok = pickCodec(hello.Obfuscations, local.Obfuscations); !ok {
+			return Negotiated{}, &HandshakeError{Reason: fmt.Sprintf("no common obfuscation codec, remote: %v, local: %v", hello.Obfuscations, local.Obfuscations)}
+		}
+	}
+
+	maxFrameSize := min(local.MaxFrameSize, hello.MaxFrameSize, transportMaxFrameBytes)
+	if maxFrameSize < fragmentMinFrameSize {
+		return Negotiated{}, &HandshakeError{Reason: fmt.Sprintf("max frame size %d below %d", maxFrameSize, fragmentMinFrameSize)}
+	}
+	return Negotiated{
+		Version:      version,
+		MessageTypes: msgTypes,
+		Compression:  compression,
+		Encryption:   encryption,
+		Obfuscation:  obfuscation,
+		MaxFrameSize: maxFrameSize,
+	}, nil
+}
+
+// pickCodec takes the first codec of the client preference the server supports too.
+func pickCodec(offered, supported []string) (string, bool) {
+	for _, codec := range offered {
+		if slices.Contains(supported, codec) {
+			return codec, true
+		}
+	}
+	return "", false
+}
+
+// clientHandshake is the client side of the handshake on one link, the key share is fresh for every link.
+type clientHandshake struct {
+	local Capabilities
+	hello *entity.Hello
+	key   *ecdh.PrivateKey
+}
+
+func newClientHandshake(local Capabilities) (*clientHandshake, error) {
+	h := &clientHandshake{local: local, hello: local.hello()}
+	if len(local.EncryptionKey) > 0 {
+		key, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("generate key share error: %v", err)
+		}
+		h.key = key
+		h.hello.KeyShare = key.PublicKey().Bytes()
+	}
+	return h, nil
+}
+
+// accept checks the parameters the server picked.
+func (h *clientHandshake) accept(ack *entity.Hello) (Negotiated, *HandshakeError) {
+	if ack.Code != 0 {
+		return Negotiated{}, &HandshakeError{Reason: fmt.Sprintf("rejected by the remote side, code: %d, message: %s", ack.Code, ack.Message)}
+	}
+	if len(ack.Compressions) != 1 || len(ack.Encryptions) != 1 {
+		return Negotiated{}, &HandshakeError{Reason: "remote side picked no codec"}
+	}
+	// the remote side picked from what we offered, so negotiating again must end up with the same
+	negotiated, err := negotiate(h.local, ack)
+	if err != nil {
+		return Negotiated{}, err
+	}
+	if negotiated.Version != ack.Version || negotiated.MaxFrameSize != ack.MaxFrameSize {
+		return Negotiated{}, &HandshakeError{Reason: fmt.Sprintf("remote side picked version %d, max frame size %d out of the offer", ack.Version, ack.MaxFrameSize)}
+	}
+	if negotiated.Encryption == CodecNone {
+		return negotiated, nil
+	}
+
+	if h.key == nil {
+		return Negotiated{}, &HandshakeError{Reason: fmt.Sprintf("remote side picked %s without a key", negotiated.Encryption)}
+	}
+	peer, keyErr := ecdh.X25519().NewPublicKey(ack.KeyShare)
+	if keyErr != nil {
+		return Negotiated{}, &HandshakeError{Reason: fmt.Sprintf("illegal key share: %v", keyErr)}
+	}
+	shared, keyErr := h.key.ECDH(peer)
+	if keyErr != nil {
+		return Negotiated{}, &HandshakeError{Reason: fmt.Sprintf("key exchange error: %v", keyErr)}
+	}
+	keys, err := deriveKeys(shared, h.local.EncryptionKey, h.hello.KeyShare, ack.KeyShare)
+	if err != nil {
+		return Negotiated{}, err
+	}
+	if !hmac.Equal(keys.confirm, ack.KeyConfirm) {
+		return Negotiated{}, &HandshakeError{Reason: "key confirmation failed, the encryption keys of both ends differ"}
+	}
+	negotiated.sealKey, negotiated.openKey = keys.clientToServer, keys.serverToClient
+	return negotiated, nil
+}
+
+func serverKeyExchange(psk, clientShare []byte, negotiated *Negotiated) ([]byte, []byte, *HandshakeError) {
+	if len(psk) == 0 {
+		return nil, nil, &HandshakeError{Reason: fmt.Sprintf("no key to use %s with", negotiated.Encryption)}
+	}
+	peer, err := ecdh.X25519().NewPublicKey(clientShare)
+	if err != nil {
+		return nil, nil, &HandshakeError{Reason: fmt.Sprintf("illegal key share: %v", err)}
+	}
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, &HandshakeError{Reason: fmt.Sprintf("generate key share error: %v", err)}
+	}
+	shared, err := key.ECDH(peer)
+	if err != nil {
+		return nil, nil, &HandshakeError{Reason: fmt.Sprintf("key exchange error: %v", err)}
+	}
+	serverShare := key.PublicKey().Bytes()
+	keys, handshakeErr := deriveKeys(shared, psk, clientShare, serverShare)
+	if handshakeErr != nil {
+		return nil, nil, handshakeErr
+	}
+	negotiated.sealKey, negotiated.openKey = keys.serverToClient, keys.clientToServer
+	return serverShare, keys.confirm, nil
+}
+
+type linkKeys struct {
+	clientToServer []byte
+	serverToClient []byte
+	confirm        []byte
+}
+
+// deriveKeys mixes the pre-shared key of the client into the X25519 secret, a man in the middle without it
+// ends up with other keys and fails the key confirmation.
+func deriveKeys(shared, psk, clientShare, serverShare []byte) (*linkKeys, *HandshakeError) {
+	info := append(append([]byte(handshakeKeyInfo), clientShare...), serverShare...)
+	material, err := hkdf.Key(sha256.New, shared, psk, string(info), 3*coder.AEADKeySize)
+	if err != nil {
+		return nil, &HandshakeError{Reason: fmt.Sprintf("derive keys error: %v", err)}
+	}
+	return &linkKeys{
+		clientToServer: material[:coder.AEADKeySize],
+		serverToClient: material[coder.AEADKeySize : 2*coder.AEADKeySize],
+		confirm:        material[2*coder.AEADKeySize:],
+	}, nil
+}
+
+// linkCodecs is the codec chain of one link, the keyed codecs in it get the keys of its handshake.
+// Once an encryption is negotiated every stream frame must end with its TV, a frame without one could
+// come from anyone able to see the header.
+type linkCodecs struct {
+	chain    coder.Chain
+	sealType int32
+	sealed   bool
+}
+
+var errNotSealed = errors.New("stream frame not encrypted")
+
+// newLinkCodecs puts compression first as encrypted data doesn't compress, and the padding before the
+// encryption so it is encrypted as well.
+func newLinkCodecs(registry *coder.Registry, negotiated Negotiated) (*linkCodecs, *HandshakeError) {
+	c := &linkCodecs{}
+	for _, name := range []string{negotiated.Compression, negotiated.Obfuscation, negotiated.Encryption} {
+		if name == CodecNone {
+			continue
+		}
+		codec, ok := registry.Lookup(name)
+		if !ok {
+			return nil, &HandshakeError{Reason: fmt.Sprintf("codec %s negotiated but not registered", name)}
+		}
+		if keyed, ok := codec.(coder.KeyedCodec); ok {
+			instance, err := keyed.WithKeys(negotiated.sealKey, negotiated.openKey)
+			if err != nil {
+				return nil, &HandshakeError{Reason: err.Error()}
+			}
+			codec = instance
+		}
+		c.chain = append(c.chain, codec)
+	}
+	if negotiated.Encryption != CodecNone && len(c.chain) > 0 {
+		c.sealType, c.sealed = c.chain[len(c.chain)-1].Type(), true
+	}
+	return c, nil
+}
+
+func (c *linkCodecs) encode(message *entity.Message) error {
+	return c.chain.Encode(message)
+}
+
+// decodes tells whether a received message has to go through decode.
+func (c *linkCodecs) decodes(message *entity.Message) bool {
+	return len(message.Tvs) > 0 || c.sealed && isStreamMessage(message.Header.Type[0])
+}
+
+// decode undoes the codec chain of a received message and marshals it again with the plain payload.
+func (c *linkCodecs) decode(message *entity.Message) ([]byte, error) {
+	if c.sealed && isStreamMessage(message.Header.Type[0]) {
+		if n := len(message.Tvs); n == 0 || message.Tvs[n-1].Type != c.sealType {
+			return nil, errNotSealed
+		}
+	}
+	decoded, err := c.chain.Decode(message)
+	if err != nil {
+		return nil, err
+	}
+	message.Data = decoded
+	message.Tvs = nil
+	return proto.Marshal(message)
+}
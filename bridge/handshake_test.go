@@ -0,0 +1,104 @@
+package bridge
+
+import (
+	"bytes"
+	"github.com/google/uuid"
+	"github.com/yangxm/gecko/base"
+	"github.com/yangxm/gecko/coder"
+	"github.com/yangxm/gecko/entity"
+	"google.golang.org/protobuf/proto"
+	"testing"
+)
+
+// newSealedCodecs returns the codecs of both ends of a link encrypted with chacha20-poly1305.
+func newSealedCodecs(t *testing.T) (*linkCodecs, Negotiated) {
+	a, b := bytes.Repeat([]byte{0x01}, coder.AEADKeySize), bytes.Repeat([]byte{0x02}, coder.AEADKeySize)
+	negotiated := Negotiated{Compression: CodecNone, Obfuscation: CodecNone, Encryption: coder.CodecChaCha20Poly1305}
+	client := negotiated
+	client.sealKey, client.openKey = a, b
+	codecs, err := newLinkCodecs(coder.DefaultRegistry, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	negotiated.sealKey, negotiated.openKey = b, a
+	return codecs, negotiated
+}
+
+func TestServerConnDropsUnsealedStreamFrames(t *testing.T) {
+	client, server := newMemoryLinkPair(LinkConditions{}, nil)
+	defer client.Close()
+	conn := newServerConn(server, nil, memoryAddr("test"))
+	codecs, negotiated := newSealedCodecs(t)
+	if err := conn.SetNegotiated(negotiated, nil); err != nil {
+		t.Fatal(err)
+	}
+	recorder := &frameRecorder{}
+	connID := uuid.New().String()
+	frame := func(_type byte, seal bool, tamper func(message *entity.Message)) []byte {
+		message, err := coder.NewMessage(_type, base.MsgFlagToServer, "c1", connID, 0x00, []byte("data"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seal {
+			if err := codecs.encode(message); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if tamper != nil {
+			tamper(message)
+		}
+		data, err := proto.Marshal(message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	conn.dispatch(frame(base.MsgTypeData, true, nil), recorder, false)
+	if got := recorder.received(); !bytes.Equal(got, []byte{base.MsgTypeData}) {
+		t.Fatalf("sealed frame, received: %v", got)
+	}
+	for name, data := range map[string][]byte{
+		"plain data":  frame(base.MsgTypeData, false, nil),
+		"plain close": frame(base.MsgTypeClose, false, nil),
+		"plain error": frame(base.MsgTypeError, false, nil),
+		"stripped tv": frame(base.MsgTypeData, true, func(message *entity.Message) { message.Tvs = nil }),
+		"tv out of the chain": frame(base.MsgTypeData, true, func(message *entity.Message) {
+			message.Tvs = append([]*entity.MessageTV{{Type: coder.TVTypeDeflate}}, message.Tvs...)
+		}),
+		"tv after the seal": frame(base.MsgTypeData, true, func(message *entity.Message) {
+			message.Tvs = append(message.Tvs, &entity.MessageTV{Type: coder.TVTypePadding, Value: "0"})
+		}),
+		"tampered seq": frame(base.MsgTypeData, true, func(message *entity.Message) { message.Header.Seq++ }),
+	} {
+		conn.dispatch(data, recorder, false)
+		if got := recorder.received(); len(got) != 1 {
+			t.Fatalf("%s, received: %v", name, got)
+		}
+	}
+	// a frame outside the streams has nothing to seal
+	conn.dispatch(frame(base.MsgTypeAck, false, nil), recorder, false)
+	if got := recorder.received(); len(got) != 2 {
+		t.Fatalf("plain ack, received: %v", got)
+	}
+}
+
+func TestLinkCodecsDecodeWithTheNegotiatedChainOnly(t *testing.T) {
+	// a codec of the registry the link didn't negotiate
+	message, err := coder.NewMessage(base.MsgTypeAck, base.MsgFlagToClient, "", "", 0x00, []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deflate, _ := coder.DefaultRegistry.Lookup(coder.CodecDeflate)
+	message.Data = bytes.Repeat([]byte("data"), 100)
+	if err := (coder.Chain{deflate}).Encode(message); err != nil || len(message.Tvs) != 1 {
+		t.Fatalf("deflate: %v, %v", message.Tvs, err)
+	}
+	codecs, _ := newSealedCodecs(t)
+	if _, err := codecs.decode(message); err == nil {
+		t.Fatal("decoded with a codec out of the chain")
+	}
+	if _, err := (&linkCodecs{}).decode(message); err == nil {
+		t.Fatal("decoded before the handshake")
+	}
+}
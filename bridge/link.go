@@ -0,0 +1,171 @@
+package bridge
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type wsLink struct {
+	conn *websocket.Conn
+}
+
+func newWsLink(conn *websocket.Conn, onPong func(payload []byte)) *wsLink {
+	conn.SetReadLimit(transportMaxFrameBytes)
+	if onPong != nil {
+		conn.SetPongHandler(func(appData string) error {
+			onPong([]byte(appData))
+			return nil
+		})
+	}
+	return &wsLink{conn: conn}
+}
+
+func (l *wsLink) ReadFrame() ([]byte, error) {
+	_, data, err := l.conn.ReadMessage()
+	return data, err
+}
+
+func (l *wsLink) WriteFrame(data []byte, deadline time.Time) error {
+	if err := l.conn.SetWriteDeadline(deadline); err != nil {
+		return fmt.Errorf("set write deadline error: %v", err)
+	}
+	return l.conn.WriteMessage(websocket.BinaryMessage, data)
+}
+
+func (l *wsLink) WritePing(payload []byte, deadline time.Time) error {
+	return l.conn.WriteControl(websocket.PingMessage, payload, deadline)
+}
+
+func (l *wsLink) SetReadDeadline(deadline time.Time) error {
+	return l.conn.SetReadDeadline(deadline)
+}
+
+// SetReadLimit fails the read of a larger message and closes the connection.
+func (l *wsLink) SetReadLimit(limit int) {
+	l.conn.SetReadLimit(int64(limit))
+}
+
+func (l *wsLink) Close() error {
+	return l.conn.Close()
+}
+
+const (
+	frameKindData   byte = 0x00
+	frameKindPing   byte = 0x01
+	frameKindPong   byte = 0x02
+	frameKindParams byte = 0x03
+
+	frameHeaderSize = 5
+)
+
+// frameConn is the byte stream under a framedLink, a net.Conn or one HTTP/2 stream.
+type frameConn interface {
+	io.ReadWriteCloser
+	SetReadDeadline(deadline time.Time) error
+	SetWriteDeadline(deadline time.Time) error
+}
+
+// framedLink carries frames over a plain stream connection, every frame is a 4 bytes big endian
+// payload length, 1 byte kind and the payload. Pings are answered by the reading side.
+type framedLink struct {
+	conn        frameConn
+	reader      *bufio.Reader
+	onPong      func(payload []byte)
+	maxFrameLen int
+	readLimit   atomic.Int64
+	writeMutex  sync.Mutex
+}
+
+func newFramedLink(conn frameConn, onPong func(payload []byte)) *framedLink {
+	l := &framedLink{
+		conn:        conn,
+		reader:      bufio.NewReader(conn),
+		onPong:      onPong,
+		maxFrameLen: transportMaxFrameBytes,
+	}
+	l.readLimit.Store(transportMaxFrameBytes)
+	return l
+}
+
+func (l *framedLink) readFrame() (byte, []byte, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(l.reader, header[:]); err != nil {
+		return 0, nil, err
+	}
+	length := int(binary.BigEndian.Uint32(header[:4]))
+	if limit := int(l.readLimit.Load()); length > limit {
+		return 0, nil, fmt.Errorf("frame too large: %d > %d", length, limit)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(l.reader, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[4], payload, nil
+}
+
+func (l *framedLink) writeFrame(kind byte, payload []byte, deadline time.Time) error {
+	if len(payload) > l.maxFrameLen {
+		return fmt.Errorf("frame too large: %d > %d", len(payload), l.maxFrameLen)
+	}
+	frame := make([]byte, frameHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(frame[:4], uint32(len(payload)))
+	frame[4] = kind
+	copy(frame[frameHeaderSize:], payload)
+
+	l.writeMutex.Lock()
+	defer l.writeMutex.Unlock()
+	if err := l.conn.SetWriteDeadline(deadline); err != nil {
+		return fmt.Errorf("set write deadline error: %v", err)
+	}
+	_, err := l.conn.Write(frame)
+	return err
+}
+
+func (l *framedLink) ReadFrame() ([]byte, error) {
+	for {
+		kind, payload, err := l.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch kind {
+		case frameKindData:
+			return payload, nil
+		case frameKindPing:
+			if err := l.writeFrame(frameKindPong, payload, time.Now().Add(transportWriteWait)); err != nil {
+				return nil, fmt.Errorf("write pong error: %v", err)
+			}
+		case frameKindPong:
+			if l.onPong != nil {
+				l.onPong(payload)
+			}
+		default:
+			return nil, fmt.Errorf("unexpected frame kind: 0x%02x", kind)
+		}
+	}
+}
+
+func (l *framedLink) WriteFrame(data []byte, deadline time.Time) error {
+	return l.writeFrame(frameKindData, data, deadline)
+}
+
+func (l *framedLink) WritePing(payload []byte, deadline time.Time) error {
+	return l.writeFrame(frameKindPing, payload, deadline)
+}
+
+func (l *framedLink) SetReadDeadline(deadline time.Time) error {
+	return l.conn.SetReadDeadline(deadline)
+}
+
+func (l *framedLink) SetReadLimit(limit int) {
+	l.readLimit.Store(int64(limit))
+}
+
+func (l *framedLink) Close() error {
+	return l.conn.Close()
+}
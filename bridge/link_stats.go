@@ -0,0 +1,117 @@
+package bridge
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+const (
+	linkLossWindow = 32
+)
+
+type LinkStats struct {
+	RTT           time.Duration // last sample
+	SmoothedRTT   time.Duration
+	Jitter        time.Duration // smoothed mean deviation of the RTT
+	Loss          float64       // fraction of the recent pings that got no pong in time, 0 ~ 1
+	PingsSent     uint64
+	PongsReceived uint64
+	LastPong      time.Time
+}
+
+type pingSample struct {
+	id       uint64
+	sentAt   time.Time
+	answered bool
+}
+
+// linkMeter estimates the link quality from numbered pings, SmoothedRTT and Jitter follow RFC 6298.
+// The send time stays here, with its monotonic reading, the ping only carries the number.
+type linkMeter struct {
+	mutex   sync.Mutex
+	stats   LinkStats
+	samples [linkLossWindow]pingSample
+	next    uint64
+}
+
+func encodePingPayload(id uint64) []byte {
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint64(payload, id)
+	return payload
+}
+
+func decodePingPayload(payload []byte) (uint64, bool) {
+	if len(payload) != 8 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(payload), true
+}
+
+// onPing records a ping sent at sentAt and returns its payload.
+func (m *linkMeter) onPing(sentAt time.Time) []byte {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.next++
+	m.samples[m.next%linkLossWindow] = pingSample{id: m.next, sentAt: sentAt}
+	m.stats.PingsSent++
+	return encodePingPayload(m.next)
+}
+
+// onPong takes the RTT from the send time of the ping it answers, a pong of a ping gone from the window
+// or answered already is not a sample.
+func (m *linkMeter) onPong(payload []byte, now time.Time) (time.Duration, bool) {
+	id, ok := decodePingPayload(payload)
+	if !ok || id == 0 {
+		return 0, false
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	sample := &m.samples[id%linkLossWindow]
+	if sample.id != id || sample.answered {
+		return 0, false
+	}
+	sample.answered = true
+	rtt := max(now.Sub(sample.sentAt), 0)
+
+	m.stats.PongsReceived++
+	m.stats.LastPong = now
+	m.stats.RTT = rtt
+	if m.stats.SmoothedRTT == 0 {
+		m.stats.SmoothedRTT = rtt
+		m.stats.Jitter = rtt / 2
+	} else {
+		deviation := m.stats.SmoothedRTT - rtt
+		if deviation < 0 {
+			deviation = -deviation
+		}
+		m.stats.Jitter = (3*m.stats.Jitter + deviation) / 4
+		m.stats.SmoothedRTT = (7*m.stats.SmoothedRTT + rtt) / 8
+	}
+	return rtt, true
+}
+
+// snapshot counts a ping as lost once it waited longer than pongWait without a pong.
+func (m *linkMeter) snapshot(pongWait time.Duration, now time.Time) LinkStats {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	stats := m.stats
+	total, lost := 0, 0
+	for _, sample := range m.samples {
+		if sample.sentAt.IsZero() {
+			continue
+		}
+		if !sample.answered && now.Sub(sample.sentAt) < pongWait {
+			continue
+		}
+		total++
+		if !sample.answered {
+			lost++
+		}
+	}
+	if total > 0 {
+		stats.Loss = float64(lost) / float64(total)
+	}
+	return stats
+}
@@ -0,0 +1,50 @@
+package bridge
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLinkMeterRTT(t *testing.T) {
+	var m linkMeter
+	sentAt := time.Now()
+	payload := m.onPing(sentAt)
+	rtt, ok := m.onPong(payload, sentAt.Add(30*time.Millisecond))
+	if !ok || rtt != 30*time.Millisecond {
+		t.Fatalf("rtt: %v, %v", rtt, ok)
+	}
+	if _, ok := m.onPong(payload, sentAt.Add(40*time.Millisecond)); ok {
+		t.Fatal("second pong of a ping counted")
+	}
+	if _, ok := m.onPong(encodePingPayload(99), sentAt); ok {
+		t.Fatal("pong of an unknown ping counted")
+	}
+	stats := m.snapshot(time.Second, sentAt.Add(time.Minute))
+	if stats.SmoothedRTT != 30*time.Millisecond || stats.PongsReceived != 1 || stats.Loss != 0 {
+		t.Fatalf("stats: %+v", stats)
+	}
+}
+
+func TestLinkMeterClampsNegativeRTT(t *testing.T) {
+	var m linkMeter
+	sentAt := time.Now()
+	payload := m.onPing(sentAt)
+	rtt, ok := m.onPong(payload, sentAt.Add(-5*time.Millisecond))
+	if !ok || rtt != 0 {
+		t.Fatalf("rtt: %v, %v", rtt, ok)
+	}
+	if stats := m.snapshot(time.Second, sentAt); stats.SmoothedRTT < 0 || stats.Jitter < 0 {
+		t.Fatalf("stats: %+v", stats)
+	}
+}
+
+func TestLinkMeterLoss(t *testing.T) {
+	var m linkMeter
+	start := time.Now()
+	answered := m.onPing(start)
+	m.onPing(start)
+	m.onPong(answered, start.Add(10*time.Millisecond))
+	if stats := m.snapshot(time.Second, start.Add(2*time.Second)); stats.Loss != 0.5 || stats.PingsSent != 2 {
+		t.Fatalf("stats: %+v", stats)
+	}
+}
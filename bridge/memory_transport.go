@@ -0,0 +1,405 @@
+package bridge
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/yangxm/gecko/base"
+	"github.com/yangxm/gecko/logger"
+	"io"
+	"math/rand/v2"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	memMaxBacklog      = time.Second
+	memInboxFrames     = 1024
+	memAcceptChanSize  = 16
+	memAddrNetworkName = "memory"
+)
+
+// LinkConditions degrade the links of a memory listener. A link is an ordered stream like the network ones,
+// so the frames never overtake each other, and a lost frame resets the link it was sent on the way a broken
+// connection would. The session resume of the transport is what gets the streams through.
+type LinkConditions struct {
+	Latency   time.Duration // one way delay of every frame
+	Jitter    time.Duration // random extra delay, 0 ~ Jitter
+	Loss      float64       // fraction of the frames lost, 0 ~ 1
+	Bandwidth int           // bytes per second, 0 is unlimited
+}
+
+// MemoryTransport carries the bridge frames over in-process links to a MemoryListener, so the client and the
+// server side run in the same process, in tests or when the bridge is embedded. It goes through the same
+// handshake, session resume, batching and fragments as the network transports.
+type MemoryTransport struct {
+	*transport
+	listener *MemoryListener
+}
+
+func NewMemoryTransport(listener *MemoryListener, connParamGetter func() map[string]string, receiver base.BridgeReceiver, opts ...Option) (*MemoryTransport, error) {
+	t := &MemoryTransport{listener: listener}
+	t.transport = newTransport("MEMTP", memAddrNetworkName, t.dial, connParamGetter, receiver, opts)
+	if err := t.start(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *MemoryTransport) dial(ctx context.Context, params map[string]string, onPong func(payload []byte)) (link, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return t.listener.dial(params, onPong)
+}
+
+type memoryAddr string
+
+func (a memoryAddr) Network() string {
+	return memAddrNetworkName
+}
+
+func (a memoryAddr) String() string {
+	return string(a)
+}
+
+// MemoryListener is the server side of MemoryTransport, every link dialed to it becomes a ServerConn.
+type MemoryListener struct {
+	mutex        sync.Mutex
+	conditions   LinkConditions
+	authenticate Authenticator
+	acceptChan   chan *ServerConn
+	links        int
+	closed       bool
+	done         chan struct{}
+}
+
+func ListenMemory(conditions LinkConditions) *MemoryListener {
+	logger.Debug("[MEMTP] listening, conditions: %+v", conditions)
+	return &MemoryListener{
+		conditions: conditions,
+		acceptChan: make(chan *ServerConn, memAcceptChanSize),
+		done:       make(chan struct{}),
+	}
+}
+
+// SetAuthenticator makes the listener refuse the links whose conn params are refused, call it before dialing.
+func (l *MemoryListener) SetAuthenticator(authenticate Authenticator) {
+	l.authenticate = authenticate
+}
+
+// SetConditions changes the conditions of the links dialed from now on.
+func (l *MemoryListener) SetConditions(conditions LinkConditions) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.conditions = conditions
+}
+
+func (l *MemoryListener) dial(params map[string]string, onPong func(payload []byte)) (link, error) {
+	var clientID string
+	if l.authenticate != nil {
+		var err error
+		if clientID, err = l.authenticate(params); err != nil {
+			return nil, fmt.Errorf("authenticate error: %v", err)
+		}
+	}
+
+	l.mutex.Lock()
+	if l.closed {
+		l.mutex.Unlock()
+		return nil, fmt.Errorf("listener closed")
+	}
+	l.links++
+	addr := memoryAddr(fmt.Sprintf("memory-%d", l.links))
+	conditions := l.conditions
+	l.mutex.Unlock()
+
+	client, server := newMemoryLinkPair(conditions, onPong)
+	serverConn := newServerConn(server, params, addr)
+	serverConn.clientID = clientID
+	select {
+	case l.acceptChan <- serverConn:
+	case <-l.done:
+		_ = client.Close()
+		return nil, fmt.Errorf("listener closed")
+	default:
+		_ = client.Close()
+		return nil, fmt.Errorf("accept backlog full")
+	}
+	logger.Debug("[MEMTP] link %s opened, params: %d", addr, len(params))
+	return client, nil
+}
+
+func (l *MemoryListener) Accept() (*ServerConn, error) {
+	select {
+	case conn := <-l.acceptChan:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting, the links already accepted are left to their ServerConn.
+func (l *MemoryListener) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	close(l.done)
+	return nil
+}
+
+type memoryFrame struct {
+	kind      byte
+	data      []byte
+	deliverAt time.Time
+}
+
+// memoryConn is shared by the two ends of a link, closing either of them closes both.
+type memoryConn struct {
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func (c *memoryConn) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+}
+
+// memoryLink is one end of an in-process link, it reads the frames the other end wrote and answers the pings.
+type memoryLink struct {
+	conn            *memoryConn
+	line            *memoryLine
+	inbox           chan memoryFrame
+	onPong          func(payload []byte)
+	readLimit       atomic.Int64
+	mutex           sync.Mutex
+	deadline        time.Time
+	deadlineChanged chan struct{}
+}
+
+func newMemoryLinkPair(conditions LinkConditions, onPong func(payload []byte)) (*memoryLink, *memoryLink) {
+	conn := &memoryConn{done: make(chan struct{})}
+	client := newMemoryLink(conn, onPong)
+	server := newMemoryLink(conn, nil)
+	client.line = newMemoryLine(conn, conditions, server.inbox)
+	server.line = newMemoryLine(conn, conditions, client.inbox)
+	return client, server
+}
+
+func newMemoryLink(conn *memoryConn, onPong func(payload []byte)) *memoryLink {
+	l := &memoryLink{
+		conn:            conn,
+		inbox:           make(chan memoryFrame, memInboxFrames),
+		onPong:          onPong,
+		deadlineChanged: make(chan struct{}),
+	}
+	l.readLimit.Store(transportMaxFrameBytes)
+	return l
+}
+
+func (l *memoryLink) ReadFrame() ([]byte, error) {
+	for {
+		l.mutex.Lock()
+		deadline, changed := l.deadline, l.deadlineChanged
+		l.mutex.Unlock()
+		var timeout <-chan time.Time
+		var timer *time.Timer
+		if !deadline.IsZero() {
+			timer = time.NewTimer(time.Until(deadline))
+			timeout = timer.C
+		}
+
+		var frame memoryFrame
+		var err error
+		select {
+		case frame = <-l.inbox:
+		case <-l.conn.done:
+			err = io.EOF
+		case <-timeout:
+			err = os.ErrDeadlineExceeded
+		case <-changed:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch frame.kind {
+		case frameKindData:
+			if limit := int(l.readLimit.Load()); len(frame.data) > limit {
+				l.conn.close()
+				return nil, fmt.Errorf("frame too large: %d > %d", len(frame.data), limit)
+			}
+			return frame.data, nil
+		case frameKindPing:
+			if err := l.line.send(frameKindPong, frame.data, time.Now().Add(transportWriteWait)); err != nil {
+				return nil, fmt.Errorf("write pong error: %v", err)
+			}
+		case frameKindPong:
+			if l.onPong != nil {
+				l.onPong(frame.data)
+			}
+		}
+	}
+}
+
+func (l *memoryLink) WriteFrame(data []byte, deadline time.Time) error {
+	if len(data) > transportMaxFrameBytes {
+		return fmt.Errorf("frame too large: %d > %d", len(data), transportMaxFrameBytes)
+	}
+	return l.line.send(frameKindData, data, deadline)
+}
+
+func (l *memoryLink) WritePing(payload []byte, deadline time.Time) error {
+	return l.line.send(frameKindPing, payload, deadline)
+}
+
+func (l *memoryLink) SetReadDeadline(deadline time.Time) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.deadline = deadline
+	close(l.deadlineChanged)
+	l.deadlineChanged = make(chan struct{})
+	return nil
+}
+
+func (l *memoryLink) SetReadLimit(limit int) {
+	l.readLimit.Store(int64(limit))
+}
+
+func (l *memoryLink) Close() error {
+	l.conn.close()
+	return nil
+}
+
+// memoryLine is one direction of a link, it delivers the frames in order once they are due.
+type memoryLine struct {
+	conn       *memoryConn
+	mutex      sync.Mutex
+	conditions LinkConditions
+	queue      []memoryFrame
+	lastDue    time.Time
+	busyUntil  time.Time // when the frames sent so far have passed the bandwidth cap
+	inbox      chan memoryFrame
+	wake       chan struct{}
+}
+
+func newMemoryLine(conn *memoryConn, conditions LinkConditions, inbox chan memoryFrame) *memoryLine {
+	l := &memoryLine{
+		conn:       conn,
+		conditions: conditions,
+		inbox:      inbox,
+		wake:       make(chan struct{}, 1),
+	}
+	go l.deliverLoop()
+	return l
+}
+
+// send queues the frame, it blocks while the bandwidth cap holds back more than memMaxBacklog.
+func (l *memoryLine) send(kind byte, data []byte, deadline time.Time) error {
+	select {
+	case <-l.conn.done:
+		return net.ErrClosed
+	default:
+	}
+
+	l.mutex.Lock()
+	c := l.conditions
+	now := time.Now()
+	if c.Loss > 0 && rand.Float64() < c.Loss {
+		l.mutex.Unlock()
+		logger.Debug("[MEMTP] frame of %d lost, reset the link", len(data))
+		l.conn.close()
+		return nil
+	}
+
+	sentAt := now
+	if c.Bandwidth > 0 {
+		if l.busyUntil.After(now) {
+			sentAt = l.busyUntil
+		}
+		sentAt = sentAt.Add(time.Duration(len(data)) * time.Second / time.Duration(c.Bandwidth))
+		l.busyUntil = sentAt
+	}
+	deliverAt := sentAt.Add(c.Latency)
+	if c.Jitter > 0 {
+		deliverAt = deliverAt.Add(rand.N(c.Jitter))
+	}
+	if deliverAt.Before(l.lastDue) {
+		deliverAt = l.lastDue
+	}
+	l.lastDue = deliverAt
+	l.queue = append(l.queue, memoryFrame{kind: kind, data: bytes.Clone(data), deliverAt: deliverAt})
+	backlog := l.busyUntil.Sub(now)
+	l.mutex.Unlock()
+	notify(l.wake)
+
+	if backlog > memMaxBacklog {
+		timer := time.NewTimer(backlog - memMaxBacklog)
+		defer timer.Stop()
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			deadlineTimer := time.NewTimer(time.Until(deadline))
+			defer deadlineTimer.Stop()
+			timeout = deadlineTimer.C
+		}
+		select {
+		case <-timer.C:
+		case <-timeout:
+			return os.ErrDeadlineExceeded
+		case <-l.conn.done:
+			return net.ErrClosed
+		}
+	}
+	return nil
+}
+
+func (l *memoryLine) deliverLoop() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		l.mutex.Lock()
+		var due []memoryFrame
+		now := time.Now()
+		for len(l.queue) > 0 && !l.queue[0].deliverAt.After(now) {
+			due = append(due, l.queue[0])
+			l.queue = l.queue[1:]
+		}
+		wait := time.Hour
+		if len(l.queue) > 0 {
+			wait = l.queue[0].deliverAt.Sub(now)
+		}
+		l.mutex.Unlock()
+
+		for _, frame := range due {
+			select {
+			case l.inbox <- frame:
+			case <-l.conn.done:
+				return
+			}
+		}
+
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case <-l.wake:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+		case <-l.conn.done:
+			return
+		}
+	}
+}
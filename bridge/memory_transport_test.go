@@ -0,0 +1,353 @@
+package bridge
+
+import (
+	"bytes"
+	"crypto/rand"
+	"github.com/google/uuid"
+	"github.com/yangxm/gecko/base"
+	"github.com/yangxm/gecko/coder"
+	"github.com/yangxm/gecko/entity"
+	"github.com/yangxm/gecko/logger"
+	"google.golang.org/protobuf/proto"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "bridge-test")
+	if err != nil {
+		panic(err)
+	}
+	config := filepath.Join(dir, "log.yaml")
+	if err := os.WriteFile(config, []byte("log:\n  level: fatal\n  format: console\n  output: [stdout]\n"), 0o600); err != nil {
+		panic(err)
+	}
+	if err := logger.InitLogger(config); err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// testServer is the server receiver the bridge leaves to its users: it answers the Hello and the resume,
+// acks every stream frame and keeps what the streams carried.
+type testServer struct {
+	listener     *MemoryListener
+	silentHello  atomic.Bool
+	rejectHello  atomic.Bool
+	silentResume atomic.Bool
+	refuseResume atomic.Int32
+	silentAck    atomic.Bool
+
+	mutex    sync.Mutex
+	sessions map[string]map[string]uint64
+	received map[string]*bytes.Buffer
+	conns    []*ServerConn
+	links    int
+	resumes  int
+	refused  int
+	gaps     int
+	changed  chan struct{}
+}
+
+func newTestServer(t *testing.T, conditions LinkConditions) *testServer {
+	s := &testServer{
+		listener: ListenMemory(conditions),
+		sessions: make(map[string]map[string]uint64),
+		received: make(map[string]*bytes.Buffer),
+		changed:  make(chan struct{}, 1),
+	}
+	go s.serve(s.listener.Accept)
+	t.Cleanup(func() {
+		_ = s.listener.Close()
+	})
+	return s
+}
+
+// serve answers every conn accept returns, until it fails.
+func (s *testServer) serve(accept func() (*ServerConn, error)) {
+	for {
+		conn, err := accept()
+		if err != nil {
+			return
+		}
+		s.mutex.Lock()
+		s.conns = append(s.conns, conn)
+		s.links++
+		s.mutex.Unlock()
+		go func() {
+			_ = conn.Serve(&testServerReceiver{server: s, conn: conn})
+		}()
+	}
+}
+
+func (s *testServer) dial(t *testing.T, receiver base.BridgeReceiver, opts ...Option) *MemoryTransport {
+	opts = append([]Option{WithBackoffPolicy(BackoffPolicy{Initial: 10 * time.Millisecond, Max: 50 * time.Millisecond, Multiplier: 2})}, opts...)
+	transport, err := NewMemoryTransport(s.listener, nil, receiver, opts...)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = transport.Close()
+	})
+	return transport
+}
+
+// waitFor polls cond under the server mutex until it holds.
+func (s *testServer) waitFor(t *testing.T, timeout time.Duration, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		s.mutex.Lock()
+		ok := cond()
+		s.mutex.Unlock()
+		if ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("condition not met after %v", timeout)
+		}
+		select {
+		case <-s.changed:
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+type testServerReceiver struct {
+	server    *testServer
+	conn      *ServerConn
+	sessionID string
+}
+
+func (r *testServerReceiver) OnReceived(data []byte) {
+	var message entity.Message
+	if err := proto.Unmarshal(data, &message); err != nil {
+		return
+	}
+	header := message.GetHeader()
+	switch header.Type[0] {
+	case base.MsgTypeHello:
+		r.hello(message.Data)
+	case base.MsgTypeResume:
+		r.resume(message.Data)
+	default:
+		r.stream(header, message.Data)
+	}
+}
+
+func (r *testServerReceiver) hello(data []byte) {
+	if r.server.silentHello.Load() {
+		return
+	}
+	var hello entity.Hello
+	if err := proto.Unmarshal(data, &hello); err != nil {
+		return
+	}
+	ack, negotiated, err := Negotiate(DefaultCapabilities(), &hello)
+	if r.server.rejectHello.Load() {
+		ack, err = &entity.Hello{Version: ProtocolVersion, Code: handshakeRejected, Message: "client refused"}, &HandshakeError{Reason: "client refused"}
+	}
+	ackData, _ := proto.Marshal(ack)
+	_, _ = r.conn.Send(base.MsgTypeHelloAck, base.MsgFlagToClient, "", "", 0x00, ackData)
+	if err == nil {
+		_ = r.conn.SetNegotiated(negotiated, nil)
+	}
+}
+
+func (r *testServerReceiver) resume(data []byte) {
+	if r.server.silentResume.Load() {
+		return
+	}
+	var req entity.SessionResume
+	if err := proto.Unmarshal(data, &req); err != nil {
+		return
+	}
+	s := r.server
+	resp := &entity.SessionResume{SessionID: req.SessionID}
+	s.mutex.Lock()
+	s.resumes++
+	if s.refuseResume.Load() > 0 {
+		s.refuseResume.Add(-1)
+		s.refused++
+		resp.Code, resp.Message = 1, "session unknown"
+	} else {
+		r.sessionID = req.SessionID
+		streams, ok := s.sessions[req.SessionID]
+		if !ok {
+			streams = make(map[string]uint64)
+			s.sessions[req.SessionID] = streams
+		}
+		for connID, seq := range streams {
+			resp.Acks = append(resp.Acks, &entity.StreamAck{ConnID: connID, Seq: seq})
+		}
+	}
+	s.mutex.Unlock()
+	notify(s.changed)
+	respData, _ := proto.Marshal(resp)
+	_, _ = r.conn.Send(base.MsgTypeResumeAck, base.MsgFlagToClient, "", "", 0x00, respData)
+}
+
+func (r *testServerReceiver) stream(header *entity.MessageHeader, data []byte) {
+	s := r.server
+	s.mutex.Lock()
+	streams := s.sessions[r.sessionID]
+	if streams == nil || header.Seq == 0 {
+		s.mutex.Unlock()
+		return
+	}
+	last := streams[header.ConnID]
+	if header.Seq <= last {
+		s.mutex.Unlock()
+		return
+	}
+	if header.Seq != last+1 {
+		s.gaps++
+	}
+	streams[header.ConnID] = header.Seq
+	if header.Type[0] == base.MsgTypeData {
+		buffer, ok := s.received[header.ConnID]
+		if !ok {
+			buffer = &bytes.Buffer{}
+			s.received[header.ConnID] = buffer
+		}
+		buffer.Write(data)
+	}
+	s.mutex.Unlock()
+	notify(s.changed)
+
+	if s.silentAck.Load() {
+		return
+	}
+	ack, _ := proto.Marshal(&entity.SessionAck{Acks: []*entity.StreamAck{{ConnID: header.ConnID, Seq: header.Seq}}})
+	_, _ = r.conn.Send(base.MsgTypeAck, base.MsgFlagToClient, "", "", 0x00, ack)
+}
+
+// testClientReceiver keeps the Close frames the transport hands up for lost streams, and the ConnectAcks
+// decoded the way the socks5 client receiver does.
+type testClientReceiver struct {
+	mutex  sync.Mutex
+	closed map[string]string
+	acks   map[string]error
+}
+
+func newTestClientReceiver() *testClientReceiver {
+	return &testClientReceiver{closed: make(map[string]string), acks: make(map[string]error)}
+}
+
+func (r *testClientReceiver) OnReceived(data []byte) {
+	message, header, err := coder.ParseFrame(data)
+	if err != nil {
+		return
+	}
+	switch header.Type {
+	case entity.MessageType_MESSAGE_TYPE_CLOSE:
+		var notif entity.Notification
+		_ = proto.Unmarshal(message.Data, &notif)
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		r.closed[header.ConnID] = notif.Message
+	case entity.MessageType_MESSAGE_TYPE_CONNECT_ACK:
+		_, err := coder.Decode(message)
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		r.acks[header.ConnID] = err
+	}
+}
+
+func (r *testClientReceiver) connectAck(connID string) (bool, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	err, ok := r.acks[connID]
+	return ok, err
+}
+
+func (r *testClientReceiver) closedStreams() map[string]string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	closed := make(map[string]string, len(r.closed))
+	for connID, reason := range r.closed {
+		closed[connID] = reason
+	}
+	return closed
+}
+
+func TestMemoryTransportLossAndLatency(t *testing.T) {
+	server := newTestServer(t, LinkConditions{Latency: 2 * time.Millisecond, Jitter: 2 * time.Millisecond, Loss: 0.01})
+	capabilities := DefaultCapabilities()
+	capabilities.MaxFrameSize = 8 * 1024
+	client := server.dial(t, newTestClientReceiver(), WithCapabilities(capabilities))
+
+	const streams, chunk, chunks = 4, 12 * 1024, 32
+	sent := make(map[string][]byte, streams)
+	for range streams {
+		connID := uuid.New().String()
+		sent[connID] = make([]byte, 0, chunk*chunks)
+	}
+	for n := 0; n < chunks; n++ {
+		for connID := range sent {
+			data := make([]byte, chunk)
+			_, _ = rand.Read(data)
+			if _, err := client.Send(base.MsgTypeData, base.MsgFlagToServer, "client", connID, 0x00, data); err != nil {
+				t.Fatalf("send error: %v", err)
+			}
+			sent[connID] = append(sent[connID], data...)
+		}
+		if n == chunks/2 {
+			_ = client.Reconnect()
+		}
+	}
+
+	server.waitFor(t, 30*time.Second, func() bool {
+		for connID, data := range sent {
+			if buffer := server.received[connID]; buffer == nil || buffer.Len() < len(data) {
+				return false
+			}
+		}
+		return true
+	})
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	for connID, data := range sent {
+		if !bytes.Equal(server.received[connID].Bytes(), data) {
+			t.Fatalf("stream %s, received %d bytes differ from the %d sent", connID, server.received[connID].Len(), len(data))
+		}
+	}
+	if server.gaps != 0 {
+		t.Fatalf("sequence gaps: %d", server.gaps)
+	}
+	t.Logf("links: %d, resumes: %d", server.links, server.resumes)
+	if server.links < 2 {
+		t.Fatalf("links: %d, want a reconnect", server.links)
+	}
+	if negotiated := client.Negotiated(); negotiated.MaxFrameSize != capabilities.MaxFrameSize {
+		t.Fatalf("max frame size: %d", negotiated.MaxFrameSize)
+	}
+}
+
+func TestMemoryTransportWaitAvailableTimeout(t *testing.T) {
+	server := newTestServer(t, LinkConditions{})
+	client := server.dial(t, newTestClientReceiver())
+	if !client.WaitAvailable(time.Second) {
+		t.Fatal("transport not available")
+	}
+
+	// the link is gone and no new one can be dialed
+	_ = server.listener.Close()
+	_ = client.Reconnect()
+	for client.State() == StateConnected {
+		time.Sleep(time.Millisecond)
+	}
+	start := time.Now()
+	if client.WaitAvailable(100 * time.Millisecond) {
+		t.Fatal("transport available without a handshake")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("WaitAvailable returned after %v", elapsed)
+	}
+}
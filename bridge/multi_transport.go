@@ -0,0 +1,347 @@
+package bridge
+
+import (
+	"fmt"
+	"github.com/yangxm/gecko/base"
+	"github.com/yangxm/gecko/coder"
+	"github.com/yangxm/gecko/entity"
+	"github.com/yangxm/gecko/logger"
+	"github.com/yangxm/gecko/util"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	multiHealthCheckPeriod = 5 * time.Second
+	multiWaitPollPeriod    = 100 * time.Millisecond
+)
+
+type Strategy int
+
+const (
+	StrategyFailover Strategy = iota
+	StrategyRoundRobin
+	StrategyLeastConnections
+	StrategyLowestRTT
+)
+
+func (s Strategy) String() string {
+	switch s {
+	case StrategyFailover:
+		return "failover"
+	case StrategyRoundRobin:
+		return "round-robin"
+	case StrategyLeastConnections:
+		return "least-connections"
+	case StrategyLowestRTT:
+		return "lowest-rtt"
+	default:
+		return "unknown"
+	}
+}
+
+type Endpoint struct {
+	Name      string
+	Transport base.BridgeTransport
+	Priority  int // lower is preferred by StrategyFailover
+}
+
+// rttSource is implemented by transports that measure the round trip time of their link.
+type rttSource interface {
+	SmoothedRTT() time.Duration
+}
+
+type endpointState struct {
+	Endpoint
+	healthy bool
+	conns   int
+}
+
+func (e *endpointState) rtt() time.Duration {
+	if source, ok := e.Transport.(rttSource); ok {
+		if rtt := source.SmoothedRTT(); rtt > 0 {
+			return rtt
+		}
+	}
+	return time.Duration(math.MaxInt64)
+}
+
+// MultiTransport spreads the streams over several bridge endpoints. Every connID is pinned to the endpoint
+// chosen for its first frame until the stream is closed, new streams only go to healthy endpoints.
+type MultiTransport struct {
+	strategy  Strategy
+	mutex     sync.Mutex
+	endpoints []*endpointState
+	pins      map[string]*endpointState
+	next      int
+	closed    bool
+	done      chan struct{}
+}
+
+func NewMultiTransport(strategy Strategy) *MultiTransport {
+	m := &MultiTransport{
+		strategy: strategy,
+		pins:     make(map[string]*endpointState),
+		done:     make(chan struct{}),
+	}
+	go m.healthCheckLoop()
+	logger.Debug("[MULTI] MultiTransport created, strategy: %s", strategy)
+	return m
+}
+
+func (m *MultiTransport) AddEndpoint(endpoint Endpoint) error {
+	if endpoint.Transport == nil {
+		return fmt.Errorf("endpoint %s transport is nil", endpoint.Name)
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.closed {
+		return fmt.Errorf("transport is closed")
+	}
+	e := &endpointState{Endpoint: endpoint, healthy: isHealthy(endpoint.Transport)}
+	m.endpoints = append(m.endpoints, e)
+	sort.SliceStable(m.endpoints, func(i, j int) bool {
+		return m.endpoints[i].Priority < m.endpoints[j].Priority
+	})
+	logger.Info("[MULTI] endpoint %s added, priority: %d, healthy: %v", endpoint.Name, endpoint.Priority, e.healthy)
+	return nil
+}
+
+// Receiver wraps the receiver given to the endpoint transports, so streams closed by the remote side are unpinned.
+func (m *MultiTransport) Receiver(next base.BridgeReceiver) base.BridgeReceiver {
+	return &multiReceiver{multi: m, next: next}
+}
+
+func isHealthy(transport base.BridgeTransport) bool {
+	if health, ok := transport.(base.BridgeHealth); ok {
+		return health.IsAvailable()
+	}
+	return true
+}
+
+func (m *MultiTransport) healthCheckLoop() {
+	ticker := time.NewTicker(multiHealthCheckPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.checkHealth()
+		case <-m.done:
+			return
+		}
+	}
+}
+
+func (m *MultiTransport) checkHealth() {
+	m.mutex.Lock()
+	endpoints := append([]*endpointState(nil), m.endpoints...)
+	m.mutex.Unlock()
+
+	for _, e := range endpoints {
+		healthy := isHealthy(e.Transport)
+		m.mutex.Lock()
+		changed := e.healthy != healthy
+		e.healthy = healthy
+		conns := e.conns
+		m.mutex.Unlock()
+		if changed {
+			logger.Info("[MULTI] endpoint %s healthy: %v, conns: %d", e.Name, healthy, conns)
+		}
+	}
+}
+
+// pick chooses among the endpoints the last health check found healthy, and checks the chosen one again,
+// the health check may be seconds old.
+func (m *MultiTransport) pick() (*endpointState, error) {
+	for {
+		var healthy []*endpointState
+		for _, e := range m.endpoints {
+			if e.healthy {
+				healthy = append(healthy, e)
+			}
+		}
+		if len(healthy) == 0 {
+			return nil, fmt.Errorf("no healthy bridge endpoint")
+		}
+
+		e := m.choose(healthy)
+		if isHealthy(e.Transport) {
+			return e, nil
+		}
+		e.healthy = false
+		logger.Info("[MULTI] endpoint %s healthy: false, conns: %d", e.Name, e.conns)
+	}
+}
+
+func (m *MultiTransport) choose(healthy []*endpointState) *endpointState {
+	switch m.strategy {
+	case StrategyRoundRobin:
+		e := healthy[m.next%len(healthy)]
+		m.next++
+		return e
+	case StrategyLeastConnections:
+		best := healthy[0]
+		for _, e := range healthy[1:] {
+			if e.conns < best.conns {
+				best = e
+			}
+		}
+		return best
+	case StrategyLowestRTT:
+		best := healthy[0]
+		for _, e := range healthy[1:] {
+			if e.rtt() < best.rtt() {
+				best = e
+			}
+		}
+		return best
+	default:
+		return healthy[0]
+	}
+}
+
+// isStreamControl tells the frames that only make sense on a stream already open, they never open one.
+func isStreamControl(_type byte) bool {
+	switch _type {
+	case base.MsgTypeWindowUpdate, base.MsgTypeHalfClose, base.MsgTypeClose, base.MsgTypeError:
+		return true
+	default:
+		return false
+	}
+}
+
+// endpointFor returns the endpoint connID is pinned to, and pins a new stream to the one picked for it.
+// A control frame of a stream not pinned, one unpinned already, is refused instead of pinning it again.
+func (m *MultiTransport) endpointFor(_type byte, connID string) (*endpointState, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.closed {
+		return nil, fmt.Errorf("transport is closed")
+	}
+	if e, ok := m.pins[connID]; ok {
+		return e, nil
+	}
+	if connID != "" && isStreamControl(_type) {
+		return nil, fmt.Errorf("stream not open on any endpoint")
+	}
+
+	e, err := m.pick()
+	if err != nil {
+		return nil, err
+	}
+	if connID != "" {
+		m.pins[connID] = e
+		e.conns++
+		logger.Debug("[MULTI] [%s] pinned to %s, conns: %d", util.ShortConnID(connID), e.Name, e.conns)
+	}
+	return e, nil
+}
+
+func (m *MultiTransport) unpin(connID string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if e, ok := m.pins[connID]; ok {
+		delete(m.pins, connID)
+		e.conns--
+		logger.Debug("[MULTI] [%s] unpinned from %s, conns: %d", util.ShortConnID(connID), e.Name, e.conns)
+	}
+}
+
+func (m *MultiTransport) Send(_type, flag byte, clientID, connID string, serverType byte, data []byte) (int, error) {
+	e, err := m.endpointFor(_type, connID)
+	if err != nil {
+		logger.Error("[MULTI] [%s] send error: %v", util.ShortConnID(connID), err)
+		return 0, err
+	}
+
+	n, err := e.Transport.Send(_type, flag, clientID, connID, serverType, data)
+	if err != nil {
+		m.markUnhealthy(e)
+	}
+	if _type == base.MsgTypeClose || _type == base.MsgTypeError {
+		m.unpin(connID)
+	}
+	return n, err
+}
+
+// markUnhealthy drops the cached health of an endpoint whose send failed, until the next health check
+// finds it available again new streams go elsewhere.
+func (m *MultiTransport) markUnhealthy(e *endpointState) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if e.healthy {
+		e.healthy = false
+		logger.Info("[MULTI] endpoint %s healthy: false after a send error, conns: %d", e.Name, e.conns)
+	}
+}
+
+func (m *MultiTransport) IsAvailable() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, e := range m.endpoints {
+		if e.healthy {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MultiTransport) WaitAvailable(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		m.checkHealth()
+		if m.IsAvailable() {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		select {
+		case <-time.After(multiWaitPollPeriod):
+		case <-m.done:
+			return false
+		}
+	}
+}
+
+func (m *MultiTransport) Close() error {
+	m.mutex.Lock()
+	if m.closed {
+		m.mutex.Unlock()
+		return nil
+	}
+	m.closed = true
+	close(m.done)
+	endpoints := m.endpoints
+	m.mutex.Unlock()
+
+	var lastErr error
+	for _, e := range endpoints {
+		if err := e.Transport.Close(); err != nil {
+			logger.Error("[MULTI] close endpoint %s error: %v", e.Name, err)
+			lastErr = err
+		}
+	}
+	logger.Info("[MULTI] closed")
+	return lastErr
+}
+
+type multiReceiver struct {
+	multi *MultiTransport
+	next  base.BridgeReceiver
+}
+
+func (r *multiReceiver) OnReceived(data []byte) {
+	if _, header, err := coder.ParseFrame(data); err == nil {
+		if header.Type == entity.MessageType_MESSAGE_TYPE_CLOSE || header.Type == entity.MessageType_MESSAGE_TYPE_ERROR {
+			defer r.multi.unpin(header.ConnID)
+		}
+	}
+	if r.next != nil {
+		r.next.OnReceived(data)
+	}
+}
@@ -0,0 +1,124 @@
+package bridge
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/yangxm/gecko/base"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stubTransport is an endpoint whose health and send errors the test sets.
+type stubTransport struct {
+	available atomic.Bool
+	failSend  atomic.Bool
+	mutex     sync.Mutex
+	sent      []byte
+}
+
+func newStubTransport() *stubTransport {
+	s := &stubTransport{}
+	s.available.Store(true)
+	return s
+}
+
+func (s *stubTransport) Send(_type, flag byte, clientID, connID string, serverType byte, data []byte) (int, error) {
+	if s.failSend.Load() {
+		return 0, fmt.Errorf("link down")
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.sent = append(s.sent, _type)
+	return len(data), nil
+}
+
+func (s *stubTransport) sentCount() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.sent)
+}
+
+func (s *stubTransport) Close() error { return nil }
+
+func (s *stubTransport) IsAvailable() bool { return s.available.Load() }
+
+func (s *stubTransport) WaitAvailable(time.Duration) bool { return s.available.Load() }
+
+func newStubMulti(t *testing.T, strategy Strategy, stubs ...*stubTransport) *MultiTransport {
+	m := NewMultiTransport(strategy)
+	t.Cleanup(func() { _ = m.Close() })
+	for i, stub := range stubs {
+		if err := m.AddEndpoint(Endpoint{Name: fmt.Sprintf("e%d", i), Transport: stub, Priority: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return m
+}
+
+func TestMultiTransportRechecksHealthOnPick(t *testing.T) {
+	primary, backup := newStubTransport(), newStubTransport()
+	m := newStubMulti(t, StrategyFailover, primary, backup)
+
+	// the cached health still says primary is fine, the next health check is seconds away
+	primary.available.Store(false)
+	if _, err := m.Send(base.MsgTypeConnect, base.MsgFlagToServer, "c1", uuid.New().String(), 0x00, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if primary.sentCount() != 0 || backup.sentCount() != 1 {
+		t.Fatalf("sent to primary: %d, backup: %d", primary.sentCount(), backup.sentCount())
+	}
+}
+
+func TestMultiTransportSendErrorDropsHealth(t *testing.T) {
+	primary, backup := newStubTransport(), newStubTransport()
+	m := newStubMulti(t, StrategyFailover, primary, backup)
+
+	connID := uuid.New().String()
+	primary.failSend.Store(true)
+	if _, err := m.Send(base.MsgTypeConnect, base.MsgFlagToServer, "c1", connID, 0x00, []byte("x")); err == nil {
+		t.Fatal("no send error")
+	}
+	// primary still answers available, but the failed send keeps the new streams away from it
+	primary.failSend.Store(false)
+	if _, err := m.Send(base.MsgTypeConnect, base.MsgFlagToServer, "c1", uuid.New().String(), 0x00, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if backup.sentCount() != 1 {
+		t.Fatalf("sent to backup: %d", backup.sentCount())
+	}
+	// the stream already pinned stays where it is
+	if _, err := m.Send(base.MsgTypeData, base.MsgFlagToServer, "c1", connID, 0x00, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if primary.sentCount() != 1 {
+		t.Fatalf("sent to primary: %d", primary.sentCount())
+	}
+}
+
+func TestMultiTransportControlFrameDoesNotRepin(t *testing.T) {
+	stub := newStubTransport()
+	m := newStubMulti(t, StrategyLeastConnections, stub)
+
+	connID := uuid.New().String()
+	for _, _type := range []byte{base.MsgTypeConnect, base.MsgTypeData, base.MsgTypeClose} {
+		if _, err := m.Send(_type, base.MsgFlagToServer, "c1", connID, 0x00, []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, _type := range []byte{base.MsgTypeWindowUpdate, base.MsgTypeHalfClose, base.MsgTypeClose, base.MsgTypeError} {
+		if _, err := m.Send(_type, base.MsgFlagToServer, "c1", connID, 0x00, []byte("x")); err == nil {
+			t.Fatalf("0x%02x sent for a closed stream", _type)
+		}
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if len(m.pins) != 0 {
+		t.Fatalf("pins: %d", len(m.pins))
+	}
+	if conns := m.endpoints[0].conns; conns != 0 {
+		t.Fatalf("conns: %d", conns)
+	}
+}
@@ -0,0 +1,180 @@
+package bridge
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/yangxm/gecko/coder"
+	"net"
+	"net/url"
+	"slices"
+	"time"
+)
+
+type options struct {
+	ctx           context.Context
+	backoff       BackoffPolicy
+	stateListener StateListener
+	linkLostWait  time.Duration
+	pingPeriod    time.Duration
+	pongWait      time.Duration
+	tlsConfig     *tls.Config
+	pollFallback  *string
+	proxyURL      *url.URL
+	capabilities  Capabilities
+	codecs        *coder.Registry
+	encryptionKey []byte
+	batchBytes    int
+	batchDelay    time.Duration
+	obfuscate     bool
+	coverInterval time.Duration
+}
+
+type Option func(o *options)
+
+func newOptions(opts []Option) *options {
+	o := &options{
+		backoff:      DefaultBackoffPolicy(),
+		linkLostWait: transportLinkLostWait,
+		pingPeriod:   transportPingPeriod,
+		pongWait:     transportPongWait,
+		capabilities: DefaultCapabilities(),
+		codecs:       coder.DefaultRegistry,
+		batchBytes:   transportBatchBytes,
+		batchDelay:   transportBatchDelay,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.encryptionKey != nil {
+		o.capabilities.EncryptionKey = o.encryptionKey
+		o.capabilities.Encryptions = slices.DeleteFunc(slices.Clone(o.capabilities.Encryptions), func(name string) bool {
+			return name == CodecNone
+		})
+		if len(o.capabilities.Encryptions) == 0 {
+			o.capabilities.Encryptions = []string{coder.CodecChaCha20Poly1305, coder.CodecAES256GCM}
+		}
+	}
+	if o.obfuscate && !slices.Contains(o.capabilities.Obfuscations, coder.CodecPadding) {
+		o.capabilities.Obfuscations = append([]string{coder.CodecPadding}, o.capabilities.Obfuscations...)
+	}
+	return o
+}
+
+// WithContext closes the transport once ctx is done.
+func WithContext(ctx context.Context) Option {
+	return func(o *options) {
+		o.ctx = ctx
+	}
+}
+
+func WithBackoffPolicy(policy BackoffPolicy) Option {
+	return func(o *options) {
+		o.backoff = policy
+	}
+}
+
+func WithStateListener(listener StateListener) Option {
+	return func(o *options) {
+		o.stateListener = listener
+	}
+}
+
+// WithLinkLostWait sets how long the transport may stay disconnected before its streams are closed.
+func WithLinkLostWait(wait time.Duration) Option {
+	return func(o *options) {
+		o.linkLostWait = wait
+	}
+}
+
+// WithPingPeriod sets how often a ping is sent, it should be shorter than the pong wait.
+func WithPingPeriod(period time.Duration) Option {
+	return func(o *options) {
+		o.pingPeriod = period
+	}
+}
+
+// WithPongWait sets how long the connection may stay silent before it is considered dead.
+func WithPongWait(wait time.Duration) Option {
+	return func(o *options) {
+		o.pongWait = wait
+	}
+}
+
+// WithTLSConfig sets the TLS config used to dial tls:// and wss:// urls.
+func WithTLSConfig(config *tls.Config) Option {
+	return func(o *options) {
+		o.tlsConfig = config
+	}
+}
+
+// WithProxy dials the bridge through an upstream http:// (CONNECT), socks5:// or socks5h:// proxy, the
+// credentials go in the user info of proxyURL. socks5:// resolves the bridge host locally and hands the
+// proxy an IP, socks5h:// and http:// leave the name to the proxy. Without it the ws, h2 and polling
+// transports follow the environment.
+func WithProxy(proxyURL *url.URL) Option {
+	return func(o *options) {
+		o.proxyURL = proxyURL
+	}
+}
+
+// WithCapabilities replaces what the transport offers in the handshake.
+func WithCapabilities(capabilities Capabilities) Option {
+	return func(o *options) {
+		o.capabilities = capabilities
+	}
+}
+
+// WithCodecRegistry sets where the codecs picked in the handshake are looked up, coder.DefaultRegistry
+// by default. Received payloads are decoded with the picked codecs only.
+func WithCodecRegistry(registry *coder.Registry) Option {
+	return func(o *options) {
+		o.codecs = registry
+	}
+}
+
+// WithEncryptionKey encrypts the payloads end to end with keys derived from key and a key exchange in
+// the handshake, the bridge server must know the same key for the client. Only the encryptions of the
+// capabilities are offered, never none, so a server that can't encrypt is refused.
+func WithEncryptionKey(key []byte) Option {
+	return func(o *options) {
+		o.encryptionKey = key
+	}
+}
+
+// WithBatching coalesces the queued frames into batches of up to maxBytes, a batch waits at most delay
+// for more frames. A maxBytes of 0 sends every frame on its own, a delay of 0 only takes what is queued.
+func WithBatching(maxBytes int, delay time.Duration) Option {
+	return func(o *options) {
+		o.batchBytes = maxBytes
+		o.batchDelay = delay
+	}
+}
+
+// WithObfuscation offers to pad every payload with random bytes, and sends a cover frame of random size
+// whenever the link stayed idle for about coverInterval. A coverInterval of 0 sends no cover frames.
+// The padding is used only if the bridge server allows it for the client.
+func WithObfuscation(coverInterval time.Duration) Option {
+	return func(o *options) {
+		o.obfuscate = true
+		o.coverInterval = coverInterval
+	}
+}
+
+// WithPollFallback sets the url Dial falls back to when a ws or wss url fails to dial, by default the
+// same url with the http or https scheme. An empty url disables the fallback.
+func WithPollFallback(rawURL string) Option {
+	return func(o *options) {
+		o.pollFallback = &rawURL
+	}
+}
+
+func (o *options) proxyDial() (func(ctx context.Context, network, addr string) (net.Conn, error), error) {
+	if o.proxyURL == nil {
+		return nil, nil
+	}
+	dialer, err := newProxyDialer(o.proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	return dialer.DialContext, nil
+}
@@ -0,0 +1,638 @@
+package bridge
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/yangxm/gecko/base"
+	"github.com/yangxm/gecko/logger"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	pollHeaderOpen = "X-Bridge-Open"
+	pollHeaderLink = "X-Bridge-Link"
+	pollHeaderSeq  = "X-Bridge-Seq"
+	pollHeaderAck  = "X-Bridge-Ack"
+
+	pollHoldTime       = 20 * time.Second
+	pollRequestTimeout = 10 * time.Second
+	pollBatchDelay     = 5 * time.Millisecond
+	pollMaxBatchBytes  = 1024 * 1024
+	pollMaxBuffered    = 4 * 1024 * 1024
+	pollMaxPending     = 64
+	pollRetries        = 3
+	pollRetryDelay     = 500 * time.Millisecond
+	pollAcceptChanSize = 16
+)
+
+// PollTransport is the last resort transport for paths where neither WebSocket nor HTTP/2 streams work.
+// The frame stream is cut into batches, upstream batches are POSTed and downstream batches are fetched by
+// held GETs, every batch carries a sequence number so retried requests are neither lost nor duplicated.
+type PollTransport struct {
+	*transport
+	endpoint string
+	client   *http.Client
+}
+
+func NewPollTransport(rawURL string, connParamGetter func() map[string]string, receiver base.BridgeReceiver, opts ...Option) (*PollTransport, error) {
+	client, err := newPollClient(newOptions(opts))
+	if err != nil {
+		return nil, err
+	}
+	t := &PollTransport{endpoint: rawURL, client: client}
+	t.transport = newTransport("POLLTP", rawURL, t.dial, connParamGetter, receiver, opts)
+	if err := t.start(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func newPollClient(o *options) (*http.Client, error) {
+	proxyDial, err := o.proxyDial()
+	if err != nil {
+		return nil, err
+	}
+	httpTransport := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: o.tlsConfig,
+	}
+	if proxyDial != nil {
+		httpTransport.Proxy = nil
+		httpTransport.DialContext = proxyDial
+	}
+	return &http.Client{Transport: httpTransport}, nil
+}
+
+func (t *PollTransport) dial(ctx context.Context, params map[string]string, onPong func(payload []byte)) (link, error) {
+	return dialPollLink(ctx, t.client, t.endpoint, params, onPong)
+}
+
+// dialPollLink opens a polling link on endpoint, the ws transport falls back to it too.
+func dialPollLink(ctx context.Context, client *http.Client, endpoint string, params map[string]string, onPong func(payload []byte)) (link, error) {
+	ctx, cancel := context.WithTimeout(ctx, pollRequestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, nil)
+	if err != nil {
+		return nil, fmt.Errorf("new request error: %v", err)
+	}
+	req.Header.Set(pollHeaderOpen, "1")
+	for k, v := range params {
+		req.Header.Add(k, v)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	linkID := resp.Header.Get(pollHeaderLink)
+	if linkID == "" {
+		return nil, fmt.Errorf("missing %s header", pollHeaderLink)
+	}
+
+	conn := newPollConn(client, endpoint, linkID)
+	logger.Debug("[POLLTP] connected to %s, link: %s", endpoint, linkID)
+	return newFramedLink(newStreamConn(conn.downReader, conn, conn.Close), onPong), nil
+}
+
+func (t *PollTransport) Close() error {
+	err := t.transport.Close()
+	t.client.CloseIdleConnections()
+	return err
+}
+
+// pollConn is the client side byte stream of one polling link.
+type pollConn struct {
+	client     *http.Client
+	endpoint   string
+	linkID     string
+	mutex      sync.Mutex
+	upstream   []byte
+	upNotify   chan struct{}
+	upDrained  chan struct{}
+	downReader *io.PipeReader
+	downWriter *io.PipeWriter
+	closeOnce  sync.Once
+	ctx        context.Context
+	cancel     context.CancelFunc
+}
+
+func newPollConn(client *http.Client, endpoint, linkID string) *pollConn {
+	ctx, cancel := context.WithCancel(context.Background())
+	reader, writer := io.Pipe()
+	c := &pollConn{
+		client:     client,
+		endpoint:   endpoint,
+		linkID:     linkID,
+		upNotify:   make(chan struct{}, 1),
+		upDrained:  make(chan struct{}, 1),
+		downReader: reader,
+		downWriter: writer,
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+	go c.sendLoop()
+	go c.pollLoop()
+	return c
+}
+
+func (c *pollConn) Write(p []byte) (int, error) {
+	for {
+		c.mutex.Lock()
+		if c.ctx.Err() != nil {
+			c.mutex.Unlock()
+			return 0, net.ErrClosed
+		}
+		if len(c.upstream) < pollMaxBuffered {
+			c.upstream = append(c.upstream, p...)
+			c.mutex.Unlock()
+			notify(c.upNotify)
+			return len(p), nil
+		}
+		c.mutex.Unlock()
+
+		select {
+		case <-c.upDrained:
+		case <-c.ctx.Done():
+		}
+	}
+}
+
+func (c *pollConn) sendLoop() {
+	var seq uint64
+	for {
+		select {
+		case <-c.upNotify:
+		case <-c.ctx.Done():
+			return
+		}
+		// give the writer a moment to queue more frames into the same batch
+		select {
+		case <-time.After(pollBatchDelay):
+		case <-c.ctx.Done():
+			return
+		}
+
+		for {
+			c.mutex.Lock()
+			batch := bytes.Clone(c.upstream[:min(len(c.upstream), pollMaxBatchBytes)])
+			c.mutex.Unlock()
+			if len(batch) == 0 {
+				break
+			}
+
+			seq++
+			if err := c.retry(func() error { return c.post(seq, batch) }); err != nil {
+				logger.Error("[POLLTP] link %s, post batch %d error: %v", c.linkID, seq, err)
+				_ = c.Close()
+				return
+			}
+
+			c.mutex.Lock()
+			c.upstream = c.upstream[len(batch):]
+			c.mutex.Unlock()
+			notify(c.upDrained)
+		}
+	}
+}
+
+func (c *pollConn) post(seq uint64, batch []byte) error {
+	ctx, cancel := context.WithTimeout(c.ctx, pollRequestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint, bytes.NewReader(batch))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(pollHeaderLink, c.linkID)
+	req.Header.Set(pollHeaderSeq, strconv.FormatUint(seq, 10))
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &pollStatusError{status: resp.Status, code: resp.StatusCode}
+	}
+	return nil
+}
+
+func (c *pollConn) pollLoop() {
+	var ack uint64
+	for {
+		var seq uint64
+		var data []byte
+		err := c.retry(func() error {
+			var err error
+			seq, data, err = c.get(ack)
+			return err
+		})
+		if err != nil {
+			logger.Error("[POLLTP] link %s, poll error: %v", c.linkID, err)
+			_ = c.Close()
+			return
+		}
+		// an older batch is a resend of one already delivered, its ack got lost
+		if seq != ack+1 {
+			continue
+		}
+		ack = seq
+		if _, err := c.downWriter.Write(data); err != nil {
+			return
+		}
+	}
+}
+
+func (c *pollConn) get(ack uint64) (uint64, []byte, error) {
+	ctx, cancel := context.WithTimeout(c.ctx, pollHoldTime+pollRequestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.endpoint, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set(pollHeaderLink, c.linkID)
+	req.Header.Set(pollHeaderAck, strconv.FormatUint(ack, 10))
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNoContent:
+		return ack, nil, nil
+	default:
+		return 0, nil, &pollStatusError{status: resp.Status, code: resp.StatusCode}
+	}
+	seq, err := strconv.ParseUint(resp.Header.Get(pollHeaderSeq), 10, 64)
+	if err != nil {
+		return 0, nil, fmt.Errorf("illegal %s header: %v", pollHeaderSeq, err)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, pollMaxBatchBytes+1))
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(data) > pollMaxBatchBytes {
+		return 0, nil, fmt.Errorf("batch too large")
+	}
+	return seq, data, nil
+}
+
+// retry gives a failed request a few more tries, except when the server says the link is gone.
+func (c *pollConn) retry(request func() error) error {
+	var err error
+	for i := 0; i < pollRetries; i++ {
+		if err = request(); err == nil {
+			return nil
+		}
+		if statusErr, ok := err.(*pollStatusError); ok && statusErr.code == http.StatusNotFound {
+			return err
+		}
+		select {
+		case <-time.After(pollRetryDelay):
+		case <-c.ctx.Done():
+			return c.ctx.Err()
+		}
+	}
+	return err
+}
+
+func (c *pollConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.cancel()
+		_ = c.downWriter.CloseWithError(io.EOF)
+
+		// let the server drop the link right away instead of waiting for its read deadline
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), pollRequestTimeout)
+			defer cancel()
+			req, err := http.NewRequestWithContext(ctx, http.MethodDelete, c.endpoint, nil)
+			if err != nil {
+				return
+			}
+			req.Header.Set(pollHeaderLink, c.linkID)
+			if resp, err := c.client.Do(req); err == nil {
+				_ = resp.Body.Close()
+			}
+		}()
+	})
+	return nil
+}
+
+type pollStatusError struct {
+	status string
+	code   int
+}
+
+func (e *pollStatusError) Error() string {
+	return fmt.Sprintf("unexpected status: %s", e.status)
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// PollListener is the server side of PollTransport, a http.Handler serving the polling endpoint.
+// Every opened link becomes a ServerConn.
+type PollListener struct {
+	mutex        sync.Mutex
+	conns        map[string]*pollServerConn
+	acceptChan   chan *ServerConn
+	authenticate Authenticator
+	closed       bool
+	done         chan struct{}
+}
+
+func NewPollListener() *PollListener {
+	return &PollListener{
+		conns:      make(map[string]*pollServerConn),
+		acceptChan: make(chan *ServerConn, pollAcceptChanSize),
+		done:       make(chan struct{}),
+	}
+}
+
+func (l *PollListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost && r.Header.Get(pollHeaderOpen) != "" {
+		l.open(w, r)
+		return
+	}
+
+	l.mutex.Lock()
+	conn := l.conns[r.Header.Get(pollHeaderLink)]
+	l.mutex.Unlock()
+	if conn == nil {
+		http.Error(w, "unknown link", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		seq, err := strconv.ParseUint(r.Header.Get(pollHeaderSeq), 10, 64)
+		if err != nil {
+			http.Error(w, "illegal seq", http.StatusBadRequest)
+			return
+		}
+		data, err := io.ReadAll(io.LimitReader(r.Body, pollMaxBatchBytes+1))
+		if err != nil || len(data) > pollMaxBatchBytes {
+			http.Error(w, "illegal batch", http.StatusBadRequest)
+			return
+		}
+		if err := conn.upload(seq, data); err != nil {
+			logger.Warn("[POLLTP] link %s, upload batch %d error: %v", conn.linkID, seq, err)
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	case http.MethodGet:
+		ack, err := strconv.ParseUint(r.Header.Get(pollHeaderAck), 10, 64)
+		if err != nil {
+			http.Error(w, "illegal ack", http.StatusBadRequest)
+			return
+		}
+		seq, data, ok := conn.poll(r.Context(), ack)
+		if !ok {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set(pollHeaderSeq, strconv.FormatUint(seq, 10))
+		_, _ = w.Write(data)
+	case http.MethodDelete:
+		_ = conn.Close()
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (l *PollListener) open(w http.ResponseWriter, r *http.Request) {
+	params := make(map[string]string, len(r.Header))
+	for k := range r.Header {
+		if k != pollHeaderOpen {
+			params[k] = r.Header.Get(k)
+		}
+	}
+	var clientID string
+	if l.authenticate != nil {
+		var err error
+		if clientID, err = l.authenticate(params); err != nil {
+			logger.Warn("[POLLTP] open from %s, authenticate error: %v", r.RemoteAddr, err)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	conn := newPollServerConn(uuid.New().String())
+	conn.onClose = func() {
+		l.mutex.Lock()
+		delete(l.conns, conn.linkID)
+		l.mutex.Unlock()
+	}
+	remoteAddr, _ := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	serverConn := newServerConn(newFramedLink(newStreamConn(conn.upReader, conn, conn.Close), nil), params, remoteAddr)
+	serverConn.clientID = clientID
+
+	l.mutex.Lock()
+	if l.closed {
+		l.mutex.Unlock()
+		http.Error(w, "listener closed", http.StatusServiceUnavailable)
+		return
+	}
+	l.conns[conn.linkID] = conn
+	l.mutex.Unlock()
+
+	select {
+	case l.acceptChan <- serverConn:
+	case <-l.done:
+		_ = conn.Close()
+		http.Error(w, "listener closed", http.StatusServiceUnavailable)
+		return
+	case <-r.Context().Done():
+		_ = conn.Close()
+		return
+	}
+	logger.Debug("[POLLTP] link %s opened from %s", conn.linkID, r.RemoteAddr)
+	w.Header().Set(pollHeaderLink, conn.linkID)
+	w.WriteHeader(http.StatusOK)
+}
+
+// SetAuthenticator makes the listener refuse the links whose conn params are refused, call it before serving.
+func (l *PollListener) SetAuthenticator(authenticate Authenticator) {
+	l.authenticate = authenticate
+}
+
+func (l *PollListener) Accept() (*ServerConn, error) {
+	select {
+	case conn := <-l.acceptChan:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *PollListener) Close() error {
+	l.mutex.Lock()
+	if l.closed {
+		l.mutex.Unlock()
+		return nil
+	}
+	l.closed = true
+	close(l.done)
+	conns := make([]*pollServerConn, 0, len(l.conns))
+	for _, conn := range l.conns {
+		conns = append(conns, conn)
+	}
+	l.mutex.Unlock()
+
+	for _, conn := range conns {
+		_ = conn.Close()
+	}
+	return nil
+}
+
+// pollServerConn is the server side byte stream of one polling link. Upstream batches are put back in
+// sequence order, the last downstream batch is kept until the client acked it.
+type pollServerConn struct {
+	linkID      string
+	onClose     func()
+	uploadMutex sync.Mutex
+	nextUpSeq   uint64
+	pending     map[uint64][]byte
+	upReader    *io.PipeReader
+	upWriter    *io.PipeWriter
+	mutex       sync.Mutex
+	downstream  []byte
+	downSeq     uint64
+	retained    []byte
+	downNotify  chan struct{}
+	downDrained chan struct{}
+	closeOnce   sync.Once
+	done        chan struct{}
+}
+
+func newPollServerConn(linkID string) *pollServerConn {
+	reader, writer := io.Pipe()
+	return &pollServerConn{
+		linkID:      linkID,
+		nextUpSeq:   1,
+		pending:     make(map[uint64][]byte),
+		upReader:    reader,
+		upWriter:    writer,
+		downNotify:  make(chan struct{}, 1),
+		downDrained: make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+}
+
+func (c *pollServerConn) upload(seq uint64, data []byte) error {
+	c.uploadMutex.Lock()
+	defer c.uploadMutex.Unlock()
+	if seq < c.nextUpSeq {
+		return nil
+	}
+	if seq > c.nextUpSeq {
+		if len(c.pending) >= pollMaxPending {
+			return fmt.Errorf("too many pending batches")
+		}
+		c.pending[seq] = data
+		return nil
+	}
+
+	for {
+		if _, err := c.upWriter.Write(data); err != nil {
+			return err
+		}
+		c.nextUpSeq++
+		next, ok := c.pending[c.nextUpSeq]
+		if !ok {
+			return nil
+		}
+		delete(c.pending, c.nextUpSeq)
+		data = next
+	}
+}
+
+func (c *pollServerConn) poll(ctx context.Context, ack uint64) (uint64, []byte, bool) {
+	timer := time.NewTimer(pollHoldTime)
+	defer timer.Stop()
+	for {
+		c.mutex.Lock()
+		if c.retained != nil && ack >= c.downSeq {
+			c.retained = nil
+		}
+		if c.retained != nil {
+			seq, data := c.downSeq, c.retained
+			c.mutex.Unlock()
+			return seq, data, true
+		}
+		if len(c.downstream) > 0 {
+			n := min(len(c.downstream), pollMaxBatchBytes)
+			c.retained = bytes.Clone(c.downstream[:n])
+			c.downstream = c.downstream[n:]
+			c.downSeq++
+			seq, data := c.downSeq, c.retained
+			c.mutex.Unlock()
+			notify(c.downDrained)
+			return seq, data, true
+		}
+		c.mutex.Unlock()
+
+		select {
+		case <-c.downNotify:
+		case <-timer.C:
+			return 0, nil, false
+		case <-ctx.Done():
+			return 0, nil, false
+		case <-c.done:
+			return 0, nil, false
+		}
+	}
+}
+
+func (c *pollServerConn) Write(p []byte) (int, error) {
+	for {
+		select {
+		case <-c.done:
+			return 0, net.ErrClosed
+		default:
+		}
+		c.mutex.Lock()
+		if len(c.downstream) < pollMaxBuffered {
+			c.downstream = append(c.downstream, p...)
+			c.mutex.Unlock()
+			notify(c.downNotify)
+			return len(p), nil
+		}
+		c.mutex.Unlock()
+
+		select {
+		case <-c.downDrained:
+		case <-c.done:
+			return 0, net.ErrClosed
+		}
+	}
+}
+
+func (c *pollServerConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		_ = c.upWriter.CloseWithError(io.EOF)
+		if c.onClose != nil {
+			c.onClose()
+		}
+		logger.Debug("[POLLTP] link %s closed", c.linkID)
+	})
+	return nil
+}
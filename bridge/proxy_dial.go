@@ -0,0 +1,251 @@
+package bridge
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"github.com/yangxm/gecko/base"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	proxyDialTimeout = 10 * time.Second
+
+	socks5AuthUserPass    byte = 0x02
+	socks5UserPassVersion byte = 0x01
+)
+
+// proxyDialer dials through an upstream HTTP (CONNECT) or SOCKS5 proxy, the credentials are taken
+// from the user info of the proxy url. A socks5 proxy gets the address resolved here, a socks5h one
+// gets the host name.
+type proxyDialer struct {
+	proxyURL *url.URL
+	dialer   net.Dialer
+}
+
+func newProxyDialer(proxyURL *url.URL) (*proxyDialer, error) {
+	switch proxyURL.Scheme {
+	case "http", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme: %s", proxyURL.Scheme)
+	}
+	return &proxyDialer{proxyURL: proxyURL, dialer: net.Dialer{Timeout: proxyDialTimeout}}, nil
+}
+
+func (d *proxyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if d.proxyURL.Scheme == "socks5" {
+		resolved, err := d.resolve(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+		addr = resolved
+	}
+
+	proxyAddr := d.proxyURL.Host
+	if d.proxyURL.Port() == "" {
+		port := "1080"
+		if d.proxyURL.Scheme == "http" {
+			port = "80"
+		}
+		proxyAddr = net.JoinHostPort(d.proxyURL.Hostname(), port)
+	}
+	conn, err := d.dialer.DialContext(ctx, network, proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("dial proxy %s error: %v", proxyAddr, err)
+	}
+
+	// the handshake must not outlive the dial
+	deadline := time.Now().Add(proxyDialTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("set deadline error: %v", err)
+	}
+
+	if d.proxyURL.Scheme == "http" {
+		err = d.connectHTTP(conn, addr)
+	} else {
+		err = d.connectSocks5(conn, addr)
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("proxy %s: %v", proxyAddr, err)
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("clear deadline error: %v", err)
+	}
+	return conn, nil
+}
+
+// resolve replaces the host of addr with its first IP address, an IP is returned as is.
+func (d *proxyDialer) resolve(ctx context.Context, addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("illegal address %s: %v", addr, err)
+	}
+	if net.ParseIP(host) != nil {
+		return addr, nil
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", fmt.Errorf("resolve %s error: %v", host, err)
+	}
+	if len(ips) == 0 {
+		return "", fmt.Errorf("resolve %s error: no address", host)
+	}
+	return net.JoinHostPort(ips[0].IP.String(), port), nil
+}
+
+func (d *proxyDialer) connectHTTP(conn net.Conn, addr string) error {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if user := d.proxyURL.User; user != nil {
+		password, _ := user.Password()
+		credential := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credential)
+	}
+	if err := req.Write(conn); err != nil {
+		return fmt.Errorf("write CONNECT error: %v", err)
+	}
+
+	// the reader must not buffer past the response, the tunnel starts right after it
+	resp, err := http.ReadResponse(bufio.NewReaderSize(&byteReader{conn: conn}, 1), req)
+	if err != nil {
+		return fmt.Errorf("read CONNECT response error: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("CONNECT refused: %s", resp.Status)
+	}
+	return nil
+}
+
+func (d *proxyDialer) connectSocks5(conn net.Conn, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("illegal address %s: %v", addr, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return fmt.Errorf("illegal port: %s", portStr)
+	}
+
+	methods := []byte{base.Socks5NoAuth}
+	if d.proxyURL.User != nil {
+		methods = append(methods, socks5AuthUserPass)
+	}
+	if _, err := conn.Write(append([]byte{base.Socks5Version, byte(len(methods))}, methods...)); err != nil {
+		return fmt.Errorf("write auth methods error: %v", err)
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("read auth method error: %v", err)
+	}
+	if reply[0] != base.Socks5Version {
+		return fmt.Errorf("unexpected socks version: 0x%02x", reply[0])
+	}
+	switch reply[1] {
+	case base.Socks5NoAuth:
+	case socks5AuthUserPass:
+		if d.proxyURL.User == nil {
+			return fmt.Errorf("proxy asks for credentials")
+		}
+		if err := d.authSocks5(conn); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("no acceptable auth method: 0x%02x", reply[1])
+	}
+
+	req := []byte{base.Socks5Version, base.Socks5CmdConnect, 0x00}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		req = append(append(req, base.AddrTypeIPv4), ip.To4()...)
+	} else if ip != nil {
+		req = append(append(req, base.AddrTypeIPv6), ip.To16()...)
+	} else {
+		if len(host) > 255 {
+			return fmt.Errorf("host too long: %s", host)
+		}
+		req = append(append(req, base.AddrTypeDomain, byte(len(host))), host...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return fmt.Errorf("write connect error: %v", err)
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return fmt.Errorf("read connect reply error: %v", err)
+	}
+	if header[1] != base.Socks5RepSuccess {
+		return fmt.Errorf("connect refused, rep: 0x%02x", header[1])
+	}
+	var skip int
+	switch header[3] {
+	case base.AddrTypeIPv4:
+		skip = net.IPv4len
+	case base.AddrTypeIPv6:
+		skip = net.IPv6len
+	case base.AddrTypeDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return fmt.Errorf("read bound address error: %v", err)
+		}
+		skip = int(length[0])
+	default:
+		return fmt.Errorf("unexpected address type: 0x%02x", header[3])
+	}
+	if _, err := io.ReadFull(conn, make([]byte, skip+2)); err != nil {
+		return fmt.Errorf("read bound address error: %v", err)
+	}
+	return nil
+}
+
+func (d *proxyDialer) authSocks5(conn net.Conn) error {
+	username := d.proxyURL.User.Username()
+	password, _ := d.proxyURL.User.Password()
+	if len(username) > 255 || len(password) > 255 {
+		return fmt.Errorf("credentials too long")
+	}
+	req := []byte{socks5UserPassVersion, byte(len(username))}
+	req = append(req, username...)
+	req = append(req, byte(len(password)))
+	req = append(req, password...)
+	if _, err := conn.Write(req); err != nil {
+		return fmt.Errorf("write credentials error: %v", err)
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("read auth reply error: %v", err)
+	}
+	if reply[1] != 0x00 {
+		return fmt.Errorf("proxy rejected credentials")
+	}
+	return nil
+}
+
+// byteReader keeps bufio from reading ahead of the CONNECT response.
+type byteReader struct {
+	conn net.Conn
+}
+
+func (r *byteReader) Read(p []byte) (int, error) {
+	if len(p) > 1 {
+		p = p[:1]
+	}
+	return r.conn.Read(p)
+}
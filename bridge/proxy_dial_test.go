@@ -0,0 +1,58 @@
+package bridge
+
+import (
+	"context"
+	"github.com/yangxm/gecko/base"
+	"io"
+	"net"
+	"net/url"
+	"testing"
+)
+
+// serveSocks5Once accepts one no-auth CONNECT and reports the address type of its request.
+func serveSocks5Once(t *testing.T) (string, <-chan byte) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	addrTypes := make(chan byte, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		greeting := make([]byte, 3)
+		if _, err := io.ReadFull(conn, greeting); err != nil {
+			return
+		}
+		_, _ = conn.Write([]byte{base.Socks5Version, base.Socks5NoAuth})
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		addrTypes <- header[3]
+	}()
+	return listener.Addr().String(), addrTypes
+}
+
+func TestProxyDialSocks5ResolvesLocally(t *testing.T) {
+	for scheme, want := range map[string]byte{"socks5": base.AddrTypeIPv4, "socks5h": base.AddrTypeDomain} {
+		proxyAddr, addrTypes := serveSocks5Once(t)
+		dialer, err := newProxyDialer(&url.URL{Scheme: scheme, Host: proxyAddr})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the fake proxy hangs up after the request, only the address it got matters
+		_, _ = dialer.DialContext(context.Background(), "tcp", "localhost:443")
+		select {
+		case got := <-addrTypes:
+			if got != want && !(scheme == "socks5" && got == base.AddrTypeIPv6) {
+				t.Fatalf("%s, address type: 0x%02x", scheme, got)
+			}
+		default:
+			t.Fatalf("%s, no CONNECT request", scheme)
+		}
+	}
+}
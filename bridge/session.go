@@ -0,0 +1,256 @@
+package bridge
+
+import (
+	"github.com/google/uuid"
+	"github.com/yangxm/gecko/base"
+	"github.com/yangxm/gecko/entity"
+	"github.com/yangxm/gecko/logger"
+	"github.com/yangxm/gecko/util"
+	"google.golang.org/protobuf/proto"
+	"sync"
+)
+
+const (
+	sessionMaxRetransmitBytes = 4 * 1024 * 1024
+)
+
+// sessionFrame keeps a frame before its codecs ran, a retransmit encodes it again for the new link.
+type sessionFrame struct {
+	connID  string
+	seq     uint64
+	message *entity.Message
+	size    int
+}
+
+// session keeps the per-stream sequence numbers of a bridge connection and the frames the remote side has not
+// acknowledged yet, so the streams survive a reconnect of the underlying transport.
+type session struct {
+	mutex        sync.Mutex
+	id           string
+	maxBuffered  int
+	buffered     int
+	frames       []*sessionFrame
+	sendSeq      map[string]uint64
+	recvSeq      map[string]uint64
+	pendingAcks  map[string]uint64
+	clientIDs    map[string]string
+	streamIDs    map[string]uint32
+	nextStreamID uint32
+	roomChan     chan struct{}
+}
+
+func newSession(maxBuffered int) *session {
+	s := &session{
+		maxBuffered: maxBuffered,
+		roomChan:    make(chan struct{}, 1),
+	}
+	s.reset()
+	return s
+}
+
+func (s *session) reset() {
+	s.id = uuid.New().String()
+	s.buffered = 0
+	s.frames = nil
+	s.sendSeq = make(map[string]uint64)
+	s.recvSeq = make(map[string]uint64)
+	s.pendingAcks = make(map[string]uint64)
+	s.clientIDs = make(map[string]string)
+	s.streamIDs = make(map[string]uint32)
+}
+
+func isStreamMessage(_type byte) bool {
+	switch _type {
+	case base.MsgTypeAck, base.MsgTypeResume, base.MsgTypeResumeAck, base.MsgTypeHello, base.MsgTypeHelloAck, base.MsgTypeBatch,
+		base.MsgTypeFragment, base.MsgTypeCover:
+		return false
+	default:
+		return true
+	}
+}
+
+// isLinkMessage tells the frames only read straight off the link, a Batch can't carry them.
+func isLinkMessage(_type byte) bool {
+	switch _type {
+	case base.MsgTypeBatch, base.MsgTypeFragment, base.MsgTypeHello, base.MsgTypeHelloAck:
+		return true
+	default:
+		return false
+	}
+}
+
+func isStreamEnd(_type byte) bool {
+	return _type == base.MsgTypeClose || _type == base.MsgTypeError
+}
+
+func (s *session) hasRoom() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.buffered < s.maxBuffered
+}
+
+// stamp assigns the next sequence number of the stream to the message, and a stream ID to the first message of
+// a stream, marshals it and keeps it until acked.
+// encode runs after the seq is set, so the codecs can bind the payload to it.
+func (s *session) stamp(message *entity.Message, encode func(message *entity.Message) error) ([]byte, error) {
+	header := message.GetHeader()
+	if header == nil || len(header.Type) != 1 || !isStreamMessage(header.Type[0]) || header.ConnID == "" {
+		return proto.Marshal(message)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	seq := s.sendSeq[header.ConnID] + 1
+	header.Seq = seq
+	streamID, ok := s.streamIDs[header.ConnID]
+	if !ok {
+		s.nextStreamID++
+		streamID = s.nextStreamID
+	}
+	header.StreamID = streamID
+	plain := &entity.Message{Header: header, Data: message.Data}
+	if err := encode(message); err != nil {
+		return nil, err
+	}
+	data, err := proto.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+
+	s.sendSeq[header.ConnID] = seq
+	s.streamIDs[header.ConnID] = streamID
+	s.clientIDs[header.ConnID] = header.ClientID
+	if isStreamEnd(header.Type[0]) {
+		delete(s.sendSeq, header.ConnID)
+		delete(s.streamIDs, header.ConnID)
+	}
+	s.frames = append(s.frames, &sessionFrame{connID: header.ConnID, seq: seq, message: plain, size: len(data)})
+	s.buffered += len(data)
+	return data, nil
+}
+
+// accept tracks the sequence number of a received stream message, and reports false for duplicates
+// retransmitted by the remote side after a resume.
+func (s *session) accept(header *entity.MessageHeader) bool {
+	if header.Seq == 0 || header.ConnID == "" {
+		return true
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	shortConn := util.ShortConnID(header.ConnID)
+	last, ok := s.recvSeq[header.ConnID]
+	if !ok && header.Seq != 1 {
+		logger.Debug("[SESS] [%s] drop frame of finished stream, seq: %d", shortConn, header.Seq)
+		return false
+	}
+	if header.Seq <= last {
+		logger.Debug("[SESS] [%s] drop duplicated frame, seq: %d, last: %d", shortConn, header.Seq, last)
+		return false
+	}
+	if header.Seq != last+1 {
+		logger.Error("[SESS] [%s] sequence gap, seq: %d, last: %d", shortConn, header.Seq, last)
+	}
+
+	s.recvSeq[header.ConnID] = header.Seq
+	s.pendingAcks[header.ConnID] = header.Seq
+	s.clientIDs[header.ConnID] = header.ClientID
+	if len(header.Type) == 1 && isStreamEnd(header.Type[0]) {
+		delete(s.recvSeq, header.ConnID)
+	}
+	return true
+}
+
+func (s *session) onAck(acks []*entity.StreamAck) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	acked := make(map[string]uint64, len(acks))
+	for _, ack := range acks {
+		acked[ack.ConnID] = ack.Seq
+	}
+
+	frames := s.frames[:0]
+	for _, frame := range s.frames {
+		if seq, ok := acked[frame.connID]; ok && frame.seq <= seq {
+			s.buffered -= frame.size
+			continue
+		}
+		frames = append(frames, frame)
+	}
+	clear(s.frames[len(frames):])
+	s.frames = frames
+
+	for connID := range acked {
+		if _, ok := s.sendSeq[connID]; !ok && !s.hasFrames(connID) {
+			if _, ok := s.recvSeq[connID]; !ok {
+				delete(s.clientIDs, connID)
+			}
+		}
+	}
+
+	select {
+	case s.roomChan <- struct{}{}:
+	default:
+	}
+}
+
+func (s *session) hasFrames(connID string) bool {
+	for _, frame := range s.frames {
+		if frame.connID == connID {
+			return true
+		}
+	}
+	return false
+}
+
+// takeAcks returns the acknowledgements received since the last call.
+func (s *session) takeAcks() []*entity.StreamAck {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.pendingAcks) == 0 {
+		return nil
+	}
+	acks := make([]*entity.StreamAck, 0, len(s.pendingAcks))
+	for connID, seq := range s.pendingAcks {
+		acks = append(acks, &entity.StreamAck{ConnID: connID, Seq: seq})
+	}
+	clear(s.pendingAcks)
+	return acks
+}
+
+func (s *session) resumeRequest() *entity.SessionResume {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	acks := make([]*entity.StreamAck, 0, len(s.recvSeq))
+	for connID, seq := range s.recvSeq {
+		acks = append(acks, &entity.StreamAck{ConnID: connID, Seq: seq})
+	}
+	clear(s.pendingAcks)
+	return &entity.SessionResume{SessionID: s.id, Acks: acks}
+}
+
+// resume drops the frames acknowledged by the remote side and returns a copy of the rest for retransmission.
+func (s *session) resume(resp *entity.SessionResume) []*entity.Message {
+	s.onAck(resp.Acks)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	retransmit := make([]*entity.Message, 0, len(s.frames))
+	for _, frame := range s.frames {
+		retransmit = append(retransmit, &entity.Message{Header: frame.message.Header, Data: frame.message.Data})
+	}
+	return retransmit
+}
+
+// lost forgets every stream of a session the remote side refused to resume and starts a new one,
+// it returns the streams that are gone together with their clientID.
+func (s *session) lost() map[string]string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	streams := s.clientIDs
+	s.reset()
+	select {
+	case s.roomChan <- struct{}{}:
+	default:
+	}
+	return streams
+}
@@ -0,0 +1,112 @@
+package bridge
+
+import (
+	"github.com/yangxm/gecko/entity"
+	"sync"
+)
+
+const (
+	// protocolVersionStreamIDs is the first protocol version with compact stream headers.
+	protocolVersionStreamIDs uint32 = 2
+	// protocolVersionEnumHeader is the first protocol version reading the enums of the header without the bytes.
+	protocolVersionEnumHeader uint32 = 3
+)
+
+type streamRef struct {
+	connID   string
+	clientID string
+}
+
+// streamTable compacts the stream headers of one link. The first frame of a stream on a link binds its
+// stream ID to the connID and clientID, the following ones carry the stream ID only. The binding is per
+// link and per direction, so a frame retransmitted on a new link simply binds the stream again.
+type streamTable struct {
+	mutex sync.Mutex
+	sent  map[uint32]bool
+	recv  map[uint32]streamRef
+	ids   map[string]uint32
+}
+
+func newStreamTable() *streamTable {
+	return &streamTable{
+		sent: make(map[uint32]bool),
+		recv: make(map[uint32]streamRef),
+		ids:  make(map[string]uint32),
+	}
+}
+
+// compact replaces the header of a message with a compact one if its stream is bound on this link already,
+// the header itself is left alone as the session keeps it for retransmits.
+func (t *streamTable) compact(message *entity.Message) {
+	header := message.GetHeader()
+	if header == nil || header.StreamID == 0 {
+		return
+	}
+	end := len(header.Type) == 1 && isStreamEnd(header.Type[0])
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if !t.sent[header.StreamID] {
+		if !end {
+			t.sent[header.StreamID] = true
+		}
+		return
+	}
+	if end {
+		delete(t.sent, header.StreamID)
+	}
+	message.Header = &entity.MessageHeader{
+		Type:       header.Type,
+		Flag:       header.Flag,
+		ServerType: header.ServerType,
+		Seq:        header.Seq,
+		StreamID:   header.StreamID,
+		MsgType:    header.MsgType,
+		Direction:  header.Direction,
+		Server:     header.Server,
+	}
+}
+
+// expand fills in the connID and clientID of a compact header, it reports false for a stream not bound
+// on this link.
+func (t *streamTable) expand(header *entity.MessageHeader) bool {
+	if header.StreamID == 0 {
+		return true
+	}
+	end := len(header.Type) == 1 && isStreamEnd(header.Type[0])
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if header.ConnID != "" {
+		if end {
+			t.unbind(header.StreamID)
+		} else {
+			t.recv[header.StreamID] = streamRef{connID: header.ConnID, clientID: header.ClientID}
+			t.ids[header.ConnID] = header.StreamID
+		}
+		return true
+	}
+	ref, ok := t.recv[header.StreamID]
+	if !ok {
+		return false
+	}
+	header.ConnID, header.ClientID = ref.connID, ref.clientID
+	if end {
+		t.unbind(header.StreamID)
+	}
+	return true
+}
+
+func (t *streamTable) unbind(streamID uint32) {
+	if ref, ok := t.recv[streamID]; ok {
+		delete(t.ids, ref.connID)
+		delete(t.recv, streamID)
+	}
+}
+
+// streamID returns the stream ID the remote side bound connID to, the server side answers with it.
+func (t *streamTable) streamID(connID string) uint32 {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.ids[connID]
+}
@@ -0,0 +1,145 @@
+package bridge
+
+import (
+	"github.com/google/uuid"
+	"github.com/yangxm/gecko/base"
+	"github.com/yangxm/gecko/coder"
+	"github.com/yangxm/gecko/entity"
+	"google.golang.org/protobuf/proto"
+	"testing"
+)
+
+// newStreamMessage makes a frame of the stream connID, stamped the way the session does.
+func newStreamMessage(t *testing.T, _type byte, connID string, streamID uint32, seq uint64) *entity.Message {
+	message, err := coder.NewMessage(_type, base.MsgFlagToServer, "c1", connID, 0x00, []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	message.Header.StreamID, message.Header.Seq = streamID, seq
+	return message
+}
+
+// send compacts message on the sending table and expands what goes on the wire on the receiving one.
+func send(t *testing.T, sent, recv *streamTable, message *entity.Message) (*entity.MessageHeader, bool) {
+	original := message.Header
+	sent.compact(message)
+	wire := proto.Clone(message).(*entity.Message)
+	message.Header = original
+	return wire.Header, recv.expand(wire.Header)
+}
+
+func TestStreamTableBindsOnTheFirstFrame(t *testing.T) {
+	sent, recv := newStreamTable(), newStreamTable()
+	connID := uuid.New().String()
+
+	first := newStreamMessage(t, base.MsgTypeConnect, connID, 1, 1)
+	header, ok := send(t, sent, recv, first)
+	if !ok || header.ConnID != connID || header.ClientID != "c1" {
+		t.Fatalf("first frame: %v, %v", header, ok)
+	}
+	if recv.streamID(connID) != 1 {
+		t.Fatalf("stream ID of %s: %d", connID, recv.streamID(connID))
+	}
+
+	second := newStreamMessage(t, base.MsgTypeData, connID, 1, 2)
+	sent.compact(second)
+	if second.Header.ConnID != "" || second.Header.ClientID != "" || second.Header.StreamID != 1 || second.Header.Seq != 2 {
+		t.Fatalf("compact header: %v", second.Header)
+	}
+	// the session keeps the full header for retransmits
+	second = newStreamMessage(t, base.MsgTypeData, connID, 1, 2)
+	original := second.Header
+	if header, ok = send(t, sent, recv, second); !ok || header.ConnID != connID || header.ClientID != "c1" {
+		t.Fatalf("expanded header: %v, %v", header, ok)
+	}
+	if second.Header != original || original.ConnID != connID {
+		t.Fatalf("full header changed: %v", second.Header)
+	}
+}
+
+func TestStreamTableNewLink(t *testing.T) {
+	sent, recv := newStreamTable(), newStreamTable()
+	connID := uuid.New().String()
+	for seq := uint64(1); seq <= 3; seq++ {
+		if _, ok := send(t, sent, recv, newStreamMessage(t, base.MsgTypeData, connID, 1, seq)); !ok {
+			t.Fatalf("seq %d not expanded", seq)
+		}
+	}
+
+	// a compact frame of the old link reaching the new one is not bound there
+	old := newStreamMessage(t, base.MsgTypeData, connID, 1, 4)
+	sent.compact(old)
+	newSent, newRecv := newStreamTable(), newStreamTable()
+	if newRecv.expand(old.Header) {
+		t.Fatalf("compact frame of the old link expanded: %v", old.Header)
+	}
+
+	// the retransmit of an unacked frame binds the stream again on the new link
+	for seq := uint64(2); seq <= 4; seq++ {
+		header, ok := send(t, newSent, newRecv, newStreamMessage(t, base.MsgTypeData, connID, 1, seq))
+		if !ok || header.ConnID != connID || header.Seq != seq {
+			t.Fatalf("retransmit seq %d: %v, %v", seq, header, ok)
+		}
+	}
+}
+
+func TestStreamTableUnbindsOnStreamEnd(t *testing.T) {
+	for _, end := range []byte{base.MsgTypeClose, base.MsgTypeError} {
+		sent, recv := newStreamTable(), newStreamTable()
+		connID := uuid.New().String()
+		if _, ok := send(t, sent, recv, newStreamMessage(t, base.MsgTypeData, connID, 1, 1)); !ok {
+			t.Fatal("first frame not expanded")
+		}
+		header, ok := send(t, sent, recv, newStreamMessage(t, end, connID, 1, 2))
+		if !ok || header.ConnID != connID {
+			t.Fatalf("0x%02x: %v, %v", end, header, ok)
+		}
+		if recv.streamID(connID) != 0 {
+			t.Fatalf("0x%02x, still bound: %d", end, recv.streamID(connID))
+		}
+		late := newStreamMessage(t, base.MsgTypeData, "", 1, 3)
+		late.Header.ClientID = ""
+		if recv.expand(late.Header) {
+			t.Fatalf("0x%02x, compact frame after the end expanded", end)
+		}
+		// the sending side forgot the stream too, a reused stream ID goes out with the full header
+		reused := newStreamMessage(t, base.MsgTypeConnect, uuid.New().String(), 1, 1)
+		if header, ok := send(t, sent, recv, reused); !ok || header.ConnID == "" {
+			t.Fatalf("0x%02x, reused stream ID: %v, %v", end, header, ok)
+		}
+	}
+
+	// a stream ending on its first frame on the link is never bound
+	sent, recv := newStreamTable(), newStreamTable()
+	connID := uuid.New().String()
+	if header, ok := send(t, sent, recv, newStreamMessage(t, base.MsgTypeClose, connID, 5, 9)); !ok || header.ConnID != connID {
+		t.Fatalf("close on the first frame: %v, %v", header, ok)
+	}
+	if recv.streamID(connID) != 0 {
+		t.Fatal("closed stream bound")
+	}
+	if header, _ := send(t, sent, recv, newStreamMessage(t, base.MsgTypeData, connID, 5, 10)); header.ConnID != connID {
+		t.Fatalf("frame after a close on the first frame compacted: %v", header)
+	}
+}
+
+func TestStreamTableUnknownStream(t *testing.T) {
+	recv := newStreamTable()
+	header := &entity.MessageHeader{Type: []byte{base.MsgTypeData}, StreamID: 7, Seq: 1}
+	if recv.expand(header) {
+		t.Fatal("unknown stream ID expanded")
+	}
+	if header.ConnID != "" || recv.streamID("") != 0 {
+		t.Fatalf("unknown stream ID: %v", header)
+	}
+	// a frame outside the streams carries no stream ID
+	plain := &entity.MessageHeader{Type: []byte{base.MsgTypeAck}}
+	if !recv.expand(plain) {
+		t.Fatal("frame without a stream ID refused")
+	}
+	message := &entity.Message{Header: plain}
+	newStreamTable().compact(message)
+	if message.Header != plain {
+		t.Fatal("frame without a stream ID compacted")
+	}
+}
@@ -0,0 +1,79 @@
+package bridge
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// TLSSettings describe how the bridge dials tls://, wss:// and the other TLS urls, see NewTLSConfig.
+type TLSSettings struct {
+	CAFile     string   // PEM bundle trusted instead of the system roots
+	CertFile   string   // client certificate for mutual TLS, with KeyFile
+	KeyFile    string   //
+	ServerName string   // SNI and the name verified, by default the url host
+	PinnedSPKI []string // base64 SHA-256 of the accepted server public keys, "sha256/" prefix optional
+}
+
+// NewTLSConfig builds the client TLS config from settings. With pins the chain is still verified,
+// then one of the certificates of a verified chain must carry a pinned public key.
+func NewTLSConfig(settings TLSSettings) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName: settings.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if settings.CAFile != "" {
+		pem, err := os.ReadFile(settings.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read CA file error: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in CA file: %s", settings.CAFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if settings.CertFile != "" || settings.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(settings.CertFile, settings.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate error: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(settings.PinnedSPKI) > 0 {
+		pins := make(map[string]bool, len(settings.PinnedSPKI))
+		for _, pin := range settings.PinnedSPKI {
+			pin = strings.TrimPrefix(strings.TrimSpace(pin), "sha256/")
+			if digest, err := base64.StdEncoding.DecodeString(pin); err != nil || len(digest) != sha256.Size {
+				return nil, fmt.Errorf("illegal SPKI pin: %s", pin)
+			}
+			pins[pin] = true
+		}
+		// only the chains verified up to a trusted root count, the server can send any certificate
+		// it likes along with its own, a pinned key among those proves nothing
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			for _, chain := range state.VerifiedChains {
+				for _, cert := range chain {
+					if pins[SPKIPin(cert)] {
+						return nil
+					}
+				}
+			}
+			return fmt.Errorf("no pinned public key in the verified server certificate chain")
+		}
+	}
+	return config, nil
+}
+
+// SPKIPin returns the base64 SHA-256 of the certificate public key, as used in TLSSettings.PinnedSPKI.
+func SPKIPin(cert *x509.Certificate) string {
+	digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(digest[:])
+}
@@ -0,0 +1,109 @@
+package bridge
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCert makes a certificate for 127.0.0.1 signed by parent, or a self-signed CA without a parent.
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		template.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key}
+}
+
+// handshakePinned runs a TLS handshake against a server sending chain, with the client trusting ca
+// and pinning pin.
+func handshakePinned(t *testing.T, ca *testCert, chain []*testCert, pin string) error {
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	config, err := NewTLSConfig(TLSSettings{CAFile: caFile, PinnedSPKI: []string{"sha256/" + pin}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverCert := tls.Certificate{PrivateKey: chain[0].key}
+	for _, c := range chain {
+		serverCert.Certificate = append(serverCert.Certificate, c.cert.Raw)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{serverCert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_ = conn.(*tls.Conn).Handshake()
+	}()
+
+	conn, err := tls.Dial("tcp", listener.Addr().String(), config)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func TestTLSConfigPinsVerifiedChainOnly(t *testing.T) {
+	ca := newTestCert(t, "ca", nil)
+	leaf := newTestCert(t, "leaf", ca)
+	decoy := newTestCert(t, "decoy", nil)
+
+	if err := handshakePinned(t, ca, []*testCert{leaf}, SPKIPin(leaf.cert)); err != nil {
+		t.Fatalf("leaf pin: %v", err)
+	}
+	if err := handshakePinned(t, ca, []*testCert{leaf}, SPKIPin(ca.cert)); err != nil {
+		t.Fatalf("CA pin: %v", err)
+	}
+	// the decoy is sent by the server but chains to nothing trusted
+	if err := handshakePinned(t, ca, []*testCert{leaf, decoy}, SPKIPin(decoy.cert)); err == nil {
+		t.Fatal("pinned a certificate outside the verified chain")
+	}
+}
@@ -0,0 +1,457 @@
+package bridge
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/yangxm/gecko/base"
+	"github.com/yangxm/gecko/coder"
+	"github.com/yangxm/gecko/entity"
+	"github.com/yangxm/gecko/logger"
+	"google.golang.org/protobuf/proto"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	tlsDialTimeout      = 10 * time.Second
+	tlsHandshakeTimeout = 10 * time.Second
+)
+
+// TlsTransport carries the bridge frames over a raw TLS connection with length prefixed framing,
+// the conn params are sent in the first frame instead of http headers.
+type TlsTransport struct {
+	*transport
+	addr string
+}
+
+func NewTlsTransport(rawURL string, connParamGetter func() map[string]string, receiver base.BridgeReceiver, opts ...Option) (*TlsTransport, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse url error: %v", err)
+	}
+	if u.Scheme != "tls" || u.Host == "" {
+		return nil, fmt.Errorf("illegal tls url: %s", rawURL)
+	}
+
+	t := &TlsTransport{addr: u.Host}
+	t.transport = newTransport("TLSTP", rawURL, t.dial, connParamGetter, receiver, opts)
+	if err := t.start(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *TlsTransport) dial(ctx context.Context, params map[string]string, onPong func(payload []byte)) (link, error) {
+	var config *tls.Config
+	if t.options.tlsConfig != nil {
+		config = t.options.tlsConfig.Clone()
+	} else {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" {
+		if host, _, err := net.SplitHostPort(t.addr); err == nil {
+			config.ServerName = host
+		}
+	}
+
+	conn, err := t.dialTLS(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+
+	l := newFramedLink(conn, onPong)
+	data, err := proto.Marshal(&entity.ConnParams{Params: params})
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("marshal ConnParams error: %v", err)
+	}
+	if err := l.writeFrame(frameKindParams, data, time.Now().Add(transportWriteWait)); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("write ConnParams error: %v", err)
+	}
+	logger.Debug("[TLSTP] connected to %s, params: %d", t.addr, len(params))
+	return l, nil
+}
+
+func (t *TlsTransport) dialTLS(ctx context.Context, config *tls.Config) (*tls.Conn, error) {
+	proxyDial, err := t.options.proxyDial()
+	if err != nil {
+		return nil, err
+	}
+	if proxyDial == nil {
+		dialer := &tls.Dialer{NetDialer: &net.Dialer{Timeout: tlsDialTimeout}, Config: config}
+		conn, err := dialer.DialContext(ctx, "tcp", t.addr)
+		if err != nil {
+			return nil, err
+		}
+		return conn.(*tls.Conn), nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, tlsDialTimeout)
+	defer cancel()
+	rawConn, err := proxyDial(ctx, "tcp", t.addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := tls.Client(rawConn, config)
+	if err := conn.HandshakeContext(ctx); err != nil {
+		_ = rawConn.Close()
+		return nil, fmt.Errorf("tls handshake error: %v", err)
+	}
+	return conn, nil
+}
+
+// TlsListener is the server side of TlsTransport.
+type TlsListener struct {
+	listener     net.Listener
+	authenticate Authenticator
+}
+
+func ListenTLS(addr string, config *tls.Config) (*TlsListener, error) {
+	listener, err := tls.Listen("tcp", addr, config)
+	if err != nil {
+		return nil, fmt.Errorf("listen error: %v", err)
+	}
+	logger.Info("[TLSTP] listening on %s", listener.Addr())
+	return &TlsListener{listener: listener}, nil
+}
+
+// SetAuthenticator makes Accept drop the clients whose conn params are refused, call it before Accept.
+func (l *TlsListener) SetAuthenticator(authenticate Authenticator) {
+	l.authenticate = authenticate
+}
+
+func (l *TlsListener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+// Accept waits for the next client and reads its conn params, a client failing the handshake is
+// dropped and Accept goes on with the next one.
+func (l *TlsListener) Accept() (*ServerConn, error) {
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		serverConn, err := acceptFramed(conn)
+		if err != nil {
+			logger.Warn("[TLSTP] accept %s error: %v", conn.RemoteAddr(), err)
+			_ = conn.Close()
+			continue
+		}
+		if l.authenticate != nil {
+			if serverConn.clientID, err = l.authenticate(serverConn.params); err != nil {
+				logger.Warn("[TLSTP] accept %s, authenticate error: %v", conn.RemoteAddr(), err)
+				_ = serverConn.Close()
+				continue
+			}
+		}
+		return serverConn, nil
+	}
+}
+
+func (l *TlsListener) Close() error {
+	return l.listener.Close()
+}
+
+func acceptFramed(conn net.Conn) (*ServerConn, error) {
+	if err := conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout)); err != nil {
+		return nil, fmt.Errorf("set deadline error: %v", err)
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, fmt.Errorf("tls handshake error: %v", err)
+		}
+	}
+
+	l := newFramedLink(conn, nil)
+	kind, data, err := l.readFrame()
+	if err != nil {
+		return nil, fmt.Errorf("read ConnParams error: %v", err)
+	}
+	if kind != frameKindParams {
+		return nil, fmt.Errorf("unexpected first frame kind: 0x%02x", kind)
+	}
+	var params entity.ConnParams
+	if err := proto.Unmarshal(data, &params); err != nil {
+		return nil, fmt.Errorf("unmarshal ConnParams error: %v", err)
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return nil, fmt.Errorf("clear deadline error: %v", err)
+	}
+	return newServerConn(l, params.Params, conn.RemoteAddr()), nil
+}
+
+// ServerConn is one accepted bridge client. It answers the client pings and treats a client silent
+// for longer than the pong wait as gone; session, acks and streams are left to the server receiver.
+type ServerConn struct {
+	link       link
+	params     map[string]string
+	clientID   string
+	remoteAddr net.Addr
+	pongWait   time.Duration
+	codecs     *linkCodecs
+	streams    *streamTable
+	fragments  reassembler
+	compact    bool
+	enumHeader bool
+	maxFrame   int
+	mutex      sync.Mutex
+	writeMutex sync.Mutex
+	closed     bool
+	done       chan struct{}
+}
+
+func newServerConn(l link, params map[string]string, remoteAddr net.Addr) *ServerConn {
+	// no more than the Hello is read before SetNegotiated
+	l.SetReadLimit(transportMaxFrameSize)
+	return &ServerConn{
+		link:       l,
+		params:     params,
+		remoteAddr: remoteAddr,
+		pongWait:   transportPongWait,
+		codecs:     &linkCodecs{},
+		streams:    newStreamTable(),
+		done:       make(chan struct{}),
+	}
+}
+
+func (c *ServerConn) Params() map[string]string {
+	return c.params
+}
+
+// ClientID is the client the authenticator of the listener accepted, empty without one.
+func (c *ServerConn) ClientID() string {
+	return c.clientID
+}
+
+func (c *ServerConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// SetNegotiated sets up the codecs picked by Negotiate for the Hello of the client, the payloads sent
+// from now on are encoded with them and the received ones decoded before they reach the receiver.
+// A nil registry means coder.DefaultRegistry.
+func (c *ServerConn) SetNegotiated(negotiated Negotiated, registry *coder.Registry) error {
+	if registry == nil {
+		registry = coder.DefaultRegistry
+	}
+	codecs, err := newLinkCodecs(registry, negotiated)
+	if err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.codecs = codecs
+	c.compact = negotiated.Version >= protocolVersionStreamIDs
+	c.enumHeader = negotiated.Version >= protocolVersionEnumHeader
+	if negotiated.Supports(base.MsgTypeFragment) {
+		c.maxFrame = int(negotiated.MaxFrameSize)
+	}
+	c.link.SetReadLimit(int(negotiated.MaxFrameSize))
+	return nil
+}
+
+// Done is closed once the connection is closed.
+func (c *ServerConn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Serve hands every frame read to receiver until the connection fails or is closed.
+func (c *ServerConn) Serve(receiver base.BridgeReceiver) error {
+	defer c.Close()
+	for {
+		if err := c.link.SetReadDeadline(time.Now().Add(c.pongWait)); err != nil {
+			return fmt.Errorf("set read deadline error: %v", err)
+		}
+		data, err := c.link.ReadFrame()
+		if err != nil {
+			if c.isClosed() {
+				return nil
+			}
+			return err
+		}
+		if receiver != nil {
+			c.dispatch(data, receiver, false)
+		}
+	}
+}
+
+// dispatch unpacks batches and undoes the negotiated codecs, a frame that fails to decode is dropped.
+// A frame unpacked from a Batch or reassembled from Fragments is nested, it is never unpacked again,
+// see isLinkMessage.
+func (c *ServerConn) dispatch(data []byte, receiver base.BridgeReceiver, nested bool) {
+	var message entity.Message
+	if err := proto.Unmarshal(data, &message); err != nil {
+		logger.Warn("[SERVER] %s, unmarshal data to Message failed: %v", c.remoteAddr, err)
+		return
+	}
+	header := message.GetHeader()
+	if header == nil {
+		logger.Warn("[SERVER] %s, frame without a header dropped", c.remoteAddr)
+		return
+	}
+	normalized, err := coder.Normalize(header)
+	if err != nil {
+		logger.Warn("[SERVER] %s, illegal header %v: %v", c.remoteAddr, header, err)
+		return
+	}
+	if nested && isLinkMessage(header.Type[0]) {
+		logger.Warn("[SERVER] %s, nested 0x%02x frame dropped", c.remoteAddr, header.Type[0])
+		return
+	}
+	if !nested && header.Type[0] != base.MsgTypeFragment && c.fragments.interrupt() {
+		logger.Warn("[SERVER] %s, fragments cut short by a 0x%02x frame dropped", c.remoteAddr, header.Type[0])
+	}
+	if header.Type[0] == base.MsgTypeBatch {
+		var batch entity.Batch
+		if err := proto.Unmarshal(message.Data, &batch); err != nil {
+			logger.Warn("[SERVER] %s, unmarshal Batch error: %v", c.remoteAddr, err)
+			return
+		}
+		for _, frame := range batch.Frames {
+			c.dispatch(frame, receiver, true)
+		}
+		return
+	}
+	if header.Type[0] == base.MsgTypeCover {
+		return
+	}
+	if header.Type[0] == base.MsgTypeFragment {
+		c.mutex.Lock()
+		maxFrame := c.maxFrame
+		c.mutex.Unlock()
+		frame, err := c.fragments.push(message.Data, maxFrame)
+		if err != nil {
+			logger.Warn("[SERVER] %s, reassemble error: %v", c.remoteAddr, err)
+			return
+		}
+		if frame != nil {
+			c.dispatch(frame, receiver, true)
+		}
+		return
+	}
+	compact := header.StreamID != 0 && header.ConnID == ""
+	if !c.streams.expand(header) {
+		logger.Warn("[SERVER] %s, stream %d not bound on this link", c.remoteAddr, header.StreamID)
+		return
+	}
+	// a client speaks for itself only, the stream frames of another clientID, or of none, are dropped
+	if c.clientID != "" && header.ClientID != c.clientID && (header.ClientID != "" || isStreamMessage(header.Type[0])) {
+		logger.Warn("[SERVER] %s, frame of client %s on the link of client %s dropped", c.remoteAddr, header.ClientID, c.clientID)
+		return
+	}
+	c.mutex.Lock()
+	codecs := c.codecs
+	c.mutex.Unlock()
+	if codecs.decodes(&message) {
+		decoded, err := codecs.decode(&message)
+		if err != nil {
+			logger.Warn("[SERVER] %s, decode payload error: %v", c.remoteAddr, err)
+			// a frame that was never sealed may come from anyone, it doesn't get to close the stream
+			if err != errNotSealed && header.ConnID != "" && isStreamMessage(header.Type[0]) && !isStreamEnd(header.Type[0]) {
+				_, _ = c.SendError(header.ClientID, header.ConnID, base.ErrCodeProtocolError, "decode payload failed")
+			}
+			return
+		}
+		data = decoded
+	} else if compact || normalized {
+		if data, err = proto.Marshal(&message); err != nil {
+			logger.Warn("[SERVER] %s, marshal expanded message error: %v", c.remoteAddr, err)
+			return
+		}
+	}
+	receiver.OnReceived(data)
+}
+
+func (c *ServerConn) Send(_type, flag byte, clientID, connID string, serverType byte, data []byte) (int, error) {
+	if c.isClosed() {
+		return 0, fmt.Errorf("connection is closed")
+	}
+	if len(data) > fragmentMaxPayload {
+		return 0, fmt.Errorf("payload too large: %d > %d", len(data), fragmentMaxPayload)
+	}
+	message, err := coder.NewMessage(_type, flag, clientID, connID, serverType, data)
+	if err != nil {
+		return 0, fmt.Errorf("encode error: %v", err)
+	}
+	// answer on the stream ID the client bound the stream to
+	message.Header.StreamID = c.streams.streamID(connID)
+	c.mutex.Lock()
+	codecs, compact, enumHeader, maxFrame := c.codecs, c.compact, c.enumHeader, c.maxFrame
+	c.mutex.Unlock()
+
+	// a stream must be bound before its compact frames go out, and the fragments of two frames
+	// must not interleave, so the frames are written in the order they are encoded
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	if err := codecs.encode(message); err != nil {
+		return 0, err
+	}
+	if compact {
+		c.streams.compact(message)
+	}
+	if enumHeader {
+		message.Header = coder.StripLegacy(message.Header)
+	}
+	frame, err := proto.Marshal(message)
+	if err != nil {
+		return 0, fmt.Errorf("marshal message error: %v", err)
+	}
+	frames := [][]byte{frame}
+	if maxFrame > 0 && len(frame) > maxFrame {
+		if frames, err = fragment(frame, maxFrame, base.MsgFlagToClient); err != nil {
+			return 0, err
+		}
+	}
+	for _, f := range frames {
+		if err := c.link.WriteFrame(f, time.Now().Add(transportWriteWait)); err != nil {
+			return 0, err
+		}
+	}
+	return len(frame), nil
+}
+
+// SendConnectAck answers the Connect of a stream, a failed dial goes with its code, see base.ErrCodeOf.
+func (c *ServerConn) SendConnectAck(clientID, connID string, dialErr error) (int, error) {
+	notif := &entity.Notification{Code: base.ErrCodeOf(dialErr)}
+	if dialErr != nil {
+		notif.Message = dialErr.Error()
+	}
+	return c.sendNotification(base.MsgTypeConnectAck, clientID, connID, notif)
+}
+
+// SendError fails a stream with one of the base.ErrCode codes, the client answers a CONNECT not acked yet
+// with the matching SOCKS5 reply.
+func (c *ServerConn) SendError(clientID, connID string, code int32, message string) (int, error) {
+	return c.sendNotification(base.MsgTypeError, clientID, connID, &entity.Notification{Code: code, Message: message})
+}
+
+func (c *ServerConn) sendNotification(_type byte, clientID, connID string, notif *entity.Notification) (int, error) {
+	data, err := proto.Marshal(notif)
+	if err != nil {
+		return 0, fmt.Errorf("marshal Notification error: %v", err)
+	}
+	return c.Send(_type, base.MsgFlagToClient, clientID, connID, 0x00, data)
+}
+
+func (c *ServerConn) Close() error {
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	c.mutex.Unlock()
+	return c.link.Close()
+}
+
+func (c *ServerConn) isClosed() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.closed
+}
@@ -0,0 +1,126 @@
+package bridge
+
+import (
+	"bytes"
+	"github.com/google/uuid"
+	"github.com/yangxm/gecko/base"
+	"github.com/yangxm/gecko/coder"
+	"github.com/yangxm/gecko/entity"
+	"google.golang.org/protobuf/proto"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestServerConnDropsFramesOfOtherClients(t *testing.T) {
+	server := newTestServer(t, LinkConditions{})
+	server.listener.SetAuthenticator(func(params map[string]string) (string, error) {
+		return "c1", nil
+	})
+	client := server.dial(t, newTestClientReceiver())
+
+	own, other, none := uuid.New().String(), uuid.New().String(), uuid.New().String()
+	for connID, clientID := range map[string]string{other: "c2", none: "", own: "c1"} {
+		if _, err := client.Send(base.MsgTypeData, base.MsgFlagToServer, clientID, connID, 0x00, []byte(clientID+" data")); err != nil {
+			t.Fatalf("send error: %v", err)
+		}
+	}
+	server.waitFor(t, 5*time.Second, func() bool {
+		return server.received[own] != nil
+	})
+	time.Sleep(100 * time.Millisecond)
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if server.received[own].String() != "c1 data" {
+		t.Fatalf("own frame: %q", server.received[own].String())
+	}
+	if server.received[other] != nil || server.received[none] != nil {
+		t.Fatal("frame of another client delivered")
+	}
+}
+
+func TestServerConnConnectAckDecodes(t *testing.T) {
+	server := newTestServer(t, LinkConditions{})
+	receiver := newTestClientReceiver()
+	server.dial(t, receiver)
+
+	server.mutex.Lock()
+	conn := server.conns[0]
+	server.mutex.Unlock()
+	connID := uuid.New().String()
+	if _, err := conn.SendConnectAck("c1", connID, nil); err != nil {
+		t.Fatalf("send error: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if ok, err := receiver.connectAck(connID); ok {
+			if err != nil {
+				t.Fatalf("decode ConnectAck error: %v", err)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no ConnectAck")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServerConnRejectsNestedBatch(t *testing.T) {
+	client, server := newMemoryLinkPair(LinkConditions{}, nil)
+	defer client.Close()
+	conn := newServerConn(server, nil, memoryAddr("test"))
+	recorder := &frameRecorder{}
+	data, err := coder.Encode(base.MsgTypeData, base.MsgFlagToServer, "c1", uuid.New().String(), 0x00, []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.dispatch(nestBatch(t, data, 1), recorder, false)
+	if got := recorder.received(); !bytes.Equal(got, []byte{base.MsgTypeData}) {
+		t.Fatalf("batched frame, received: %v", got)
+	}
+	for _, depth := range []int{2, 1000} {
+		conn.dispatch(nestBatch(t, data, depth), recorder, false)
+	}
+	hello, _ := coder.Encode(base.MsgTypeHello, base.MsgFlagToServer, "", "", 0x00, []byte{0x08, 0x03})
+	conn.dispatch(nestBatch(t, hello, 1), recorder, false)
+	if got := recorder.received(); len(got) != 1 {
+		t.Fatalf("nested frames delivered: %v", got)
+	}
+}
+
+// countingReceiver counts the frames handed to it, parsable or not.
+type countingReceiver struct {
+	frames atomic.Int32
+}
+
+func (r *countingReceiver) OnReceived(data []byte) {
+	r.frames.Add(1)
+}
+
+func TestServerConnDropsUnparsableFrames(t *testing.T) {
+	client, server := newMemoryLinkPair(LinkConditions{}, nil)
+	defer client.Close()
+	conn := newServerConn(server, nil, memoryAddr("test"))
+	conn.clientID = "c1"
+	receiver := &countingReceiver{}
+	headless, err := proto.Marshal(&entity.Message{Data: []byte("data")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range [][]byte{{0xFF, 0xFF, 0xFF}, headless} {
+		conn.dispatch(data, receiver, false)
+	}
+	if n := receiver.frames.Load(); n != 0 {
+		t.Fatalf("unparsable frames delivered: %d", n)
+	}
+	own, err := coder.Encode(base.MsgTypeData, base.MsgFlagToServer, "c1", uuid.New().String(), 0x00, []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.dispatch(own, receiver, false)
+	if n := receiver.frames.Load(); n != 1 {
+		t.Fatalf("own frame, delivered: %d", n)
+	}
+}
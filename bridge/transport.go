@@ -0,0 +1,1029 @@
+package bridge
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"github.com/yangxm/gecko/base"
+	"github.com/yangxm/gecko/coder"
+	"github.com/yangxm/gecko/entity"
+	"github.com/yangxm/gecko/logger"
+	"github.com/yangxm/gecko/util"
+	"google.golang.org/protobuf/proto"
+	"math/big"
+	"sync"
+	"time"
+)
+
+const (
+	transportPingPeriod    = 10 * time.Second // default, see WithPingPeriod
+	transportPongWait      = 15 * time.Second // default, see WithPongWait
+	transportWriteWait     = 5 * time.Second
+	transportSendWait      = 10 * time.Second
+	transportAckPeriod     = 500 * time.Millisecond
+	transportLinkLostWait  = 30 * time.Second // default, see WithLinkLostWait
+	transportSendChanSize  = 32 * 1024
+	transportMaxFrameBytes = 16 * 1024 * 1024     // hard limit, for a reassembled frame too
+	transportMaxFrameSize  = 64 * 1024            // default, negotiated in the handshake
+	transportBatchBytes    = 64 * 1024            // default, see WithBatching
+	transportBatchDelay    = 2 * time.Millisecond // default, see WithBatching
+	transportBatchFrames   = 256
+
+	// the length and tag of a frame in a batch
+	batchFrameOverhead = 8
+
+	coverMaxBytes = 512
+)
+
+// the handshake waits are variables so the tests don't have to sit through them
+var (
+	transportResumeWait = 10 * time.Second
+	transportHelloWait  = 10 * time.Second
+)
+
+// link is one connection of a transport, the transport dials a new one every time the previous one failed.
+// WriteFrame is only called by the write loop, WritePing may be called concurrently with it.
+// A frame larger than the read limit fails the read.
+type link interface {
+	ReadFrame() ([]byte, error)
+	WriteFrame(data []byte, deadline time.Time) error
+	WritePing(payload []byte, deadline time.Time) error
+	SetReadDeadline(deadline time.Time) error
+	SetReadLimit(limit int)
+	Close() error
+}
+
+// linkDialer dials a new link, onPong must be called by the link for every pong it reads. ctx is done once
+// the transport is closed, the dial must give up then.
+type linkDialer func(ctx context.Context, params map[string]string, onPong func(payload []byte)) (link, error)
+
+// transport is the part shared by all the bridge transports: the send queue, the resumable session,
+// heartbeat, reconnect and link health. The concrete transports only provide the linkDialer.
+type transport struct {
+	tag             string
+	target          string
+	dialer          linkDialer
+	connParamGetter func() map[string]string
+	receiver        base.BridgeReceiver
+	options         *options
+	link            link
+	sendChan        chan *entity.Message
+	helloChan       chan *entity.Hello
+	resumeChan      chan *entity.SessionResume
+	session         *session
+	negotiated      Negotiated
+	codecs          *linkCodecs
+	state           TransportState
+	stateChanged    chan struct{}
+	lostListeners   []func(reason string)
+	attempts        int   // reconnect attempts since the transport was last connected
+	attemptErr      error // why the last of them failed
+	lostTimer       *time.Timer
+	dialCtx         context.Context
+	dialCancel      context.CancelFunc
+	forceChan       chan struct{}
+	meter           linkMeter
+	mutex           sync.Mutex
+	closed          bool
+	closeErr        error
+	done            chan struct{}
+}
+
+func newTransport(tag, target string, dialer linkDialer, connParamGetter func() map[string]string, receiver base.BridgeReceiver, opts []Option) *transport {
+	options := newOptions(opts)
+	parent := options.ctx
+	if parent == nil {
+		parent = context.Background()
+	}
+	dialCtx, dialCancel := context.WithCancel(parent)
+	t := &transport{
+		tag:             tag,
+		target:          target,
+		dialer:          dialer,
+		connParamGetter: connParamGetter,
+		receiver:        receiver,
+		options:         options,
+		codecs:          &linkCodecs{},
+		sendChan:        make(chan *entity.Message, transportSendChanSize),
+		helloChan:       make(chan *entity.Hello, 1),
+		resumeChan:      make(chan *entity.SessionResume, 1),
+		session:         newSession(sessionMaxRetransmitBytes),
+		state:           StateClosed,
+		stateChanged:    make(chan struct{}),
+		dialCtx:         dialCtx,
+		dialCancel:      dialCancel,
+		forceChan:       make(chan struct{}, 1),
+		done:            make(chan struct{}),
+	}
+	logger.Debug("[%s] transport created: %s", t.tag, t.target)
+	return t
+}
+
+// start dials the first link and waits for its handshake, the transport is closed if either fails
+// for good. A link lost during the handshake is left to the reconnect.
+func (t *transport) start() error {
+	t.setState(StateConnecting, nil)
+	if err := t.connect(); err != nil {
+		t.setState(StateClosed, err)
+		return err
+	}
+	if err := t.waitHandshake(); err != nil {
+		return err
+	}
+
+	if ctx := t.options.ctx; ctx != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				logger.Info("[%s] context done: %v", t.tag, ctx.Err())
+				_ = t.Close()
+			case <-t.done:
+			}
+		}()
+	}
+	return nil
+}
+
+func (t *transport) waitHandshake() error {
+	timer := time.NewTimer(transportHelloWait + transportResumeWait)
+	defer timer.Stop()
+	for {
+		t.mutex.Lock()
+		state, changed, closeErr := t.state, t.stateChanged, t.closeErr
+		t.mutex.Unlock()
+		switch state {
+		case StateConnected, StateBackoff:
+			return nil
+		case StateClosed:
+			if closeErr == nil {
+				closeErr = fmt.Errorf("connection is closed")
+			}
+			return closeErr
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return nil
+		}
+	}
+}
+
+// Negotiated returns the parameters agreed on in the handshake of the current link.
+func (t *transport) Negotiated() Negotiated {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.negotiated
+}
+
+func (t *transport) State() TransportState {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.state
+}
+
+func (t *transport) Stats() LinkStats {
+	return t.meter.snapshot(t.options.pongWait, time.Now())
+}
+
+func (t *transport) SmoothedRTT() time.Duration {
+	return t.Stats().SmoothedRTT
+}
+
+func (t *transport) IsAvailable() bool {
+	return t.State() == StateConnected
+}
+
+// WaitAvailable blocks until the link is usable, the transport is closed or the timeout expires.
+func (t *transport) WaitAvailable(timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		t.mutex.Lock()
+		state, changed, closed := t.state, t.stateChanged, t.closed
+		t.mutex.Unlock()
+		if state == StateConnected {
+			return true
+		}
+		if closed {
+			return false
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return false
+		}
+	}
+}
+
+func (t *transport) setState(state TransportState, err error) {
+	t.mutex.Lock()
+	if t.state == state && state != StateBackoff {
+		t.mutex.Unlock()
+		return
+	}
+	if t.closed && state != StateClosed {
+		t.mutex.Unlock()
+		return
+	}
+	t.state = state
+	close(t.stateChanged)
+	t.stateChanged = make(chan struct{})
+	listener := t.options.stateListener
+	t.mutex.Unlock()
+
+	logger.Debug("[%s] state -> %s, err: %v", t.tag, state, err)
+	if listener != nil {
+		listener(state, err)
+	}
+}
+
+func (t *transport) connect() error {
+	logger.Info("[%s] dialing to %s", t.tag, t.target)
+
+	var params map[string]string
+	if t.connParamGetter != nil {
+		params = t.connParamGetter()
+	}
+
+	var l link
+	l, err := t.dialer(t.dialCtx, params, func(payload []byte) {
+		now := time.Now()
+		if err := l.SetReadDeadline(now.Add(t.options.pongWait)); err != nil {
+			logger.Error("[%s] pong handler, set read deadline error: %v", t.tag, err)
+		}
+		if rtt, ok := t.meter.onPong(payload, now); ok {
+			logger.Debug("[%s] pong received, rtt: %v", t.tag, rtt)
+		} else {
+			logger.Debug("[%s] pong received", t.tag)
+		}
+	})
+	if err != nil {
+		logger.Error("[%s] dialing to %s error: %v", t.tag, t.target, err)
+		return fmt.Errorf("dialing error: %w", err)
+	}
+
+	if err := l.SetReadDeadline(time.Now().Add(t.options.pongWait)); err != nil {
+		logger.Error("[%s] connect, set read deadline error: %v", t.tag, err)
+		_ = l.Close()
+		return fmt.Errorf("set read deadline error: %v", err)
+	}
+	// the remote side can't pick a larger max frame size than we offer
+	l.SetReadLimit(int(min(t.options.capabilities.MaxFrameSize, transportMaxFrameBytes)))
+
+	t.mutex.Lock()
+	t.link = l
+	t.mutex.Unlock()
+
+	// every link gets its own set of loops, linkClosed stops the write side of a link as soon as
+	// its read side failed, so the loops of a dead link never outlive the reconnect
+	linkClosed := make(chan struct{})
+	streams := newStreamTable()
+	go t.readLoop(l, streams, linkClosed)
+	go t.writeLoop(l, streams, linkClosed)
+	go t.heartbeatLoop(l, linkClosed)
+
+	logger.Debug("[%s] connected to %s", t.tag, t.target)
+	return nil
+}
+
+func (t *transport) readLoop(l link, streams *streamTable, linkClosed chan struct{}) {
+	defer t.reconnect(l)
+	defer close(linkClosed)
+
+	fragments := &reassembler{}
+	for {
+		data, err := l.ReadFrame()
+		if err != nil {
+			logger.Error("[%s] read error: %v", t.tag, err)
+			return
+		}
+		logger.Debug("[%s] read: %d", t.tag, len(data))
+		t.onFrame(data, streams, fragments, false)
+	}
+}
+
+// onFrame handles a frame read from the link, or one unpacked from a Batch or reassembled from Fragments
+// when nested. A nested frame is never unpacked again, see isLinkMessage.
+func (t *transport) onFrame(data []byte, streams *streamTable, fragments *reassembler, nested bool) {
+	var message entity.Message
+	if err := proto.Unmarshal(data, &message); err != nil {
+		logger.Warn("[%s] read, unmarshal data to Message failed: %v", t.tag, err)
+		return
+	}
+	header := message.GetHeader()
+	normalized, err := coder.Normalize(header)
+	if err != nil {
+		logger.Warn("[%s] read, illegal header %v: %v", t.tag, header, err)
+		return
+	}
+	if nested && isLinkMessage(header.Type[0]) {
+		logger.Warn("[%s] read, nested 0x%02x frame dropped", t.tag, header.Type[0])
+		return
+	}
+	if !nested && header.Type[0] != base.MsgTypeFragment && fragments.interrupt() {
+		logger.Warn("[%s] read, fragments cut short by a 0x%02x frame dropped", t.tag, header.Type[0])
+	}
+	compact := header.StreamID != 0 && header.ConnID == ""
+	if !streams.expand(header) {
+		logger.Warn("[%s] read, stream %d not bound on this link", t.tag, header.StreamID)
+		return
+	}
+	t.mutex.Lock()
+	codecs := t.codecs
+	t.mutex.Unlock()
+	if codecs.decodes(&message) {
+		if data, err = codecs.decode(&message); err != nil {
+			logger.Warn("[%s] [%s] read, decode payload error: %v", t.tag, util.ShortConnID(header.ConnID), err)
+			return
+		}
+	} else if compact || normalized {
+		if data, err = proto.Marshal(&message); err != nil {
+			logger.Warn("[%s] read, marshal expanded message error: %v", t.tag, err)
+			return
+		}
+	}
+
+	switch header.Type[0] {
+	case base.MsgTypeBatch:
+		var batch entity.Batch
+		if err := proto.Unmarshal(message.Data, &batch); err != nil {
+			logger.Warn("[%s] read, unmarshal Batch failed: %v", t.tag, err)
+			return
+		}
+		for _, frame := range batch.Frames {
+			t.onFrame(frame, streams, fragments, true)
+		}
+	case base.MsgTypeFragment:
+		maxFrameSize := 0
+		if negotiated := t.Negotiated(); negotiated.Supports(base.MsgTypeFragment) {
+			maxFrameSize = int(negotiated.MaxFrameSize)
+		}
+		frame, err := fragments.push(message.Data, maxFrameSize)
+		if err != nil {
+			logger.Warn("[%s] read, reassemble error: %v", t.tag, err)
+			return
+		}
+		if frame != nil {
+			t.onFrame(frame, streams, fragments, true)
+		}
+	case base.MsgTypeCover:
+		logger.Debug("[%s] read, cover frame dropped: %d", t.tag, len(message.Data))
+	case base.MsgTypeAck:
+		var ack entity.SessionAck
+		if err := proto.Unmarshal(message.Data, &ack); err != nil {
+			logger.Warn("[%s] read, unmarshal SessionAck failed: %v", t.tag, err)
+			return
+		}
+		t.session.onAck(ack.Acks)
+	case base.MsgTypeHelloAck:
+		var ack entity.Hello
+		if err := proto.Unmarshal(message.Data, &ack); err != nil {
+			logger.Warn("[%s] read, unmarshal HelloAck failed: %v", t.tag, err)
+			return
+		}
+		select {
+		case t.helloChan <- &ack:
+		default:
+			logger.Warn("[%s] read, unexpected HelloAck dropped", t.tag)
+		}
+	case base.MsgTypeResumeAck:
+		var resp entity.SessionResume
+		if err := proto.Unmarshal(message.Data, &resp); err != nil {
+			logger.Warn("[%s] read, unmarshal SessionResume failed: %v", t.tag, err)
+			return
+		}
+		select {
+		case t.resumeChan <- &resp:
+		default:
+			logger.Warn("[%s] read, unexpected ResumeAck dropped", t.tag)
+		}
+	default:
+		if !t.session.accept(header) {
+			return
+		}
+		if t.receiver != nil {
+			t.receiver.OnReceived(data)
+		}
+	}
+}
+
+func (t *transport) encode(message *entity.Message) error {
+	t.mutex.Lock()
+	codecs := t.codecs
+	t.mutex.Unlock()
+	return codecs.encode(message)
+}
+
+// linkEncoder runs the codecs and then compacts the stream header when the remote side expands it, the codecs
+// still see the full header. The bytes of the header are left out for a remote side reading the enums.
+func (t *transport) linkEncoder(streams *streamTable) func(message *entity.Message) error {
+	version := t.Negotiated().Version
+	return func(message *entity.Message) error {
+		if err := t.encode(message); err != nil {
+			return err
+		}
+		if version >= protocolVersionStreamIDs {
+			streams.compact(message)
+		}
+		if version >= protocolVersionEnumHeader {
+			message.Header = coder.StripLegacy(message.Header)
+		}
+		return nil
+	}
+}
+
+func (t *transport) writeLoop(l link, streams *streamTable, linkClosed chan struct{}) {
+	if err := t.hello(l, linkClosed); err != nil {
+		if handshakeErr, ok := err.(*HandshakeError); ok {
+			logger.Error("[%s] %v", t.tag, handshakeErr)
+			_ = t.closeWithError(handshakeErr)
+			return
+		}
+		logger.Error("[%s] hello error: %v", t.tag, err)
+		t.failAttempt(err)
+		_ = l.Close()
+		return
+	}
+	encode := t.linkEncoder(streams)
+	if err := t.resume(l, encode, linkClosed); err != nil {
+		if handshakeErr, ok := err.(*HandshakeError); ok {
+			logger.Error("[%s] %v", t.tag, handshakeErr)
+			_ = t.closeWithError(handshakeErr)
+			return
+		}
+		logger.Error("[%s] resume session error: %v", t.tag, err)
+		t.failAttempt(fmt.Errorf("resume session error: %v", err))
+		_ = l.Close()
+		return
+	}
+	t.connected()
+
+	ackTicker := time.NewTicker(transportAckPeriod)
+	defer ackTicker.Stop()
+
+	// the cover timer restarts on every frame written, so it only fires on an idle link
+	coverInterval := t.options.coverInterval
+	if !t.Negotiated().Supports(base.MsgTypeCover) {
+		coverInterval = 0
+	}
+	var coverChan <-chan time.Time
+	var coverTimer *time.Timer
+	if coverInterval > 0 {
+		coverTimer = time.NewTimer(jitter(coverInterval))
+		defer coverTimer.Stop()
+		coverChan = coverTimer.C
+	}
+	resetCover := func() {
+		if coverTimer != nil {
+			coverTimer.Reset(jitter(coverInterval))
+		}
+	}
+
+	for {
+		// stop taking new frames while the retransmit buffer is full, until the remote side acked some
+		var sendChan chan *entity.Message
+		if t.session.hasRoom() {
+			sendChan = t.sendChan
+		}
+
+		select {
+		case message := <-sendChan:
+			if err := t.writeBatch(l, encode, message); err != nil {
+				logger.Error("[%s] write error: %v", t.tag, err)
+				_ = l.Close()
+				return
+			}
+			resetCover()
+		case <-t.session.roomChan:
+		case <-ackTicker.C:
+			if err := t.writeAck(l); err != nil {
+				logger.Error("[%s] write ack error: %v", t.tag, err)
+				_ = l.Close()
+				return
+			}
+		case <-coverChan:
+			if err := t.writeCover(l); err != nil {
+				logger.Error("[%s] write cover error: %v", t.tag, err)
+				_ = l.Close()
+				return
+			}
+			resetCover()
+		case <-linkClosed:
+			return
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// writeBatch writes message together with the ones queued behind it, waiting up to the batch delay for more.
+// Every frame is stamped and encoded on its own, so the remote side unpacks the batch into the same frames.
+func (t *transport) writeBatch(l link, encode func(message *entity.Message) error, message *entity.Message) error {
+	maxBytes, delay := t.batchLimits()
+	var batch [][]byte
+	size := 0
+	var timer *time.Timer
+	for message != nil {
+		data, err := t.session.stamp(message, encode)
+		if err != nil {
+			logger.Error("[%s] write, marshal message error: %v", t.tag, err)
+		} else if size > 0 && size+len(data)+batchFrameOverhead > maxBytes {
+			if err := t.writeFrames(l, batch); err != nil {
+				return err
+			}
+			batch, size = [][]byte{data}, len(data)+batchFrameOverhead
+		} else {
+			batch = append(batch, data)
+			size += len(data) + batchFrameOverhead
+		}
+		if size >= maxBytes || len(batch) >= transportBatchFrames || !t.session.hasRoom() {
+			break
+		}
+
+		message = nil
+		select {
+		case message = <-t.sendChan:
+			continue
+		default:
+		}
+		if delay <= 0 {
+			break
+		}
+		if timer == nil {
+			timer = time.NewTimer(delay)
+			defer timer.Stop()
+		}
+		select {
+		case message = <-t.sendChan:
+		case <-timer.C:
+		case <-t.done:
+		}
+	}
+	return t.writeFrames(l, batch)
+}
+
+// batchLimits returns a max batch size of 0 when the remote side doesn't unpack batches.
+func (t *transport) batchLimits() (int, time.Duration) {
+	t.mutex.Lock()
+	negotiated := t.negotiated
+	t.mutex.Unlock()
+	if !negotiated.Supports(base.MsgTypeBatch) {
+		return 0, 0
+	}
+	return min(t.options.batchBytes, int(negotiated.MaxFrameSize)-fragmentOverhead), t.options.batchDelay
+}
+
+func (t *transport) writeFrames(l link, frames [][]byte) error {
+	if len(frames) == 0 {
+		return nil
+	}
+	if len(frames) == 1 {
+		return t.write(l, frames[0])
+	}
+	data, err := proto.Marshal(&entity.Batch{Frames: frames})
+	if err != nil {
+		return fmt.Errorf("marshal Batch error: %v", err)
+	}
+	message, err := coder.Encode(base.MsgTypeBatch, base.MsgFlagToServer, "", "", 0x00, data)
+	if err != nil {
+		return fmt.Errorf("encode Batch error: %v", err)
+	}
+	logger.Debug("[%s] write batch, frames: %d, size: %d", t.tag, len(frames), len(message))
+	return t.write(l, message)
+}
+
+// write splits a frame larger than the negotiated max frame size into fragments.
+func (t *transport) write(l link, data []byte) error {
+	t.mutex.Lock()
+	negotiated := t.negotiated
+	t.mutex.Unlock()
+	if negotiated.MaxFrameSize == 0 || len(data) <= int(negotiated.MaxFrameSize) {
+		return l.WriteFrame(data, time.Now().Add(transportWriteWait))
+	}
+	if !negotiated.Supports(base.MsgTypeFragment) {
+		return fmt.Errorf("frame too large: %d > %d", len(data), negotiated.MaxFrameSize)
+	}
+	frames, err := fragment(data, int(negotiated.MaxFrameSize), base.MsgFlagToServer)
+	if err != nil {
+		return err
+	}
+	logger.Debug("[%s] write %d in %d fragments", t.tag, len(data), len(frames))
+	for _, frame := range frames {
+		if err := l.WriteFrame(frame, time.Now().Add(transportWriteWait)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *transport) writeAck(l link) error {
+	acks := t.session.takeAcks()
+	if len(acks) == 0 {
+		return nil
+	}
+	data, err := proto.Marshal(&entity.SessionAck{Acks: acks})
+	if err != nil {
+		return fmt.Errorf("marshal SessionAck error: %v", err)
+	}
+	message, err := coder.Encode(base.MsgTypeAck, base.MsgFlagToServer, "", "", 0x00, data)
+	if err != nil {
+		return fmt.Errorf("encode SessionAck error: %v", err)
+	}
+	logger.Debug("[%s] write ack, streams: %d", t.tag, len(acks))
+	return t.write(l, message)
+}
+
+// writeCover writes a frame of random size and content, the remote side drops it.
+func (t *transport) writeCover(l link) error {
+	n, err := rand.Int(rand.Reader, big.NewInt(coverMaxBytes+1))
+	if err != nil {
+		return fmt.Errorf("random cover size error: %v", err)
+	}
+	data := make([]byte, n.Int64())
+	if _, err := rand.Read(data); err != nil {
+		return fmt.Errorf("random cover error: %v", err)
+	}
+	message, err := coder.Encode(base.MsgTypeCover, base.MsgFlagToServer, "", "", 0x00, data)
+	if err != nil {
+		return fmt.Errorf("encode cover error: %v", err)
+	}
+	logger.Debug("[%s] write cover: %d", t.tag, len(data))
+	return t.write(l, message)
+}
+
+// jitter returns a random duration between half and one and a half of d.
+func jitter(d time.Duration) time.Duration {
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(d)+1))
+	if err != nil {
+		return d
+	}
+	return d/2 + time.Duration(n.Int64())
+}
+
+// hello runs the capability handshake on a new link, it comes before anything else on the link.
+func (t *transport) hello(l link, linkClosed chan struct{}) error {
+	select {
+	case <-t.helloChan:
+	default:
+	}
+
+	handshake, err := newClientHandshake(t.options.capabilities)
+	if err != nil {
+		return err
+	}
+	data, err := proto.Marshal(handshake.hello)
+	if err != nil {
+		return fmt.Errorf("marshal Hello error: %v", err)
+	}
+	message, err := coder.Encode(base.MsgTypeHello, base.MsgFlagToServer, "", "", 0x00, data)
+	if err != nil {
+		return fmt.Errorf("encode Hello error: %v", err)
+	}
+	if err := t.write(l, message); err != nil {
+		return fmt.Errorf("write Hello error: %v", err)
+	}
+
+	timer := time.NewTimer(transportHelloWait)
+	defer timer.Stop()
+	var ack *entity.Hello
+	select {
+	case ack = <-t.helloChan:
+	case <-timer.C:
+		// a half-open or lossy link looks the same as a remote side ignoring the Hello, only a refusal is final
+		return fmt.Errorf("no HelloAck after %v", transportHelloWait)
+	case <-linkClosed:
+		return fmt.Errorf("link closed")
+	case <-t.done:
+		return fmt.Errorf("transport closed")
+	}
+
+	negotiated, handshakeErr := handshake.accept(ack)
+	if handshakeErr != nil {
+		return handshakeErr
+	}
+	codecs, handshakeErr := newLinkCodecs(t.options.codecs, negotiated)
+	if handshakeErr != nil {
+		return handshakeErr
+	}
+	t.mutex.Lock()
+	t.negotiated = negotiated
+	t.codecs = codecs
+	t.mutex.Unlock()
+	l.SetReadLimit(int(negotiated.MaxFrameSize))
+	logger.Info("[%s] handshake done, version: %d, compression: %s, encryption: %s, obfuscation: %s, max frame size: %d",
+		t.tag, negotiated.Version, negotiated.Compression, negotiated.Encryption, negotiated.Obfuscation, negotiated.MaxFrameSize)
+	return nil
+}
+
+// resume runs the resume handshake on a new link and retransmits the frames the remote side missed.
+// A session the remote side refuses is dropped with all its streams and a new one is offered once, a remote
+// side refusing that as well won't take any session and the transport is closed. A request left unanswered
+// only fails the link, the next one resumes the same session.
+func (t *transport) resume(l link, encode func(message *entity.Message) error, linkClosed chan struct{}) error {
+	req, resp, err := t.requestResume(l, linkClosed)
+	if err == nil && resp.Code != 0 {
+		reason := fmt.Sprintf("code: %d, message: %s", resp.Code, resp.Message)
+		logger.Warn("[%s] resume session %s refused, %s, start a new session", t.tag, req.SessionID, reason)
+		t.closeStreams(t.session.lost(), fmt.Sprintf("bridge session lost: %s", reason))
+
+		req, resp, err = t.requestResume(l, linkClosed)
+		if err == nil && resp.Code != 0 {
+			return &HandshakeError{Reason: fmt.Sprintf("new session %s refused, code: %d, message: %s", req.SessionID, resp.Code, resp.Message)}
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	// the frames are encoded again, the keys of the link they were first sent on are gone
+	frames := t.session.resume(resp)
+	for _, frame := range frames {
+		if err := encode(frame); err != nil {
+			return fmt.Errorf("retransmit, encode error: %v", err)
+		}
+		data, err := proto.Marshal(frame)
+		if err != nil {
+			return fmt.Errorf("retransmit, marshal error: %v", err)
+		}
+		if err := t.write(l, data); err != nil {
+			return fmt.Errorf("retransmit error: %v", err)
+		}
+	}
+	logger.Info("[%s] session %s resumed, retransmitted: %d", t.tag, req.SessionID, len(frames))
+	return nil
+}
+
+// requestResume sends the resume request of the current session and waits for the answer of the remote side.
+func (t *transport) requestResume(l link, linkClosed chan struct{}) (*entity.SessionResume, *entity.SessionResume, error) {
+	select {
+	case <-t.resumeChan:
+	default:
+	}
+
+	req := t.session.resumeRequest()
+	data, err := proto.Marshal(req)
+	if err != nil {
+		return req, nil, fmt.Errorf("marshal SessionResume error: %v", err)
+	}
+	message, err := coder.Encode(base.MsgTypeResume, base.MsgFlagToServer, "", "", 0x00, data)
+	if err != nil {
+		return req, nil, fmt.Errorf("encode SessionResume error: %v", err)
+	}
+	if err := t.write(l, message); err != nil {
+		return req, nil, fmt.Errorf("write SessionResume error: %v", err)
+	}
+	logger.Debug("[%s] resume session %s, streams: %d", t.tag, req.SessionID, len(req.Acks))
+
+	timer := time.NewTimer(transportResumeWait)
+	defer timer.Stop()
+	select {
+	case resp := <-t.resumeChan:
+		return req, resp, nil
+	case <-timer.C:
+		return req, nil, fmt.Errorf("no ResumeAck after %v", transportResumeWait)
+	case <-linkClosed:
+		return req, nil, fmt.Errorf("link closed")
+	case <-t.done:
+		return req, nil, fmt.Errorf("transport closed")
+	}
+}
+
+// closeStreams hands a Close for every lost stream to the receiver, as if the remote side had closed them.
+func (t *transport) closeStreams(streams map[string]string, reason string) {
+	if t.receiver == nil {
+		return
+	}
+	for connID, clientID := range streams {
+		data, err := proto.Marshal(&entity.Notification{Message: reason})
+		if err != nil {
+			continue
+		}
+		message, err := coder.Encode(base.MsgTypeClose, base.MsgFlagToClient, clientID, connID, 0x00, data)
+		if err != nil {
+			continue
+		}
+		logger.Warn("[%s] [%s] close stream: %s", t.tag, util.ShortConnID(connID), reason)
+		t.receiver.OnReceived(message)
+	}
+}
+
+func (t *transport) heartbeatLoop(l link, linkClosed chan struct{}) {
+	ticker := time.NewTicker(t.options.pingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			now := time.Now()
+			payload := t.meter.onPing(now)
+			if err := l.WritePing(payload, now.Add(transportWriteWait)); err != nil {
+				logger.Error("[%s] send ping error: %v", t.tag, err)
+				return
+			}
+			logger.Debug("[%s] send ping", t.tag)
+		case <-linkClosed:
+			return
+		case <-t.done:
+			return
+		}
+	}
+}
+
+func (t *transport) Send(_type, flag byte, clientID, connID string, serverType byte, data []byte) (int, error) {
+	shortConn := util.ShortConnID(connID)
+	dataLen := len(data)
+	logger.Debug("[%s] [%s] send %d start", t.tag, shortConn, dataLen)
+
+	if t.isClosed() {
+		logger.Error("[%s] [%s] send %d error: connection is closed", t.tag, shortConn, dataLen)
+		return 0, fmt.Errorf("connection is closed")
+	}
+	if dataLen > fragmentMaxPayload {
+		logger.Error("[%s] [%s] send %d error: payload too large", t.tag, shortConn, dataLen)
+		return 0, fmt.Errorf("payload too large: %d > %d", dataLen, fragmentMaxPayload)
+	}
+
+	// the message is marshaled by the write loop, so it must not share the caller's buffer
+	if message, err := coder.NewMessage(_type, flag, clientID, connID, serverType, bytes.Clone(data)); err != nil {
+		logger.Error("[%s] [%s] send %d error: encode error: %v", t.tag, shortConn, dataLen, err)
+		return 0, fmt.Errorf("[%s] send, encode error: %v", t.tag, err)
+	} else {
+		encodedDataLen := proto.Size(message)
+		timer := time.NewTimer(transportSendWait)
+		defer timer.Stop()
+		select {
+		case t.sendChan <- message:
+			logger.Debug("[%s] [%s] send %d -> %d", t.tag, shortConn, dataLen, encodedDataLen)
+			return encodedDataLen, nil
+		case <-t.done:
+			logger.Error("[%s] [%s] send %d -> %d error: connection is closed", t.tag, shortConn, dataLen, encodedDataLen)
+			return 0, fmt.Errorf("connection is closed")
+		case <-timer.C:
+			logger.Error("[%s] [%s] send %d -> %d error: send channel full for %v", t.tag, shortConn, dataLen, encodedDataLen, transportSendWait)
+			return 0, fmt.Errorf("send timeout after %v", transportSendWait)
+		}
+	}
+}
+
+func (t *transport) reconnect(l link) {
+	if t.isClosed() {
+		return
+	}
+
+	logger.Info("[%s] reconnecting...", t.tag)
+	if err := l.Close(); err != nil {
+		logger.Warn("[%s] close old link error: %v", t.tag, err)
+	}
+
+	// streams survive a short outage through the session resume, a longer one closes them right away
+	// instead of leaving them hanging on a link that may never come back. The outage lasts until a link
+	// is connected again, the links dialed and dropped in the meantime don't end it.
+	linkLostWait := t.options.linkLostWait
+	t.mutex.Lock()
+	if t.lostTimer == nil {
+		t.lostTimer = time.AfterFunc(linkLostWait, func() {
+			t.declareLinkLost(fmt.Sprintf("bridge link lost for %v", linkLostWait))
+		})
+	}
+
+	// a link dialed is not a reconnect done, the attempts go on from where the last link left them
+	// until one gets through the handshake
+	first, lastErr := t.attempts, t.attemptErr
+	t.mutex.Unlock()
+	for attempt := first; ; attempt++ {
+		if t.options.backoff.Exhausted(attempt) {
+			err := fmt.Errorf("reconnect gave up after %d attempts, last error: %v", attempt, lastErr)
+			logger.Error("[%s] %v", t.tag, err)
+			t.closeWithError(err)
+			return
+		}
+
+		delay := t.options.backoff.Delay(attempt)
+		t.setState(StateBackoff, lastErr)
+		logger.Info("[%s] reconnect in %v, attempt: %d", t.tag, delay, attempt+1)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-t.forceChan:
+			timer.Stop()
+			logger.Info("[%s] reconnect forced", t.tag)
+		case <-t.done:
+			timer.Stop()
+			return
+		}
+
+		t.setState(StateConnecting, nil)
+		t.mutex.Lock()
+		t.attempts = attempt + 1
+		t.mutex.Unlock()
+		if err := t.connect(); err == nil {
+			logger.Info("[%s] link dialed, attempt: %d", t.tag, attempt+1)
+			return
+		} else {
+			lastErr = err
+			t.failAttempt(err)
+			logger.Error("[%s] reconnect error: %v, retries: %d", t.tag, err, attempt+1)
+		}
+	}
+}
+
+// failAttempt records why the current link didn't get connected, for the reconnect giving up.
+func (t *transport) failAttempt(err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.attemptErr = err
+}
+
+// connected ends the outage, the next link lost starts over with the first attempt and a new lost timer.
+func (t *transport) connected() {
+	t.mutex.Lock()
+	t.attempts, t.attemptErr = 0, nil
+	if t.lostTimer != nil {
+		t.lostTimer.Stop()
+		t.lostTimer = nil
+	}
+	t.mutex.Unlock()
+	t.setState(StateConnected, nil)
+}
+
+func (t *transport) declareLinkLost(reason string) {
+	logger.Warn("[%s] %s, close all streams", t.tag, reason)
+	t.closeStreams(t.session.lost(), reason)
+
+	t.mutex.Lock()
+	listeners := t.lostListeners
+	t.mutex.Unlock()
+	for _, listener := range listeners {
+		listener(reason)
+	}
+}
+
+// OnLinkLost adds a listener called every time the link is declared lost, the streams the session doesn't
+// know of, like the ones whose Connect is still queued, are left to it.
+func (t *transport) OnLinkLost(listener func(reason string)) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.lostListeners = append(t.lostListeners, listener)
+}
+
+// Reconnect drops the current link, or skips the pending backoff wait, and dials again right away.
+func (t *transport) Reconnect() error {
+	t.mutex.Lock()
+	if t.closed {
+		t.mutex.Unlock()
+		return fmt.Errorf("connection is closed")
+	}
+	l, state := t.link, t.state
+	t.mutex.Unlock()
+
+	select {
+	case t.forceChan <- struct{}{}:
+	default:
+	}
+	logger.Info("[%s] force reconnect, state: %s", t.tag, state)
+	if state == StateConnected && l != nil {
+		return l.Close()
+	}
+	return nil
+}
+
+func (t *transport) Close() error {
+	return t.closeWithError(nil)
+}
+
+func (t *transport) closeWithError(cause error) error {
+	t.mutex.Lock()
+	if t.closed {
+		t.mutex.Unlock()
+		logger.Info("[%s] already closed", t.tag)
+		return nil
+	}
+	t.closed = true
+	t.closeErr = cause
+	close(t.done)
+	l := t.link
+	if t.lostTimer != nil {
+		t.lostTimer.Stop()
+		t.lostTimer = nil
+	}
+	t.mutex.Unlock()
+	t.dialCancel()
+
+	var err error
+	if l != nil {
+		if err = l.Close(); err != nil {
+			logger.Error("[%s] close link error: %v", t.tag, err)
+		}
+	}
+	t.setState(StateClosed, cause)
+	t.declareLinkLost("bridge transport closed")
+	logger.Info("[%s] closed", t.tag)
+	return err
+}
+
+func (t *transport) isClosed() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.closed
+}
@@ -0,0 +1,28 @@
+package bridge
+
+type TransportState int
+
+const (
+	StateConnecting TransportState = iota
+	StateConnected
+	StateBackoff
+	StateClosed
+)
+
+func (s TransportState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateBackoff:
+		return "backoff"
+	case StateClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+// StateListener is notified on every state change of a transport, err is the cause of the change if any.
+type StateListener func(state TransportState, err error)
@@ -0,0 +1,503 @@
+package bridge
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/yangxm/gecko/base"
+	"github.com/yangxm/gecko/coder"
+	"github.com/yangxm/gecko/entity"
+	"google.golang.org/protobuf/proto"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stateRecorder is a StateListener keeping every state change.
+type stateRecorder struct {
+	mutex  sync.Mutex
+	states []TransportState
+	errs   []error
+}
+
+func (r *stateRecorder) listen(state TransportState, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.states = append(r.states, state)
+	r.errs = append(r.errs, err)
+}
+
+func (r *stateRecorder) last() (TransportState, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.states[len(r.states)-1], r.errs[len(r.errs)-1]
+}
+
+func TestTransportHelloWithoutAnswerReconnects(t *testing.T) {
+	helloWait := transportHelloWait
+	transportHelloWait = 100 * time.Millisecond
+	defer func() {
+		transportHelloWait = helloWait
+	}()
+
+	server := newTestServer(t, LinkConditions{})
+	server.silentHello.Store(true)
+	client := server.dial(t, newTestClientReceiver())
+	server.waitFor(t, 5*time.Second, func() bool {
+		return server.links >= 3
+	})
+	if state := client.State(); state == StateClosed || state == StateConnected {
+		t.Fatalf("state: %s", state)
+	}
+
+	// the link recovers, the transport gets there without help
+	server.silentHello.Store(false)
+	if !client.WaitAvailable(5 * time.Second) {
+		t.Fatalf("transport not available, state: %s", client.State())
+	}
+}
+
+func TestTransportHelloRefusedIsTerminal(t *testing.T) {
+	server := newTestServer(t, LinkConditions{})
+	server.rejectHello.Store(true)
+	recorder := &stateRecorder{}
+	_, err := NewMemoryTransport(server.listener, nil, newTestClientReceiver(), WithStateListener(recorder.listen))
+	var handshakeErr *HandshakeError
+	if !errors.As(err, &handshakeErr) {
+		t.Fatalf("dial error: %v, want a HandshakeError", err)
+	}
+	if state, err := recorder.last(); state != StateClosed || !errors.As(err, &handshakeErr) {
+		t.Fatalf("last state: %s, %v", state, err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if server.links != 1 {
+		t.Fatalf("links: %d, want no reconnect", server.links)
+	}
+}
+
+func TestTransportResumeRefusedStartsNewSession(t *testing.T) {
+	server := newTestServer(t, LinkConditions{})
+	receiver := newTestClientReceiver()
+	client := server.dial(t, receiver)
+
+	lost := uuid.New().String()
+	if _, err := client.Send(base.MsgTypeData, base.MsgFlagToServer, "client", lost, 0x00, []byte("before")); err != nil {
+		t.Fatalf("send error: %v", err)
+	}
+	server.waitFor(t, 5*time.Second, func() bool {
+		return server.received[lost] != nil
+	})
+
+	server.refuseResume.Store(1)
+	_ = client.Reconnect()
+	server.waitFor(t, 5*time.Second, func() bool {
+		return server.resumes == 3
+	})
+	if !client.WaitAvailable(5 * time.Second) {
+		t.Fatalf("transport not available after the new session, state: %s", client.State())
+	}
+	if reason, ok := receiver.closedStreams()[lost]; !ok || !strings.HasPrefix(reason, "bridge session lost") {
+		t.Fatalf("stream of the refused session not closed: %q", reason)
+	}
+
+	fresh := uuid.New().String()
+	if _, err := client.Send(base.MsgTypeData, base.MsgFlagToServer, "client", fresh, 0x00, []byte("after")); err != nil {
+		t.Fatalf("send error: %v", err)
+	}
+	server.waitFor(t, 5*time.Second, func() bool {
+		return server.received[fresh] != nil && server.received[fresh].String() == "after"
+	})
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if server.refused != 1 || server.links != 2 {
+		t.Fatalf("refused: %d, links: %d", server.refused, server.links)
+	}
+}
+
+func TestTransportResumeRefusedTwiceIsTerminal(t *testing.T) {
+	server := newTestServer(t, LinkConditions{})
+	recorder := &stateRecorder{}
+	client := server.dial(t, newTestClientReceiver(), WithStateListener(recorder.listen))
+
+	server.refuseResume.Store(2)
+	_ = client.Reconnect()
+	server.waitFor(t, 5*time.Second, func() bool {
+		return server.refused == 2
+	})
+	if client.WaitAvailable(time.Second) {
+		t.Fatal("transport available after the new session was refused")
+	}
+	var handshakeErr *HandshakeError
+	if state, err := recorder.last(); state != StateClosed || !errors.As(err, &handshakeErr) {
+		t.Fatalf("last state: %s, %v", state, err)
+	}
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if server.links != 2 {
+		t.Fatalf("links: %d, want no reconnect", server.links)
+	}
+}
+
+func TestTransportResumeWithoutAnswerReconnects(t *testing.T) {
+	resumeWait := transportResumeWait
+	transportResumeWait = 100 * time.Millisecond
+	defer func() {
+		transportResumeWait = resumeWait
+	}()
+
+	server := newTestServer(t, LinkConditions{})
+	receiver := newTestClientReceiver()
+	client := server.dial(t, receiver)
+	stream := uuid.New().String()
+	if _, err := client.Send(base.MsgTypeData, base.MsgFlagToServer, "client", stream, 0x00, []byte("before ")); err != nil {
+		t.Fatalf("send error: %v", err)
+	}
+	server.waitFor(t, 5*time.Second, func() bool {
+		return server.received[stream] != nil
+	})
+
+	// a slow link keeps the transport reconnecting, the session and its streams stay
+	server.silentResume.Store(true)
+	_ = client.Reconnect()
+	server.waitFor(t, 5*time.Second, func() bool {
+		return server.links >= 4
+	})
+	if state := client.State(); state == StateClosed {
+		t.Fatal("transport closed on an unanswered resume")
+	}
+
+	server.silentResume.Store(false)
+	if !client.WaitAvailable(5 * time.Second) {
+		t.Fatalf("transport not available, state: %s", client.State())
+	}
+	if _, err := client.Send(base.MsgTypeData, base.MsgFlagToServer, "client", stream, 0x00, []byte("after")); err != nil {
+		t.Fatalf("send error: %v", err)
+	}
+	server.waitFor(t, 5*time.Second, func() bool {
+		return server.received[stream].String() == "before after"
+	})
+	if _, ok := receiver.closedStreams()[stream]; ok {
+		t.Fatal("stream of the resumed session closed")
+	}
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if server.gaps != 0 || server.refused != 0 {
+		t.Fatalf("gaps: %d, refused: %d", server.gaps, server.refused)
+	}
+}
+
+func TestTransportRetransmitBufferCap(t *testing.T) {
+	server := newTestServer(t, LinkConditions{})
+	server.silentAck.Store(true)
+	client := server.dial(t, newTestClientReceiver())
+
+	const chunk = 32 * 1024
+	stream := uuid.New().String()
+	sent := make([]byte, 0, 2*sessionMaxRetransmitBytes)
+	for len(sent) < 2*sessionMaxRetransmitBytes {
+		data := make([]byte, chunk)
+		_, _ = rand.Read(data)
+		if _, err := client.Send(base.MsgTypeData, base.MsgFlagToServer, "client", stream, 0x00, data); err != nil {
+			t.Fatalf("send error: %v", err)
+		}
+		sent = append(sent, data...)
+	}
+
+	// without acks the writes stop once the buffer is full, one frame may go past the cap
+	received := func() int {
+		server.mutex.Lock()
+		defer server.mutex.Unlock()
+		if buffer := server.received[stream]; buffer != nil {
+			return buffer.Len()
+		}
+		return 0
+	}
+	last := -1
+	for n := received(); n != last; n = received() {
+		last = n
+		time.Sleep(200 * time.Millisecond)
+	}
+	if last > sessionMaxRetransmitBytes+chunk || last < sessionMaxRetransmitBytes-2*chunk {
+		t.Fatalf("received %d without acks, cap: %d", last, sessionMaxRetransmitBytes)
+	}
+
+	// the resume acks what the remote side has, that makes room for the rest
+	server.silentAck.Store(false)
+	_ = client.Reconnect()
+	server.waitFor(t, 10*time.Second, func() bool {
+		return server.received[stream].Len() >= len(sent)
+	})
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if !bytes.Equal(server.received[stream].Bytes(), sent) {
+		t.Fatalf("received %d bytes differ from the %d sent", server.received[stream].Len(), len(sent))
+	}
+}
+
+func TestTransportLinkLostListener(t *testing.T) {
+	server := newTestServer(t, LinkConditions{})
+	client := server.dial(t, newTestClientReceiver(), WithLinkLostWait(50*time.Millisecond))
+	lost := make(chan string, 1)
+	client.OnLinkLost(func(reason string) {
+		select {
+		case lost <- reason:
+		default:
+		}
+	})
+
+	_ = server.listener.Close()
+	_ = client.Reconnect()
+	select {
+	case reason := <-lost:
+		if !strings.HasPrefix(reason, "bridge link lost") {
+			t.Fatalf("reason: %s", reason)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("link lost listener not called")
+	}
+}
+
+func TestTransportReconnectCountsUntilConnected(t *testing.T) {
+	helloWait := transportHelloWait
+	transportHelloWait = 50 * time.Millisecond
+	defer func() {
+		transportHelloWait = helloWait
+	}()
+
+	// every link is dialed and then dropped in the handshake, that must use up the attempts
+	server := newTestServer(t, LinkConditions{})
+	server.silentHello.Store(true)
+	recorder := &stateRecorder{}
+	policy := BackoffPolicy{Initial: 10 * time.Millisecond, Max: 50 * time.Millisecond, Multiplier: 2, MaxAttempts: 3}
+	client := server.dial(t, newTestClientReceiver(), WithBackoffPolicy(policy), WithStateListener(recorder.listen))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for client.State() != StateClosed {
+		if time.Now().After(deadline) {
+			t.Fatalf("transport still %s", client.State())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := recorder.last(); err == nil || !strings.Contains(err.Error(), "reconnect gave up after 3 attempts") {
+		t.Fatalf("close error: %v", err)
+	}
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if server.links != 4 {
+		t.Fatalf("links: %d, want the first one and 3 attempts", server.links)
+	}
+}
+
+func TestTransportCloseCancelsDial(t *testing.T) {
+	server := newTestServer(t, LinkConditions{})
+	dialing := make(chan struct{}, 1)
+	dialed := make(chan error, 1)
+	var dials atomic.Int32
+	dialer := func(ctx context.Context, params map[string]string, onPong func(payload []byte)) (link, error) {
+		if dials.Add(1) == 1 {
+			return server.listener.dial(params, onPong)
+		}
+		dialing <- struct{}{}
+		<-ctx.Done()
+		dialed <- ctx.Err()
+		return nil, ctx.Err()
+	}
+	policy := BackoffPolicy{Initial: time.Millisecond, Max: time.Millisecond, Multiplier: 1}
+	client := newTransport("TEST", "test", dialer, nil, newTestClientReceiver(), []Option{WithBackoffPolicy(policy)})
+	if err := client.start(); err != nil {
+		t.Fatalf("start error: %v", err)
+	}
+
+	_ = client.Reconnect()
+	select {
+	case <-dialing:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reconnect dial")
+	}
+	_ = client.Close()
+	select {
+	case err := <-dialed:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("dial error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("dial not canceled by Close")
+	}
+}
+
+func TestTransportLinkLostWhileLinksKeepDropping(t *testing.T) {
+	helloWait := transportHelloWait
+	transportHelloWait = 20 * time.Millisecond
+	defer func() {
+		transportHelloWait = helloWait
+	}()
+
+	server := newTestServer(t, LinkConditions{})
+	receiver := newTestClientReceiver()
+	client := server.dial(t, receiver, WithLinkLostWait(300*time.Millisecond))
+	stream := uuid.New().String()
+	if _, err := client.Send(base.MsgTypeData, base.MsgFlagToServer, "client", stream, 0x00, []byte("data")); err != nil {
+		t.Fatalf("send error: %v", err)
+	}
+	server.waitFor(t, 5*time.Second, func() bool {
+		return server.received[stream] != nil
+	})
+
+	// every new link is dialed at once and dropped in the handshake, the outage goes on all the same
+	server.silentHello.Store(true)
+	_ = client.Reconnect()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if reason, ok := receiver.closedStreams()[stream]; ok {
+			if !strings.HasPrefix(reason, "bridge link lost") {
+				t.Fatalf("reason: %s", reason)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("stream not closed while the links keep dropping")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if server.links < 3 {
+		t.Fatalf("links: %d, want the links to keep dropping", server.links)
+	}
+}
+
+// frameRecorder is a receiver keeping the types of the frames handed to it.
+type frameRecorder struct {
+	mutex sync.Mutex
+	types []byte
+}
+
+func (r *frameRecorder) OnReceived(data []byte) {
+	_, header, err := coder.ParseFrame(data)
+	if err != nil {
+		return
+	}
+	_type, _ := coder.MessageTypeByte(header.Type)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.types = append(r.types, _type)
+}
+
+func (r *frameRecorder) received() []byte {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return bytes.Clone(r.types)
+}
+
+// nestBatch wraps frame in depth Batch frames.
+func nestBatch(t *testing.T, frame []byte, depth int) []byte {
+	for range depth {
+		data, err := proto.Marshal(&entity.Batch{Frames: [][]byte{frame}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame, err = coder.Encode(base.MsgTypeBatch, base.MsgFlagToServer, "", "", 0x00, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return frame
+}
+
+func TestTransportRejectsNestedBatch(t *testing.T) {
+	recorder := &frameRecorder{}
+	client := newTransport("TEST", "test", nil, nil, recorder, nil)
+	streams, fragments := newStreamTable(), &reassembler{}
+	data, err := coder.Encode(base.MsgTypeData, base.MsgFlagToClient, "c1", uuid.New().String(), 0x00, []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.onFrame(nestBatch(t, data, 1), streams, fragments, false)
+	if got := recorder.received(); !bytes.Equal(got, []byte{base.MsgTypeData}) {
+		t.Fatalf("batched frame, received: %v", got)
+	}
+	for _, depth := range []int{2, 1000} {
+		client.onFrame(nestBatch(t, data, depth), streams, fragments, false)
+	}
+	hello, _ := coder.Encode(base.MsgTypeHelloAck, base.MsgFlagToClient, "", "", 0x00, []byte{0x08, 0x03})
+	client.onFrame(nestBatch(t, hello, 1), streams, fragments, false)
+	if got := recorder.received(); len(got) != 1 {
+		t.Fatalf("nested frames delivered: %v", got)
+	}
+	select {
+	case <-client.helloChan:
+		t.Fatal("HelloAck taken from a Batch")
+	default:
+	}
+}
+
+// coverTap counts the cover frames written on a link, and the largest one.
+type coverTap struct {
+	link
+	covers   *atomic.Int32
+	maxBytes *atomic.Int32
+}
+
+func (l *coverTap) WriteFrame(data []byte, deadline time.Time) error {
+	if message, header, err := coder.ParseFrame(data); err == nil && header.Type == entity.MessageType_MESSAGE_TYPE_COVER {
+		l.covers.Add(1)
+		if size := int32(len(message.Data)); size > l.maxBytes.Load() {
+			l.maxBytes.Store(size)
+		}
+	}
+	return l.link.WriteFrame(data, deadline)
+}
+
+func TestTransportCoverFrames(t *testing.T) {
+	for _, coverInterval := range []time.Duration{0, 20 * time.Millisecond} {
+		server := newTestServer(t, LinkConditions{})
+		covers, maxBytes := &atomic.Int32{}, &atomic.Int32{}
+		dialer := func(ctx context.Context, params map[string]string, onPong func(payload []byte)) (link, error) {
+			l, err := server.listener.dial(params, onPong)
+			if err != nil {
+				return nil, err
+			}
+			return &coverTap{link: l, covers: covers, maxBytes: maxBytes}, nil
+		}
+		client := newTransport("TEST", "test", dialer, nil, newTestClientReceiver(), []Option{WithObfuscation(coverInterval)})
+		if err := client.start(); err != nil {
+			t.Fatalf("start error: %v", err)
+		}
+		if !client.WaitAvailable(5 * time.Second) {
+			t.Fatal("transport not available")
+		}
+
+		connID := uuid.New().String()
+		time.Sleep(300 * time.Millisecond)
+		if _, err := client.Send(base.MsgTypeData, base.MsgFlagToServer, "client", connID, 0x00, []byte("after covers")); err != nil {
+			t.Fatalf("send error: %v", err)
+		}
+		// the remote side drops the covers, the stream sees its own frames only
+		server.waitFor(t, 5*time.Second, func() bool {
+			return server.received[connID] != nil && server.received[connID].String() == "after covers"
+		})
+		_ = client.Close()
+		if coverInterval == 0 && covers.Load() != 0 {
+			t.Fatalf("covers without an interval: %d", covers.Load())
+		}
+		if coverInterval > 0 && covers.Load() < 3 {
+			t.Fatalf("covers on an idle link: %d", covers.Load())
+		}
+		if maxBytes.Load() > coverMaxBytes {
+			t.Fatalf("cover of %d bytes", maxBytes.Load())
+		}
+		server.mutex.Lock()
+		gaps := server.gaps
+		server.mutex.Unlock()
+		if gaps != 0 {
+			t.Fatalf("gaps: %d", gaps)
+		}
+	}
+}
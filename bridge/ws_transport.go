@@ -1,231 +1,144 @@
 package bridge
 
 import (
+	"context"
 	"fmt"
 	"github.com/gorilla/websocket"
 	"github.com/yangxm/gecko/base"
-	"github.com/yangxm/gecko/coder"
 	"github.com/yangxm/gecko/logger"
-	"github.com/yangxm/gecko/util"
 	"net/http"
 	"sync"
-	"time"
-)
-
-const (
-	wsPingPeriod   = 10 * time.Second
-	wsPongWait     = 15 * time.Second
-	wsWriteWait    = 5 * time.Second
-	wsSendChanSize = 32 * 1024
 )
 
 type WsTransport struct {
-	url             string
-	connParamGetter func() map[string]string
-	receiver        base.BridgeReceiver
-	conn            *websocket.Conn
-	sendChan        chan []byte
-	mutex           sync.Mutex
-	closed          bool
-	done            chan struct{}
+	*transport
+	fallback *wsFallback
 }
 
-func NewWsTransport(url string, connParamGetter func() map[string]string, receiver base.BridgeReceiver) (*WsTransport, error) {
-	t := &WsTransport{
-		url:             url,
-		connParamGetter: connParamGetter,
-		receiver:        receiver,
-		sendChan:        make(chan []byte, wsSendChanSize),
-		done:            make(chan struct{}),
-	}
-	logger.Debug("[WSTP] WsTransport created: %s", t.url)
-	if err := t.connect(); err != nil {
+func NewWsTransport(url string, connParamGetter func() map[string]string, receiver base.BridgeReceiver, opts ...Option) (*WsTransport, error) {
+	return newWsTransport(url, nil, connParamGetter, receiver, opts)
+}
+
+func newWsTransport(url string, fallback *wsFallback, connParamGetter func() map[string]string, receiver base.BridgeReceiver, opts []Option) (*WsTransport, error) {
+	t := &WsTransport{fallback: fallback}
+	t.transport = newTransport("WSTP", url, t.dial, connParamGetter, receiver, opts)
+	if err := t.start(); err != nil {
 		return nil, err
 	}
 	return t, nil
 }
 
-func (t *WsTransport) connect() error {
-	logger.Info("[WSTP] dialing to %s", t.url)
+func (t *WsTransport) dial(ctx context.Context, params map[string]string, onPong func(payload []byte)) (link, error) {
+	if t.fallback == nil {
+		return t.dialWs(ctx, params, onPong)
+	}
+	if t.fallback.isPolling() {
+		return dialPollLink(ctx, t.fallback.client, t.fallback.url, params, onPong)
+	}
+
+	l, err := t.dialWs(ctx, params, onPong)
+	if err == nil {
+		t.fallback.onDialed()
+		return l, nil
+	}
+	if !t.fallback.onDialFailed(err) {
+		return nil, err
+	}
+	logger.Warn("[%s] websocket dial failed %d times in a row, last error: %v, fall back to long polling: %s", t.tag, pollFallbackDialAttempts, err, t.fallback.url)
+	return dialPollLink(ctx, t.fallback.client, t.fallback.url, params, onPong)
+}
 
+func (t *WsTransport) dialWs(ctx context.Context, params map[string]string, onPong func(payload []byte)) (link, error) {
 	var httpHeader http.Header
-	if t.connParamGetter != nil {
+	if params != nil {
 		httpHeader = make(http.Header)
-		params := t.connParamGetter()
 		for k, v := range params {
 			httpHeader.Add(k, v)
 		}
 	}
-	logger.Debug("[WSTP] dialing to %s with header: %v", t.url, httpHeader)
-	if conn, _, err := websocket.DefaultDialer.Dial(t.url, httpHeader); err != nil {
-		logger.Error("[WSTP] dialing to %s error: %v", t.url, err)
-		return fmt.Errorf("dialing error: %v", err)
-	} else {
-		t.conn = conn
-	}
+	logger.Debug("[WSTP] dialing to %s with header: %v", t.target, httpHeader)
 
-	if err := t.conn.SetReadDeadline(time.Now().Add(wsPongWait)); err != nil {
-		logger.Error("[WSTP] connect, set read deadline error: %v", err)
-		return fmt.Errorf("set read deadline error: %v", err)
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = t.options.tlsConfig
+	proxyDial, err := t.options.proxyDial()
+	if err != nil {
+		return nil, err
 	}
-
-	t.conn.SetPongHandler(func(appData string) error {
-		if err := t.conn.SetReadDeadline(time.Now().Add(wsPongWait)); err != nil {
-			logger.Error("[WSTP] pong handler, set read deadline error: %v", err)
-			return fmt.Errorf("set read deadline error: %v", err)
-		}
-		logger.Debug("[WSTP] pong received")
-		return nil
-	})
-
-	go t.readLoop()
-	go t.writeLoop()
-	go t.heartbeatLoop()
-
-	logger.Debug("[WSTP] connected to %s", t.url)
-	return nil
-}
-
-func (t *WsTransport) readLoop() {
-	defer t.reconnect()
-
-	for {
-		_, bytes, err := t.conn.ReadMessage()
-		if err != nil {
-			logger.Error("[WSTP] read error: %v", err)
-			return
-		}
-		logger.Debug("[WSTP] read: %d", len(bytes))
-		if t.receiver != nil {
-			t.receiver.OnReceived(bytes)
-		}
+	if proxyDial != nil {
+		dialer.Proxy = nil
+		dialer.NetDialContext = proxyDial
 	}
-}
-
-func (t *WsTransport) writeLoop() {
-	for {
-		select {
-		case msg, ok := <-t.sendChan:
-			if !ok {
-				return
-			}
-			if err := t.conn.SetWriteDeadline(time.Now().Add(wsWriteWait)); err != nil {
-				logger.Error("[WSTP] write, set write deadline error: %v", err)
-				return
-			}
-
-			if err := t.conn.WriteMessage(websocket.BinaryMessage, msg); err != nil {
-				logger.Error("[WSTP] write error: %s", err.Error())
-				return
-			}
-		case <-t.done:
-			return
+	conn, resp, err := dialer.DialContext(ctx, t.target, httpHeader)
+	if err != nil {
+		if resp != nil {
+			_ = resp.Body.Close()
+			return nil, &wsRejectedError{status: resp.Status, code: resp.StatusCode}
 		}
+		return nil, err
 	}
+	return newWsLink(conn, onPong), nil
 }
 
-func (t *WsTransport) heartbeatLoop() {
-	ticker := time.NewTicker(wsPingPeriod)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-ticker.C:
-			t.mutex.Lock()
-			if t.closed {
-				t.mutex.Unlock()
-				return
-			}
-			if err := t.conn.SetWriteDeadline(time.Now().Add(wsWriteWait)); err != nil {
-				t.mutex.Unlock()
-				logger.Error("[WSTP] send ping, set write deadline error: %v", err)
-				return
-			}
-
-			if err := t.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
-				t.mutex.Unlock()
-				logger.Error("[WSTP] send ping error: %v", err)
-				return
-			}
-			logger.Debug("[WSTP] send ping")
-			t.mutex.Unlock()
-		case <-t.done:
-			return
-		}
+func (t *WsTransport) Close() error {
+	err := t.transport.Close()
+	if t.fallback != nil {
+		t.fallback.client.CloseIdleConnections()
 	}
+	return err
 }
 
-func (t *WsTransport) Send(_type, flag byte, clientID, connID string, serverType byte, data []byte) (int, error) {
-	shortConn := util.ShortConnID(connID)
-	dataLen := len(data)
-	logger.Debug("[WSTP] [%s] send %d start", shortConn, dataLen)
-
-	if t.isClosed() {
-		logger.Error("[WSTP] [%s] send %d error: connection is closed", shortConn, dataLen)
-		return 0, fmt.Errorf("connection is closed")
-	}
+// wsRejectedError is a WebSocket handshake the server answered without upgrading, the path works and
+// long polling would be refused the same way.
+type wsRejectedError struct {
+	status string
+	code   int
+}
 
-	if encodedData, err := coder.Encode(_type, flag, clientID, connID, serverType, data); err != nil {
-		logger.Error("[WSTP] [%s] send %d error: encode error: %v", shortConn, dataLen, err)
-		return 0, fmt.Errorf("[WSTP] send, encode error: %v", err)
-	} else {
-		select {
-		case t.sendChan <- encodedData:
-			encodedDataLen := len(encodedData)
-			logger.Debug("[WSTP] [%s] send %d -> %d", shortConn, dataLen, encodedDataLen)
-			return encodedDataLen, nil
-		default:
-			logger.Error("[WSTP] [%s] send %d -> %d error: send channel full, drop message", shortConn, dataLen, len(encodedData))
-			return 0, fmt.Errorf("send channel full")
-		}
-	}
+func (e *wsRejectedError) Error() string {
+	return fmt.Sprintf("websocket handshake rejected: %s", e.status)
 }
 
-func (t *WsTransport) reconnect() {
-	if t.isClosed() {
-		return
-	}
+// wsFallback switches the links of a WsTransport to long polling once the WebSocket dial failed
+// pollFallbackDialAttempts times in a row at the transport level, on the first dial as well as on
+// the reconnects. Once on long polling the transport stays there.
+type wsFallback struct {
+	url      string
+	client   *http.Client
+	mutex    sync.Mutex
+	failures int
+	polling  bool
+}
 
-	logger.Info("[WSTP] reconnecting...")
-	if err := t.conn.Close(); err != nil {
-		logger.Warn("[WSTP] close old connection error: %v", err)
+func newWsFallback(rawURL string, o *options) (*wsFallback, error) {
+	client, err := newPollClient(o)
+	if err != nil {
+		return nil, err
 	}
+	return &wsFallback{url: rawURL, client: client}, nil
+}
 
-	i := 0
-	for {
-		time.Sleep(time.Duration(1<<i) * time.Second)
-		if err := t.connect(); err == nil {
-			logger.Info("[WSTP] reconnected successfully")
-			return
-		} else {
-			i++
-			logger.Error("[WSTP] reconnect error: %v, retries: %d", err, i)
-		}
-	}
+func (f *wsFallback) isPolling() bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.polling
 }
 
-func (t *WsTransport) Close() error {
-	t.mutex.Lock()
-	defer t.mutex.Unlock()
-	if t.closed {
-		logger.Info("[WSTP] already closed")
-		return nil
-	}
-	t.closed = true
-	close(t.done)
-	close(t.sendChan)
-	if t.conn != nil {
-		if err := t.conn.Close(); err != nil {
-			logger.Error("[WSTP] close connection error: %v", err)
-			return err
-		}
-	}
-	logger.Info("[WSTP] closed")
-	return nil
+func (f *wsFallback) onDialed() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.failures = 0
 }
 
-func (t *WsTransport) isClosed() bool {
-	t.mutex.Lock()
-	defer t.mutex.Unlock()
-	return t.closed
+// onDialFailed counts a failed WebSocket dial and tells whether it is time to fall back, a rejected
+// handshake resets the count.
+func (f *wsFallback) onDialFailed(err error) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if _, rejected := err.(*wsRejectedError); rejected {
+		f.failures = 0
+		return false
+	}
+	f.failures++
+	f.polling = f.failures >= pollFallbackDialAttempts
+	return f.polling
 }
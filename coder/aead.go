@@ -0,0 +1,132 @@
+package coder
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/yangxm/gecko/entity"
+	"golang.org/x/crypto/chacha20poly1305"
+	"strconv"
+	"sync"
+)
+
+const (
+	CodecChaCha20Poly1305 = "chacha20-poly1305"
+	CodecAES256GCM        = "aes-256-gcm"
+
+	TVTypeChaCha20Poly1305 int32 = 0x21
+	TVTypeAES256GCM        int32 = 0x22
+
+	AEADKeySize = 32
+)
+
+func init() {
+	for _, codec := range []Codec{
+		&aeadCodec{name: CodecChaCha20Poly1305, _type: TVTypeChaCha20Poly1305, newAEAD: chacha20poly1305.New},
+		&aeadCodec{name: CodecAES256GCM, _type: TVTypeAES256GCM, newAEAD: newAESGCM},
+	} {
+		if err := Register(codec); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// aeadCodec seals the payload with the header and the stages before it as additional data, so neither
+// can be changed on the way. The nonce is a counter of the sealing side, it goes in the MessageTV.
+// The keys are fresh for every link, so a counter never repeats under the same key.
+type aeadCodec struct {
+	name    string
+	_type   int32
+	newAEAD func(key []byte) (cipher.AEAD, error)
+	seal    cipher.AEAD
+	open    cipher.AEAD
+	mutex   sync.Mutex
+	counter uint64
+}
+
+func (c *aeadCodec) Name() string {
+	return c.name
+}
+
+func (c *aeadCodec) Type() int32 {
+	return c._type
+}
+
+func (c *aeadCodec) WithKeys(sealKey, openKey []byte) (Codec, error) {
+	if len(sealKey) != AEADKeySize || len(openKey) != AEADKeySize {
+		return nil, fmt.Errorf("illegal %s key size: %d, %d", c.name, len(sealKey), len(openKey))
+	}
+	seal, err := c.newAEAD(sealKey)
+	if err != nil {
+		return nil, fmt.Errorf("create %s error: %v", c.name, err)
+	}
+	open, err := c.newAEAD(openKey)
+	if err != nil {
+		return nil, fmt.Errorf("create %s error: %v", c.name, err)
+	}
+	return &aeadCodec{name: c.name, _type: c._type, newAEAD: c.newAEAD, seal: seal, open: open}, nil
+}
+
+func (c *aeadCodec) Encode(header *entity.MessageHeader, tvs []*entity.MessageTV, data []byte) ([]byte, string, bool, error) {
+	if c.seal == nil {
+		return nil, "", false, errors.New("no key")
+	}
+	c.mutex.Lock()
+	c.counter++
+	counter := c.counter
+	c.mutex.Unlock()
+
+	nonce := aeadNonce(c.seal.NonceSize(), counter)
+	return c.seal.Seal(nil, nonce, data, additionalData(header, tvs)), strconv.FormatUint(counter, 10), true, nil
+}
+
+func (c *aeadCodec) Decode(header *entity.MessageHeader, tvs []*entity.MessageTV, data []byte, value string) ([]byte, error) {
+	if c.open == nil {
+		return nil, errors.New("no key")
+	}
+	counter, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("illegal nonce: %s", value)
+	}
+	nonce := aeadNonce(c.open.NonceSize(), counter)
+	return c.open.Open(nil, nonce, data, additionalData(header, tvs))
+}
+
+func aeadNonce(size int, counter uint64) []byte {
+	nonce := make([]byte, size)
+	binary.BigEndian.PutUint64(nonce[size-8:], counter)
+	return nonce
+}
+
+// additionalData covers every header field and the stages applied before, each one length prefixed.
+func additionalData(header *entity.MessageHeader, tvs []*entity.MessageTV) []byte {
+	var ad []byte
+	field := func(value []byte) {
+		ad = binary.BigEndian.AppendUint32(ad, uint32(len(value)))
+		ad = append(ad, value...)
+	}
+	if header != nil {
+		field(header.Type)
+		field(header.Flag)
+		field([]byte(header.ClientID))
+		field([]byte(header.ConnID))
+		field(header.ServerType)
+		ad = binary.BigEndian.AppendUint64(ad, header.Seq)
+		ad = binary.BigEndian.AppendUint32(ad, header.StreamID)
+	}
+	for _, tv := range tvs {
+		ad = binary.BigEndian.AppendUint32(ad, uint32(tv.Type))
+		field([]byte(tv.Value))
+	}
+	return ad
+}
@@ -0,0 +1,116 @@
+package coder
+
+import (
+	"bytes"
+	"github.com/yangxm/gecko/base"
+	"github.com/yangxm/gecko/entity"
+	"testing"
+)
+
+// newAEADPair returns the two ends of a link for the registered codec name, what one seals the other opens.
+func newAEADPair(t *testing.T, name string) (Codec, Codec) {
+	template, ok := DefaultRegistry.Lookup(name)
+	if !ok {
+		t.Fatalf("%s not registered", name)
+	}
+	keyed := template.(KeyedCodec)
+	a, b := bytes.Repeat([]byte{0x01}, AEADKeySize), bytes.Repeat([]byte{0x02}, AEADKeySize)
+	client, err := keyed.WithKeys(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := keyed.WithKeys(b, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+func newSealed(t *testing.T, codec Codec, data string) *entity.Message {
+	message, err := NewMessage(base.MsgTypeData, base.MsgFlagToServer, "c1", "conn", 0x00, []byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	message.Header.Seq, message.Header.StreamID = 7, 3
+	if err := (Chain{codec}).Encode(message); err != nil {
+		t.Fatal(err)
+	}
+	return message
+}
+
+func TestAEADRoundTrip(t *testing.T) {
+	for _, name := range []string{CodecChaCha20Poly1305, CodecAES256GCM} {
+		client, server := newAEADPair(t, name)
+		message := newSealed(t, client, "payload")
+		if bytes.Contains(message.Data, []byte("payload")) || len(message.Tvs) != 1 || message.Tvs[0].Type != client.Type() {
+			t.Fatalf("%s, sealed: %x, tvs: %v", name, message.Data, message.Tvs)
+		}
+		data, err := (Chain{server}).Decode(message)
+		if err != nil || string(data) != "payload" {
+			t.Fatalf("%s, opened %q: %v", name, data, err)
+		}
+		// a link direction has its own key, the sealing side can't open its own frames
+		if _, err := (Chain{client}).Decode(message); err == nil {
+			t.Fatalf("%s, opened with the seal key", name)
+		}
+	}
+}
+
+func TestAEADTampered(t *testing.T) {
+	client, server := newAEADPair(t, CodecChaCha20Poly1305)
+	for name, tamper := range map[string]func(message *entity.Message){
+		"type":     func(message *entity.Message) { message.Header.Type = []byte{base.MsgTypeClose} },
+		"connID":   func(message *entity.Message) { message.Header.ConnID = "other" },
+		"clientID": func(message *entity.Message) { message.Header.ClientID = "c2" },
+		"seq":      func(message *entity.Message) { message.Header.Seq++ },
+		"streamID": func(message *entity.Message) { message.Header.StreamID++ },
+		"data":     func(message *entity.Message) { message.Data[0] ^= 0x01 },
+		"nonce":    func(message *entity.Message) { message.Tvs[0].Value = "999999" },
+		"earlier tv": func(message *entity.Message) {
+			message.Tvs = append([]*entity.MessageTV{{Type: TVTypeDeflate, Value: "1"}}, message.Tvs...)
+		},
+	} {
+		message := newSealed(t, client, "payload")
+		tamper(message)
+		if _, err := server.Decode(message.Header, message.Tvs[:len(message.Tvs)-1], message.Data, message.Tvs[len(message.Tvs)-1].Value); err == nil {
+			t.Fatalf("%s tampered, opened", name)
+		}
+	}
+}
+
+func TestAEADWrongKeys(t *testing.T) {
+	client, _ := newAEADPair(t, CodecAES256GCM)
+	other := bytes.Repeat([]byte{0x03}, AEADKeySize)
+	template, _ := DefaultRegistry.Lookup(CodecAES256GCM)
+	stranger, err := template.(KeyedCodec).WithKeys(other, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (Chain{stranger}).Decode(newSealed(t, client, "payload")); err == nil {
+		t.Fatal("opened with another key")
+	}
+	if _, err := template.(KeyedCodec).WithKeys(other[:16], other); err == nil {
+		t.Fatal("short key accepted")
+	}
+	if _, _, _, err := template.Encode(nil, nil, []byte("payload")); err == nil {
+		t.Fatal("sealed by the template without keys")
+	}
+}
+
+func TestAEADNonceUnique(t *testing.T) {
+	client, _ := newAEADPair(t, CodecChaCha20Poly1305)
+	nonces := make(map[string]bool)
+	for range 1000 {
+		message := newSealed(t, client, "payload")
+		nonce := message.Tvs[0].Value
+		if nonces[nonce] {
+			t.Fatalf("nonce %s used twice", nonce)
+		}
+		nonces[nonce] = true
+	}
+	// every link gets a codec of its own, with its own counter
+	_, server := newAEADPair(t, CodecChaCha20Poly1305)
+	if message := newSealed(t, server, "payload"); message.Tvs[0].Value != "1" {
+		t.Fatalf("fresh codec nonce: %s", message.Tvs[0].Value)
+	}
+}
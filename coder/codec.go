@@ -0,0 +1,159 @@
+package coder
+
+import (
+	"fmt"
+	"github.com/yangxm/gecko/entity"
+	"strings"
+	"sync"
+)
+
+// Codec is one stage of the payload encoding, like compression, encryption or padding. Every stage applied to
+// a payload leaves a MessageTV of its type behind, with the value it needs to undo itself. tvs are the stages
+// applied before this one.
+type Codec interface {
+	Name() string
+	Type() int32
+	// Encode returns ok false to leave the payload as is, the stage then leaves no MessageTV.
+	Encode(header *entity.MessageHeader, tvs []*entity.MessageTV, data []byte) (encoded []byte, value string, ok bool, err error)
+	Decode(header *entity.MessageHeader, tvs []*entity.MessageTV, data []byte, value string) ([]byte, error)
+}
+
+// KeyedCodec is a codec that needs the keys agreed on in the bridge handshake. The registered one is only
+// a template, every link gets its own instance from WithKeys.
+type KeyedCodec interface {
+	Codec
+	WithKeys(sealKey, openKey []byte) (Codec, error)
+}
+
+type Chain []Codec
+
+func (c Chain) String() string {
+	names := make([]string, 0, len(c))
+	for _, codec := range c {
+		names = append(names, codec.Name())
+	}
+	return "[" + strings.Join(names, ",") + "]"
+}
+
+// Registry maps the MessageTV types back to the codecs able to decode them.
+type Registry struct {
+	mutex  sync.RWMutex
+	types  map[int32]Codec
+	names  map[string]Codec
+	parent *Registry
+}
+
+var DefaultRegistry = NewRegistry(nil)
+
+// NewRegistry creates a registry, the codecs it doesn't know are looked up in parent.
+func NewRegistry(parent *Registry) *Registry {
+	return &Registry{
+		types:  make(map[int32]Codec),
+		names:  make(map[string]Codec),
+		parent: parent,
+	}
+}
+
+// Register adds a codec to DefaultRegistry.
+func Register(codec Codec) error {
+	return DefaultRegistry.Register(codec)
+}
+
+func (r *Registry) Register(codec Codec) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if existing, ok := r.types[codec.Type()]; ok {
+		return fmt.Errorf("codec type %d already registered by %s", codec.Type(), existing.Name())
+	}
+	if _, ok := r.names[codec.Name()]; ok {
+		return fmt.Errorf("codec %s already registered", codec.Name())
+	}
+	r.types[codec.Type()] = codec
+	r.names[codec.Name()] = codec
+	return nil
+}
+
+func (r *Registry) Lookup(name string) (Codec, bool) {
+	r.mutex.RLock()
+	codec, ok := r.names[name]
+	r.mutex.RUnlock()
+	if !ok && r.parent != nil {
+		return r.parent.Lookup(name)
+	}
+	return codec, ok
+}
+
+func (r *Registry) lookupType(_type int32) (Codec, bool) {
+	r.mutex.RLock()
+	codec, ok := r.types[_type]
+	r.mutex.RUnlock()
+	if !ok && r.parent != nil {
+		return r.parent.lookupType(_type)
+	}
+	return codec, ok
+}
+
+// Encode runs the payload of message through chain in order and records every applied stage in its tvs.
+func (r *Registry) Encode(message *entity.Message, chain Chain) error {
+	return chain.Encode(message)
+}
+
+// Decode undoes the stages recorded in the tvs of message, last applied first.
+func (r *Registry) Decode(message *entity.Message) ([]byte, error) {
+	data := message.Data
+	for i := len(message.Tvs) - 1; i >= 0; i-- {
+		tv := message.Tvs[i]
+		codec, ok := r.lookupType(tv.Type)
+		if !ok {
+			return nil, fmt.Errorf("unknown codec type: %d", tv.Type)
+		}
+		decoded, err := codec.Decode(message.Header, message.Tvs[:i], data, tv.Value)
+		if err != nil {
+			return nil, fmt.Errorf("codec %s decode error: %v", codec.Name(), err)
+		}
+		data = decoded
+	}
+	return data, nil
+}
+
+// Encode runs the payload of message through the codecs in order and records every applied stage in its tvs.
+func (c Chain) Encode(message *entity.Message) error {
+	for _, codec := range c {
+		encoded, value, ok, err := codec.Encode(message.Header, message.Tvs, message.Data)
+		if err != nil {
+			return fmt.Errorf("codec %s encode error: %v", codec.Name(), err)
+		}
+		if !ok {
+			continue
+		}
+		message.Data = encoded
+		message.Tvs = append(message.Tvs, &entity.MessageTV{Type: codec.Type(), Value: value})
+	}
+	return nil
+}
+
+// Decode undoes the stages recorded in the tvs of message with the codecs of the chain only. The tvs must
+// follow the order of the chain, a stage may be missing as it is free to leave the payload as is.
+func (c Chain) Decode(message *entity.Message) ([]byte, error) {
+	codecs := make([]Codec, len(message.Tvs))
+	next := 0
+	for i, tv := range message.Tvs {
+		for next < len(c) && c[next].Type() != tv.Type {
+			next++
+		}
+		if next == len(c) {
+			return nil, fmt.Errorf("codec type %d out of the chain %v", tv.Type, c)
+		}
+		codecs[i] = c[next]
+		next++
+	}
+	data := message.Data
+	for i := len(message.Tvs) - 1; i >= 0; i-- {
+		decoded, err := codecs[i].Decode(message.Header, message.Tvs[:i], data, message.Tvs[i].Value)
+		if err != nil {
+			return nil, fmt.Errorf("codec %s decode error: %v", codecs[i].Name(), err)
+		}
+		data = decoded
+	}
+	return data, nil
+}
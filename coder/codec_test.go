@@ -0,0 +1,158 @@
+package coder
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/yangxm/gecko/base"
+	"github.com/yangxm/gecko/entity"
+	"testing"
+)
+
+// suffixCodec appends its suffix, and checks on decode that it sees the stages applied before it.
+type suffixCodec struct {
+	name   string
+	_type  int32
+	suffix string
+	skip   bool
+}
+
+func (c *suffixCodec) Name() string {
+	return c.name
+}
+
+func (c *suffixCodec) Type() int32 {
+	return c._type
+}
+
+func (c *suffixCodec) Encode(_ *entity.MessageHeader, tvs []*entity.MessageTV, data []byte) ([]byte, string, bool, error) {
+	if c.skip {
+		return nil, "", false, nil
+	}
+	return append(bytes.Clone(data), c.suffix...), fmt.Sprintf("%d", len(tvs)), true, nil
+}
+
+func (c *suffixCodec) Decode(_ *entity.MessageHeader, tvs []*entity.MessageTV, data []byte, value string) ([]byte, error) {
+	if value != fmt.Sprintf("%d", len(tvs)) {
+		return nil, fmt.Errorf("%s decoded after %d stages, encoded after %s", c.name, len(tvs), value)
+	}
+	if !bytes.HasSuffix(data, []byte(c.suffix)) {
+		return nil, fmt.Errorf("%s decoded out of order: %q", c.name, data)
+	}
+	return data[:len(data)-len(c.suffix)], nil
+}
+
+func newTestMessage(t *testing.T, data string) *entity.Message {
+	message, err := NewMessage(base.MsgTypeData, base.MsgFlagToServer, "c1", "conn", 0x00, []byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return message
+}
+
+func TestRegistryEncodeDecodeOrder(t *testing.T) {
+	a := &suffixCodec{name: "a", _type: 0x71, suffix: "-a"}
+	b := &suffixCodec{name: "b", _type: 0x72, suffix: "-b"}
+	skipped := &suffixCodec{name: "skipped", _type: 0x73, skip: true}
+	registry := NewRegistry(nil)
+	for _, codec := range []Codec{a, b, skipped} {
+		if err := registry.Register(codec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	message := newTestMessage(t, "data")
+	if err := registry.Encode(message, Chain{a, skipped, b}); err != nil {
+		t.Fatal(err)
+	}
+	if string(message.Data) != "data-a-b" || len(message.Tvs) != 2 || message.Tvs[0].Type != a._type || message.Tvs[1].Type != b._type {
+		t.Fatalf("encoded %q, tvs: %v", message.Data, message.Tvs)
+	}
+	if data, err := registry.Decode(message); err != nil || string(data) != "data" {
+		t.Fatalf("decoded %q: %v", data, err)
+	}
+	if data, err := (Chain{a, skipped, b}).Decode(message); err != nil || string(data) != "data" {
+		t.Fatalf("chain decoded %q: %v", data, err)
+	}
+
+	// the tvs swapped, each stage sees the wrong data and the wrong stages before it
+	message.Tvs[0], message.Tvs[1] = message.Tvs[1], message.Tvs[0]
+	if _, err := registry.Decode(message); err == nil {
+		t.Fatal("decoded with the tvs out of order")
+	}
+	if _, err := (Chain{a, b}).Decode(message); err == nil {
+		t.Fatal("chain decoded with the tvs out of order")
+	}
+}
+
+func TestRegistryUnknownType(t *testing.T) {
+	a := &suffixCodec{name: "a", _type: 0x71, suffix: "-a"}
+	registry := NewRegistry(nil)
+	if err := registry.Register(a); err != nil {
+		t.Fatal(err)
+	}
+	message := newTestMessage(t, "data")
+	if err := registry.Encode(message, Chain{a}); err != nil {
+		t.Fatal(err)
+	}
+	message.Tvs = append(message.Tvs, &entity.MessageTV{Type: 0x7F, Value: "0"})
+	if _, err := registry.Decode(message); err == nil {
+		t.Fatal("decoded an unknown tv type")
+	}
+	if _, err := (Chain{a}).Decode(message); err == nil {
+		t.Fatal("chain decoded a tv out of the chain")
+	}
+	if _, err := (Chain{}).Decode(newTestMessage(t, "data")); err != nil {
+		t.Fatalf("empty chain, message without tvs: %v", err)
+	}
+}
+
+func TestRegistryParentFallback(t *testing.T) {
+	parentCodec := &suffixCodec{name: "parent", _type: 0x71, suffix: "-p"}
+	childCodec := &suffixCodec{name: "child", _type: 0x72, suffix: "-c"}
+	parent := NewRegistry(nil)
+	if err := parent.Register(parentCodec); err != nil {
+		t.Fatal(err)
+	}
+	child := NewRegistry(parent)
+	if err := child.Register(childCodec); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"parent", "child"} {
+		if _, ok := child.Lookup(name); !ok {
+			t.Fatalf("child lookup %s failed", name)
+		}
+	}
+	if _, ok := parent.Lookup("child"); ok {
+		t.Fatal("parent sees the codecs of its child")
+	}
+	message := newTestMessage(t, "data")
+	if err := child.Encode(message, Chain{parentCodec, childCodec}); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := child.Decode(message); err != nil || string(data) != "data" {
+		t.Fatalf("child decoded %q: %v", data, err)
+	}
+	if _, err := parent.Decode(message); err == nil {
+		t.Fatal("parent decoded a tv of its child")
+	}
+
+	// the child may reuse a type of the parent, its own codec wins
+	shadow := &suffixCodec{name: "shadow", _type: 0x71, suffix: "-s"}
+	if err := child.Register(shadow); err != nil {
+		t.Fatal(err)
+	}
+	if err := child.Register(&suffixCodec{name: "shadow", _type: 0x73}); err == nil {
+		t.Fatal("name registered twice")
+	}
+	if err := child.Register(&suffixCodec{name: "other", _type: 0x72}); err == nil {
+		t.Fatal("type registered twice")
+	}
+	message = newTestMessage(t, "data")
+	if err := child.Encode(message, Chain{shadow}); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := child.Decode(message); err != nil || string(data) != "data" {
+		t.Fatalf("shadowed type decoded %q: %v", data, err)
+	}
+}
@@ -7,10 +7,15 @@ import (
 )
 
 func Encode(_type, flag byte, clientID, connId string, serverType byte, data []byte) ([]byte, error) {
-	if data == nil {
-		return nil, errors.New("data is nil")
+	message, err := NewMessage(_type, flag, clientID, connId, serverType, data)
+	if err != nil {
+		return nil, err
 	}
+	return proto.Marshal(message)
+}
 
+// NewMessage takes a nil data as an empty payload, the way proto.Marshal returns a message with only defaults.
+func NewMessage(_type, flag byte, clientID, connId string, serverType byte, data []byte) (*entity.Message, error) {
 	header := &entity.MessageHeader{
 		Type:       []byte{_type},
 		Flag:       []byte{flag},
@@ -18,18 +23,16 @@ func Encode(_type, flag byte, clientID, connId string, serverType byte, data []b
 		ConnID:     connId,
 		ServerType: []byte{serverType},
 	}
+	// the v2 enums go along with the bytes, see Header
+	header.MsgType, _ = MessageTypeOf(_type)
+	header.Direction, _ = DirectionOf(flag)
+	header.Server, _ = ServerTypeOf(serverType)
 
-	// TODO:
-	var tvs []*entity.MessageTV
-	var encodedData []byte = data
-
-	message := &entity.Message{
+	// the payload is encoded by the codec chain of the transport, see Registry.Encode
+	return &entity.Message{
 		Header: header,
-		Tvs:    tvs,
-		Data:   encodedData,
-	}
-
-	return proto.Marshal(message)
+		Data:   data,
+	}, nil
 }
 
 func Decode(message *entity.Message) ([]byte, error) {
@@ -37,9 +40,9 @@ func Decode(message *entity.Message) ([]byte, error) {
 		return nil, errors.New("message is nil")
 	}
 
-	if message.Data == nil {
-		return nil, errors.New("message data is nil")
+	// an empty payload, like a Notification with only defaults, marshals to no data at all
+	if message.Data == nil && len(message.Tvs) == 0 {
+		return []byte{}, nil
 	}
-	// TODO: decode message data
-	return message.Data, nil
+	return DefaultRegistry.Decode(message)
 }
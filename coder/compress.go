@@ -0,0 +1,138 @@
+package coder
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"github.com/yangxm/gecko/entity"
+	"io"
+	"strconv"
+	"sync"
+)
+
+const (
+	CodecDeflate     = "deflate"
+	CodecDeflateFast = "deflate-fast"
+
+	TVTypeDeflate     int32 = 0x11
+	TVTypeDeflateFast int32 = 0x12
+
+	compressMinSize    = 256
+	compressSampleSize = 2 * 1024
+	// a frame is only sent compressed if it shrinks below 90% of its size
+	compressMaxRatioNum = 9
+	compressMaxRatioDen = 10
+	compressMaxSize     = 16 * 1024 * 1024
+	// deflate can't expand data more than that, a larger declared size is a lie
+	deflateMaxExpansion = 1032
+)
+
+func init() {
+	for _, codec := range []Codec{
+		newDeflateCodec(CodecDeflate, TVTypeDeflate, flate.DefaultCompression),
+		newDeflateCodec(CodecDeflateFast, TVTypeDeflateFast, flate.BestSpeed),
+	} {
+		if err := Register(codec); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// deflateCodec compresses a frame only when it is worth it: small frames are skipped, and so is
+// data that doesn't shrink enough, like TLS records or media. A large frame is probed with a sample
+// first, so incompressible data doesn't cost a full compression. The original size goes in the
+// MessageTV and bounds the decompression.
+type deflateCodec struct {
+	name    string
+	_type   int32
+	level   int
+	writers sync.Pool
+	readers sync.Pool
+}
+
+func newDeflateCodec(name string, _type int32, level int) *deflateCodec {
+	return &deflateCodec{name: name, _type: _type, level: level}
+}
+
+func (c *deflateCodec) Name() string {
+	return c.name
+}
+
+func (c *deflateCodec) Type() int32 {
+	return c._type
+}
+
+func (c *deflateCodec) Encode(_ *entity.MessageHeader, _ []*entity.MessageTV, data []byte) ([]byte, string, bool, error) {
+	if len(data) < compressMinSize {
+		return nil, "", false, nil
+	}
+	if len(data) > 2*compressSampleSize {
+		sample, err := c.compress(data[:compressSampleSize])
+		if err != nil {
+			return nil, "", false, err
+		}
+		if !worthIt(len(sample), compressSampleSize) {
+			return nil, "", false, nil
+		}
+	}
+	compressed, err := c.compress(data)
+	if err != nil {
+		return nil, "", false, err
+	}
+	if !worthIt(len(compressed), len(data)) {
+		return nil, "", false, nil
+	}
+	return compressed, strconv.Itoa(len(data)), true, nil
+}
+
+func worthIt(compressed, original int) bool {
+	return compressed*compressMaxRatioDen < original*compressMaxRatioNum
+}
+
+func (c *deflateCodec) compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Grow(len(data) / 2)
+	w, _ := c.writers.Get().(*flate.Writer)
+	if w == nil {
+		var err error
+		if w, err = flate.NewWriter(&buf, c.level); err != nil {
+			return nil, err
+		}
+	} else {
+		w.Reset(&buf)
+	}
+	defer c.writers.Put(w)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *deflateCodec) Decode(_ *entity.MessageHeader, _ []*entity.MessageTV, data []byte, value string) ([]byte, error) {
+	size, err := strconv.Atoi(value)
+	if err != nil || size < 0 || size > compressMaxSize || size > len(data)*deflateMaxExpansion {
+		return nil, fmt.Errorf("illegal original size: %s", value)
+	}
+
+	src := bytes.NewReader(data)
+	r, _ := c.readers.Get().(io.ReadCloser)
+	if r == nil {
+		r = flate.NewReader(src)
+	} else if err := r.(flate.Resetter).Reset(src, nil); err != nil {
+		return nil, err
+	}
+	defer c.readers.Put(r)
+
+	// never inflate past the size the sender declared
+	decoded := make([]byte, size)
+	if _, err := io.ReadFull(r, decoded); err != nil {
+		return nil, fmt.Errorf("inflate error: %v", err)
+	}
+	if n, _ := r.Read(make([]byte, 1)); n != 0 {
+		return nil, fmt.Errorf("inflated data longer than %d", size)
+	}
+	return decoded, nil
+}
@@ -0,0 +1,110 @@
+package coder
+
+import (
+	"bytes"
+	"crypto/rand"
+	"strconv"
+	"testing"
+)
+
+func deflateCodecs(t *testing.T) []Codec {
+	var codecs []Codec
+	for _, name := range []string{CodecDeflate, CodecDeflateFast} {
+		codec, ok := DefaultRegistry.Lookup(name)
+		if !ok {
+			t.Fatalf("%s not registered", name)
+		}
+		codecs = append(codecs, codec)
+	}
+	return codecs
+}
+
+func TestDeflateRoundTrip(t *testing.T) {
+	text := bytes.Repeat([]byte("GET /index.html HTTP/1.1\r\nHost: example.com\r\n\r\n"), 2000)
+	for _, codec := range deflateCodecs(t) {
+		for _, size := range []int{compressMinSize, 2 * compressSampleSize, 2*compressSampleSize + 1, len(text)} {
+			data := text[:size]
+			encoded, value, ok, err := codec.Encode(nil, nil, data)
+			if err != nil || !ok {
+				t.Fatalf("%s, %d bytes: %v, %v", codec.Name(), size, ok, err)
+			}
+			if value != strconv.Itoa(size) || !worthIt(len(encoded), size) {
+				t.Fatalf("%s, %d bytes: %d compressed, value %s", codec.Name(), size, len(encoded), value)
+			}
+			decoded, err := codec.Decode(nil, nil, encoded, value)
+			if err != nil || !bytes.Equal(decoded, data) {
+				t.Fatalf("%s, %d bytes: decoded %d, %v", codec.Name(), size, len(decoded), err)
+			}
+		}
+	}
+}
+
+func TestDeflateSkipsWhatDoesNotPay(t *testing.T) {
+	random := make([]byte, 64*1024)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+	// compressible data hidden behind an incompressible sample, the probe gives up on it
+	mixed := append(bytes.Clone(random[:compressSampleSize]), make([]byte, 64*1024)...)
+	for _, codec := range deflateCodecs(t) {
+		for name, data := range map[string][]byte{
+			"small":    bytes.Repeat([]byte("a"), compressMinSize-1),
+			"random":   random,
+			"sample":   mixed,
+			"barely":   random[:2*compressSampleSize],
+			"no bytes": {},
+		} {
+			if _, _, ok, err := codec.Encode(nil, nil, data); ok || err != nil {
+				t.Fatalf("%s, %s: compressed, %v", codec.Name(), name, err)
+			}
+		}
+	}
+}
+
+func TestDeflateFastAndAdaptiveInteroperate(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1024)
+	codecs := deflateCodecs(t)
+	adaptive, fast := codecs[0], codecs[1]
+	if adaptive.Type() == fast.Type() {
+		t.Fatal("both modes share a tv type")
+	}
+	for _, c := range [][2]Codec{{adaptive, fast}, {fast, adaptive}} {
+		encoded, value, _, err := c[0].Encode(nil, nil, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// both are raw deflate, only the level differs
+		if decoded, err := c[1].Decode(nil, nil, encoded, value); err != nil || !bytes.Equal(decoded, data) {
+			t.Fatalf("%s encoded, %s decoded: %v", c[0].Name(), c[1].Name(), err)
+		}
+	}
+}
+
+func TestDeflateDecodeBoundsTheSize(t *testing.T) {
+	codec := deflateCodecs(t)[0]
+	data := bytes.Repeat([]byte("a"), 4096)
+	encoded, value, _, err := codec.Encode(nil, nil, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, value := range map[string]string{
+		"shorter":       strconv.Itoa(len(data) - 1),
+		"longer":        strconv.Itoa(len(data) + 1),
+		"negative":      "-1",
+		"not a number":  "size",
+		"over max":      strconv.Itoa(compressMaxSize + 1),
+		"over ratio":    strconv.Itoa(len(encoded)*deflateMaxExpansion + 1),
+		"empty payload": value,
+	} {
+		payload := encoded
+		if name == "empty payload" {
+			payload = nil
+		}
+		if _, err := codec.Decode(nil, nil, payload, value); err == nil {
+			t.Fatalf("%s size accepted", name)
+		}
+	}
+	if _, err := codec.Decode(nil, nil, []byte("not deflate at all"), "100"); err == nil {
+		t.Fatal("garbage inflated")
+	}
+}
@@ -0,0 +1,225 @@
+package coder
+
+import (
+	"errors"
+	"fmt"
+	"github.com/yangxm/gecko/base"
+	"github.com/yangxm/gecko/entity"
+	"google.golang.org/protobuf/proto"
+)
+
+var messageTypes = map[byte]entity.MessageType{
+	base.MsgTypeConnect:      entity.MessageType_MESSAGE_TYPE_CONNECT,
+	base.MsgTypeConnectAck:   entity.MessageType_MESSAGE_TYPE_CONNECT_ACK,
+	base.MsgTypeData:         entity.MessageType_MESSAGE_TYPE_DATA,
+	base.MsgTypeClose:        entity.MessageType_MESSAGE_TYPE_CLOSE,
+	base.MsgTypeError:        entity.MessageType_MESSAGE_TYPE_ERROR,
+	base.MsgTypeWindowUpdate: entity.MessageType_MESSAGE_TYPE_WINDOW_UPDATE,
+	base.MsgTypeHalfClose:    entity.MessageType_MESSAGE_TYPE_HALF_CLOSE,
+	base.MsgTypeAck:          entity.MessageType_MESSAGE_TYPE_ACK,
+	base.MsgTypeResume:       entity.MessageType_MESSAGE_TYPE_RESUME,
+	base.MsgTypeResumeAck:    entity.MessageType_MESSAGE_TYPE_RESUME_ACK,
+	base.MsgTypeHello:        entity.MessageType_MESSAGE_TYPE_HELLO,
+	base.MsgTypeHelloAck:     entity.MessageType_MESSAGE_TYPE_HELLO_ACK,
+	base.MsgTypeBatch:        entity.MessageType_MESSAGE_TYPE_BATCH,
+	base.MsgTypeFragment:     entity.MessageType_MESSAGE_TYPE_FRAGMENT,
+	base.MsgTypeCover:        entity.MessageType_MESSAGE_TYPE_COVER,
+}
+
+var directions = map[byte]entity.Direction{
+	base.MsgFlagToServer: entity.Direction_DIRECTION_TO_SERVER,
+	base.MsgFlagToClient: entity.Direction_DIRECTION_TO_CLIENT,
+}
+
+var serverTypes = map[byte]entity.ServerType{
+	0x00: entity.ServerType_SERVER_TYPE_DEFAULT,
+}
+
+// Header is the typed view of a MessageHeader, whichever of the two encodings it came in.
+type Header struct {
+	Type       entity.MessageType
+	Direction  entity.Direction
+	ServerType entity.ServerType
+	ClientID   string
+	ConnID     string
+	Seq        uint64
+	StreamID   uint32
+}
+
+func MessageTypeOf(_type byte) (entity.MessageType, bool) {
+	t, ok := messageTypes[_type]
+	return t, ok
+}
+
+func DirectionOf(flag byte) (entity.Direction, bool) {
+	d, ok := directions[flag]
+	return d, ok
+}
+
+// ServerTypeOf maps a v1 byte without an enum to the default server, see legacyServerType.
+func ServerTypeOf(serverType byte) (entity.ServerType, bool) {
+	s, ok := serverTypes[legacyServerType([]byte{serverType})[0]]
+	return s, ok
+}
+
+// MessageTypeByte is the v1 byte of a message type, the bridge and the session still key on it.
+func MessageTypeByte(_type entity.MessageType) (byte, bool) {
+	return keyOf(messageTypes, _type)
+}
+
+func DirectionByte(direction entity.Direction) (byte, bool) {
+	return keyOf(directions, direction)
+}
+
+func ServerTypeByte(serverType entity.ServerType) (byte, bool) {
+	return keyOf(serverTypes, serverType)
+}
+
+func keyOf[V comparable](m map[byte]V, value V) (byte, bool) {
+	for k, v := range m {
+		if v == value {
+			return k, true
+		}
+	}
+	return 0, false
+}
+
+// ParseHeader reads the enums of a v2 header and falls back to the single byte fields of a v1 one.
+// A header carrying both must carry the same values in both.
+func ParseHeader(header *entity.MessageHeader) (Header, error) {
+	if header == nil {
+		return Header{}, errors.New("header is nil")
+	}
+	_type, err := parseField("type", header.Type, header.MsgType, messageTypes)
+	if err != nil {
+		return Header{}, err
+	}
+	direction, err := parseField("flag", header.Flag, header.Direction, directions)
+	if err != nil {
+		return Header{}, err
+	}
+	serverType, err := parseField("serverType", legacyServerType(header.ServerType), header.Server, serverTypes)
+	if err != nil {
+		return Header{}, err
+	}
+	return Header{
+		Type:       _type,
+		Direction:  direction,
+		ServerType: serverType,
+		ClientID:   header.ClientID,
+		ConnID:     header.ConnID,
+		Seq:        header.Seq,
+		StreamID:   header.StreamID,
+	}, nil
+}
+
+// legacyServerType maps a v1 serverType byte without an enum to the default server, v1 peers send any value there.
+func legacyServerType(legacy []byte) []byte {
+	if len(legacy) == 1 {
+		if _, ok := serverTypes[legacy[0]]; !ok {
+			return []byte{0x00}
+		}
+	}
+	return legacy
+}
+
+func parseField[V comparable](name string, legacy []byte, value V, m map[byte]V) (V, error) {
+	var zero V
+	if legacy == nil {
+		if value == zero {
+			return zero, fmt.Errorf("missing %s", name)
+		}
+		if _, ok := keyOf(m, value); !ok {
+			return zero, fmt.Errorf("illegal %s %v", name, value)
+		}
+		return value, nil
+	}
+	if len(legacy) != 1 {
+		return zero, fmt.Errorf("illegal %s %v", name, legacy)
+	}
+	mapped, ok := m[legacy[0]]
+	if !ok {
+		return zero, fmt.Errorf("illegal %s %v", name, legacy)
+	}
+	if value != zero && value != mapped {
+		return zero, fmt.Errorf("%s mismatch, %v and %v", name, legacy, value)
+	}
+	return mapped, nil
+}
+
+// Proto builds a MessageHeader carrying both encodings, so v1 peers read it as well.
+func (h Header) Proto() *entity.MessageHeader {
+	header := &entity.MessageHeader{
+		ClientID:  h.ClientID,
+		ConnID:    h.ConnID,
+		Seq:       h.Seq,
+		StreamID:  h.StreamID,
+		MsgType:   h.Type,
+		Direction: h.Direction,
+		Server:    h.ServerType,
+	}
+	if b, ok := MessageTypeByte(h.Type); ok {
+		header.Type = []byte{b}
+	}
+	if b, ok := DirectionByte(h.Direction); ok {
+		header.Flag = []byte{b}
+	}
+	if b, ok := ServerTypeByte(h.ServerType); ok {
+		header.ServerType = []byte{b}
+	}
+	return header
+}
+
+// NewFrame takes a nil data as an empty payload, see NewMessage.
+func NewFrame(h Header, data []byte) (*entity.Message, error) {
+	return &entity.Message{
+		Header: h.Proto(),
+		Data:   data,
+	}, nil
+}
+
+// ParseFrame unmarshals a frame and parses its header.
+func ParseFrame(data []byte) (*entity.Message, Header, error) {
+	var message entity.Message
+	if err := proto.Unmarshal(data, &message); err != nil {
+		return nil, Header{}, fmt.Errorf("unmarshal Message error: %v", err)
+	}
+	h, err := ParseHeader(message.GetHeader())
+	if err != nil {
+		return nil, Header{}, err
+	}
+	return &message, h, nil
+}
+
+// Normalize fills in whichever encoding a header lacks, it reports whether the header changed.
+// The payload codecs cover the byte fields, so a v2 header goes through it before it is decoded.
+func Normalize(header *entity.MessageHeader) (bool, error) {
+	h, err := ParseHeader(header)
+	if err != nil {
+		return false, err
+	}
+	full := h.Proto()
+	changed := header.Type == nil || header.Flag == nil || header.ServerType == nil ||
+		header.MsgType == entity.MessageType_MESSAGE_TYPE_UNSPECIFIED ||
+		header.Direction == entity.Direction_DIRECTION_UNSPECIFIED ||
+		header.Server == entity.ServerType_SERVER_TYPE_UNSPECIFIED
+	header.Type, header.Flag, header.ServerType = full.Type, full.Flag, full.ServerType
+	header.MsgType, header.Direction, header.Server = full.MsgType, full.Direction, full.Server
+	return changed, nil
+}
+
+// StripLegacy returns a copy of header without the single byte fields, for a peer reading the enums.
+func StripLegacy(header *entity.MessageHeader) *entity.MessageHeader {
+	if header == nil {
+		return nil
+	}
+	return &entity.MessageHeader{
+		ClientID:  header.ClientID,
+		ConnID:    header.ConnID,
+		Seq:       header.Seq,
+		StreamID:  header.StreamID,
+		MsgType:   header.MsgType,
+		Direction: header.Direction,
+		Server:    header.Server,
+	}
+}
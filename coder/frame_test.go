@@ -0,0 +1,70 @@
+package coder
+
+import (
+	"github.com/yangxm/gecko/base"
+	"github.com/yangxm/gecko/entity"
+	"google.golang.org/protobuf/proto"
+	"testing"
+)
+
+func TestParseFrameV1ServerTypes(t *testing.T) {
+	for _, serverType := range []byte{0x00, 0x01, 0x07, 0xFF} {
+		data, err := proto.Marshal(&entity.Message{
+			Header: &entity.MessageHeader{
+				Type:       []byte{base.MsgTypeData},
+				Flag:       []byte{base.MsgFlagToServer},
+				ClientID:   "c1",
+				ConnID:     "conn",
+				ServerType: []byte{serverType},
+			},
+			Data: []byte("data"),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		message, h, err := ParseFrame(data)
+		if err != nil {
+			t.Fatalf("serverType 0x%02x: %v", serverType, err)
+		}
+		if h.ServerType != entity.ServerType_SERVER_TYPE_DEFAULT || h.Type != entity.MessageType_MESSAGE_TYPE_DATA {
+			t.Fatalf("serverType 0x%02x: parsed %+v", serverType, h)
+		}
+		if _, err := Normalize(message.Header); err != nil {
+			t.Fatalf("serverType 0x%02x, normalize: %v", serverType, err)
+		}
+		if message.Header.Server != entity.ServerType_SERVER_TYPE_DEFAULT {
+			t.Fatalf("serverType 0x%02x, normalized to %v", serverType, message.Header.Server)
+		}
+	}
+}
+
+func TestParseFrameV1ServerTypeFromEncode(t *testing.T) {
+	data, err := Encode(base.MsgTypeConnect, base.MsgFlagToServer, "c1", "conn", 0x05, []byte("connect"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, h, err := ParseFrame(data); err != nil || h.ServerType != entity.ServerType_SERVER_TYPE_DEFAULT {
+		t.Fatalf("parsed %+v, %v", h, err)
+	}
+}
+
+func TestParseHeaderRejectsIllegalServerType(t *testing.T) {
+	header := &entity.MessageHeader{
+		Type:       []byte{base.MsgTypeData},
+		Flag:       []byte{base.MsgFlagToServer},
+		ServerType: []byte{0x00, 0x01},
+	}
+	if _, err := ParseHeader(header); err == nil {
+		t.Fatal("two byte serverType accepted")
+	}
+}
+
+func TestStripLegacyKeepsUnknownServerType(t *testing.T) {
+	message, err := NewMessage(base.MsgTypeData, base.MsgFlagToServer, "c1", "conn", 0x05, []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h, err := ParseHeader(StripLegacy(message.Header)); err != nil || h.ServerType != entity.ServerType_SERVER_TYPE_DEFAULT {
+		t.Fatalf("parsed %+v, %v", h, err)
+	}
+}
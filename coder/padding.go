@@ -0,0 +1,57 @@
+package coder
+
+import (
+	"crypto/rand"
+	"fmt"
+	"github.com/yangxm/gecko/entity"
+	"math/big"
+	"strconv"
+)
+
+const (
+	CodecPadding = "padding"
+
+	TVTypePadding int32 = 0x31
+
+	paddingMaxBytes = 255
+)
+
+func init() {
+	if err := Register(&paddingCodec{}); err != nil {
+		panic(err)
+	}
+}
+
+// paddingCodec appends a random number of random bytes to the payload, so the frame sizes don't follow
+// the sizes of the tunneled data. It goes before the encryption, which hides the padding as well.
+type paddingCodec struct{}
+
+func (c *paddingCodec) Name() string {
+	return CodecPadding
+}
+
+func (c *paddingCodec) Type() int32 {
+	return TVTypePadding
+}
+
+func (c *paddingCodec) Encode(_ *entity.MessageHeader, _ []*entity.MessageTV, data []byte) ([]byte, string, bool, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(paddingMaxBytes+1))
+	if err != nil {
+		return nil, "", false, fmt.Errorf("random padding size error: %v", err)
+	}
+	size := int(n.Int64())
+	padded := make([]byte, len(data)+size)
+	copy(padded, data)
+	if _, err := rand.Read(padded[len(data):]); err != nil {
+		return nil, "", false, fmt.Errorf("random padding error: %v", err)
+	}
+	return padded, strconv.Itoa(size), true, nil
+}
+
+func (c *paddingCodec) Decode(_ *entity.MessageHeader, _ []*entity.MessageTV, data []byte, value string) ([]byte, error) {
+	size, err := strconv.Atoi(value)
+	if err != nil || size < 0 || size > len(data) {
+		return nil, fmt.Errorf("illegal padding size: %s", value)
+	}
+	return data[:len(data)-size], nil
+}
@@ -0,0 +1,45 @@
+package coder
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+)
+
+func TestPaddingRoundTrip(t *testing.T) {
+	codec, ok := DefaultRegistry.Lookup(CodecPadding)
+	if !ok {
+		t.Fatal("padding not registered")
+	}
+	sizes := make(map[int]bool)
+	for _, data := range [][]byte{{}, []byte("x"), bytes.Repeat([]byte("data"), 1000)} {
+		for range 200 {
+			padded, value, ok, err := codec.Encode(nil, nil, data)
+			if err != nil || !ok {
+				t.Fatalf("encode: %v, %v", ok, err)
+			}
+			size, _ := strconv.Atoi(value)
+			if size < 0 || size > paddingMaxBytes || len(padded) != len(data)+size || !bytes.HasPrefix(padded, data) {
+				t.Fatalf("%d bytes padded to %d, value %s", len(data), len(padded), value)
+			}
+			sizes[size] = true
+			decoded, err := codec.Decode(nil, nil, padded, value)
+			if err != nil || !bytes.Equal(decoded, data) {
+				t.Fatalf("decoded %d of %d bytes: %v", len(decoded), len(data), err)
+			}
+		}
+	}
+	// 600 draws out of 256 sizes, a fixed or narrow size would show up here
+	if len(sizes) < 64 {
+		t.Fatalf("padding sizes: %d distinct", len(sizes))
+	}
+}
+
+func TestPaddingDecodeRejectsIllegalSize(t *testing.T) {
+	codec, _ := DefaultRegistry.Lookup(CodecPadding)
+	for _, value := range []string{"-1", "11", "size", ""} {
+		if _, err := codec.Decode(nil, nil, make([]byte, 10), value); err == nil {
+			t.Fatalf("padding size %q accepted", value)
+		}
+	}
+}
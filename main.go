@@ -8,7 +8,11 @@ import (
 func main() {
 	logger.InitLogger("")
 	logger.Info("SOCKS5 SERVER START")
-	server := socks5.NewClientLocalSocks5Server("", "127.0.0.1", 1080, nil)
+	server, err := socks5.NewClientLocalSocks5Server("", "127.0.0.1", 1080, nil, socks5.NewSock5ConnManager())
+	if err != nil {
+		logger.Error("SOCKS5 SERVER CREATE FAILED: %v", err)
+		return
+	}
 	server.Start()
 	logger.Info("SOCKS5 SERVER STOP")
 }
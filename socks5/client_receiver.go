@@ -17,11 +17,16 @@ type ClientReceiver struct {
 	connManager    base.ConnManager[*Socks5Conn]
 }
 
-func NewClientReceiver(clientID string) *ClientReceiver {
+// NewClientReceiver creates the receiver of a client profile, connManager is the one of the
+// ClientLocalSocks5Server of the same profile.
+func NewClientReceiver(clientID string, connManager base.ConnManager[*Socks5Conn]) (*ClientReceiver, error) {
+	if connManager == nil {
+		return nil, fmt.Errorf("connManager is nil")
+	}
 	return &ClientReceiver{
 		clientID:    clientID,
-		connManager: Sock5ConnManager(),
-	}
+		connManager: connManager,
+	}, nil
 }
 
 func (c *ClientReceiver) nextTraceID() string {
@@ -45,18 +50,13 @@ func (c *ClientReceiver) OnReceived(data []byte) {
 		logger.Warn("[%s] RECV DONE, data bytes is null or empty", traceID)
 		return
 	}
-	var message entity.Message
-	if err := proto.Unmarshal(data, &message); err != nil {
-		logger.Warn("[%s] RECV ERROR, unmarshal data to Message failed: %v", traceID, err)
+	message, header, err := coder.ParseFrame(data)
+	if err != nil {
+		logger.Error("[%s] RECV ERROR, parse frame failed: %v", traceID, err)
 		return
 	}
-	header := message.GetHeader()
-	if header == nil {
-		logger.Error("[%s] RECV ERROR, header is nil", traceID)
-		return
-	}
-	logger.Debug("[%s] RECV, unmarshal data success, type: %v, flag: %v, ConnID: %v, clientID: %v, serverType: %v",
-		traceID, header.Type, header.Flag, header.ConnID, header.ClientID, header.ServerType)
+	logger.Debug("[%s] RECV, parse frame success, type: %v, direction: %v, ConnID: %v, clientID: %v, serverType: %v",
+		traceID, header.Type, header.Direction, header.ConnID, header.ClientID, header.ServerType)
 
 	if c.clientID != header.ClientID {
 		logger.Error("[%s] RECV ERROR, clientID not match, expected: %s, actual: %v", traceID, c.clientID, header.ClientID)
@@ -68,32 +68,30 @@ func (c *ClientReceiver) OnReceived(data []byte) {
 		return
 	}
 
-	if header.Flag == nil || len(header.Flag) != 1 || base.MsgFlagToClient != header.Flag[0] {
-		logger.Error("[%s] RECV ERROR, illegal flag %v", traceID, header.Flag)
+	if header.Direction != entity.Direction_DIRECTION_TO_CLIENT {
+		logger.Error("[%s] RECV ERROR, illegal direction %v", traceID, header.Direction)
 		return
 	}
 
-	var _type byte
-	if header.Type == nil || len(header.Type) != 1 {
-		logger.Error("[%s] RECV ERROR, illegal type %v", traceID, header.Type)
-		return
-	}
-	_type = header.Type[0]
-
-	if decodedData, err := coder.Decode(&message); err != nil {
+	if decodedData, err := coder.Decode(message); err != nil {
 		logger.Error("[%s] RECV ERROR, decoded failed: %v", traceID, err)
 		return
 	} else {
-		switch _type {
-		case base.MsgTypeData:
+		switch header.Type {
+		case entity.MessageType_MESSAGE_TYPE_DATA:
 			c.handleData(traceID, header.ConnID, decodedData)
-		case base.MsgTypeConnectAck:
+		case entity.MessageType_MESSAGE_TYPE_CONNECT_ACK:
 			c.handleConnectAck(traceID, header.ConnID, decodedData)
-		case base.MsgTypeClose:
+		case entity.MessageType_MESSAGE_TYPE_CLOSE:
 			c.handleClose(traceID, header.ConnID, decodedData)
-		case base.MsgTypeError:
+		case entity.MessageType_MESSAGE_TYPE_WINDOW_UPDATE:
+			c.handleWindowUpdate(traceID, header.ConnID, decodedData)
+		case entity.MessageType_MESSAGE_TYPE_HALF_CLOSE:
+			c.handleHalfClose(traceID, header.ConnID)
+		case entity.MessageType_MESSAGE_TYPE_ERROR:
+			c.handleError(traceID, header.ConnID, decodedData)
 		default:
-			logger.Warn("[%s] RECV ERROR, unknown type %v", traceID, _type)
+			logger.Warn("[%s] RECV ERROR, unknown type %v", traceID, header.Type)
 		}
 	}
 }
@@ -101,12 +99,50 @@ func (c *ClientReceiver) OnReceived(data []byte) {
 func (c *ClientReceiver) handleData(traceID, connID string, data []byte) {
 	shortConn := util.ShortConnID(connID)
 	logger.Debug("[%s] RECV [%s], handling Data", traceID, shortConn)
-	if wn, err := c.connManager.WriteIfConnected(connID, data); err != nil {
-		logger.Error("[%s] RECV [%s] ERROR, write data to client failed: %v", traceID, shortConn, err)
+	sk5Conn, res := c.connManager.Get(connID)
+	if !res || sk5Conn == nil || sk5Conn.flow == nil {
+		logger.Error("[%s] RECV [%s] ERROR, handling Data, get conn failed", traceID, shortConn)
+		return
+	}
+	if err := sk5Conn.flow.recv.push(data); err != nil {
+		logger.Error("[%s] RECV [%s] ERROR, buffer data for client failed: %v", traceID, shortConn, err)
 		c.connManager.RemoveAndClose(connID)
 	} else {
-		logger.Debug("[%s] RECV [%s], write data to client success, %d", traceID, shortConn, wn)
+		logger.Debug("[%s] RECV [%s], buffer data for client success, %d", traceID, shortConn, len(data))
+	}
+}
+
+func (c *ClientReceiver) handleWindowUpdate(traceID, connID string, data []byte) {
+	shortConn := util.ShortConnID(connID)
+	logger.Debug("[%s] RECV [%s], handling WindowUpdate", traceID, shortConn)
+	var update entity.WindowUpdate
+	if err := proto.Unmarshal(data, &update); err != nil {
+		logger.Error("[%s] RECV [%s] ERROR, handling WindowUpdate, unmarshal data failed: %v", traceID, shortConn, err)
+		return
+	}
+
+	sk5Conn, res := c.connManager.Get(connID)
+	if !res || sk5Conn == nil || sk5Conn.flow == nil {
+		logger.Error("[%s] RECV [%s] ERROR, handling WindowUpdate, get conn failed", traceID, shortConn)
+		return
 	}
+	sk5Conn.flow.send.grant(int(update.Increment))
+	logger.Debug("[%s] RECV [%s], handling WindowUpdate, increment: %d, credit: %d", traceID, shortConn, update.Increment, sk5Conn.flow.send.available())
+}
+
+func (c *ClientReceiver) handleHalfClose(traceID, connID string) {
+	shortConn := util.ShortConnID(connID)
+	logger.Debug("[%s] RECV [%s], handling HalfClose", traceID, shortConn)
+	sk5Conn, res := c.connManager.Get(connID)
+	if !res || sk5Conn == nil || sk5Conn.flow == nil {
+		logger.Error("[%s] RECV [%s] ERROR, handling HalfClose, get conn failed", traceID, shortConn)
+		return
+	}
+	if err := sk5Conn.flow.recv.pushEOF(); err != nil {
+		logger.Error("[%s] RECV [%s] ERROR, handling HalfClose, buffer EOF failed: %v", traceID, shortConn, err)
+		return
+	}
+	logger.Debug("[%s] RECV [%s], handling HalfClose, buffered EOF", traceID, shortConn)
 }
 
 func (c *ClientReceiver) handleConnectAck(traceID, connID string, data []byte) {
@@ -124,6 +160,10 @@ func (c *ClientReceiver) handleConnectAck(traceID, connID string, data []byte) {
 		logger.Error("[%s] RECV [%s] ERROR, handling ConnectAck, get conn failed", traceID, shortConn)
 		return
 	}
+	if !sk5Conn.MarkReplied() {
+		logger.Warn("[%s] RECV [%s], handling ConnectAck, CONNECT already answered", traceID, shortConn)
+		return
+	}
 	var respBytes []byte
 	if notif.Code == 0 {
 		logger.Debug("[%s] RECV [%s], handling ConnectAck, success, code: %d, message: %s", traceID, shortConn, notif.Code, notif.Message)
@@ -131,8 +171,8 @@ func (c *ClientReceiver) handleConnectAck(traceID, connID string, data []byte) {
 		sk5Conn.SetConnected(true)
 
 	} else {
-		logger.Error("[%s] RECV [%s], handling ConnectAck, failed, code: %d, message: %s", traceID, shortConn, notif.Code, notif.Message)
-		respBytes = base.Socks5CmdConnectFailed()
+		logger.Error("[%s] RECV [%s], handling ConnectAck, failed, code: %s, message: %s", traceID, shortConn, base.ErrCodeName(notif.Code), notif.Message)
+		respBytes = base.Socks5CmdConnectReply(base.Socks5RepOf(notif.Code))
 		sk5Conn.SetConnected(false)
 	}
 
@@ -154,6 +194,9 @@ func (c *ClientReceiver) handleClose(traceID, connID string, data []byte) {
 		logger.Debug("[%s] RECV [%s], handling Close, Addr --> %s:%d %v, code: %d, message: %s",
 			traceID, shortConn, notif.Addr, notif.Port, notif.Atyp, notif.Code, notif.Message)
 	}
+	if sk5Conn, res := c.connManager.Get(connID); res && sk5Conn.flow != nil {
+		sk5Conn.flow.setCloseReason(proxyDoneRemoteClosed, notif.Message)
+	}
 	c.connManager.RemoveAndClose(connID)
 	logger.Debug("[%s] RECV [%s], handling Close, closed conn", traceID, shortConn)
 }
@@ -164,11 +207,29 @@ func (c *ClientReceiver) handleError(traceID, connID string, data []byte) {
 	var notif entity.Notification
 	if err := proto.Unmarshal(data, &notif); err != nil {
 		logger.Error("[%s] RECV [%s] ERROR, handling Error, unmarshal data failed: %v", traceID, shortConn, err)
+		notif.Reset()
 	} else {
-		logger.Error("[%s] RECV [%s], handling Error, Addr --> %s:%d %v, code: %d, message: %s",
-			traceID, shortConn, notif.Addr, notif.Port, notif.Atyp, notif.Code, notif.Message)
+		logger.Error("[%s] RECV [%s], handling Error, Addr --> %s:%d %v, code: %s, message: %s",
+			traceID, shortConn, notif.Addr, notif.Port, notif.Atyp, base.ErrCodeName(notif.Code), notif.Message)
+	}
+	// an Error frame without a code still failed the stream
+	code := notif.Code
+	if code == base.ErrCodeNone {
+		code = base.ErrCodeGeneral
+	}
+
+	if sk5Conn, res := c.connManager.Get(connID); res && sk5Conn != nil {
+		// the client still waits for the reply to its CONNECT
+		if sk5Conn.MarkReplied() {
+			rep := base.Socks5RepOf(code)
+			if _, err := sk5Conn.Write(base.Socks5CmdConnectReply(rep)); err != nil {
+				logger.Warn("[%s] RECV [%s], handling Error, write reply %#x to client failed: %v", traceID, shortConn, rep, err)
+			}
+		}
+		if sk5Conn.flow != nil {
+			sk5Conn.flow.setCloseReason(proxyDoneRemoteError, fmt.Sprintf("%s, %s", base.ErrCodeName(code), notif.Message))
+		}
 	}
-
 	c.connManager.RemoveAndClose(connID)
 	logger.Debug("[%s] RECV [%s], handling Error, closed conn", traceID, shortConn)
 }
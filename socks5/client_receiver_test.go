@@ -0,0 +1,90 @@
+package socks5
+
+import (
+	"bytes"
+	"github.com/yangxm/gecko/base"
+	"github.com/yangxm/gecko/coder"
+	"github.com/yangxm/gecko/entity"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"testing"
+	"time"
+)
+
+// receiveAll hands frames of the given types and payloads to a receiver for one waiting stream, and returns
+// what its SOCKS5 client read until the stream was closed.
+func receiveAll(t *testing.T, frames ...sentFrame) []byte {
+	client, server := tcpPair(t)
+	manager := NewSock5ConnManager()
+	receiver := newReceiver(t, "c1", manager)
+	sk5Conn := NewSocks5Conn(server)
+	if err := sk5Conn.SetTarget("example.com", 80, base.AddrTypeDomain, true); err != nil {
+		t.Fatal(err)
+	}
+	sk5Conn.flow = newStreamFlow(base.StreamInitialWindow)
+	manager.Add(sk5Conn.ConnID(), sk5Conn)
+
+	for _, f := range frames {
+		frame, err := coder.Encode(f._type, base.MsgFlagToClient, "c1", sk5Conn.ConnID(), 0x00, f.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		receiver.OnReceived(frame)
+	}
+	if manager.IsExist(sk5Conn.ConnID()) {
+		t.Fatal("stream not closed")
+	}
+	_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	read, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return read
+}
+
+func notification(t *testing.T, code int32) []byte {
+	data, err := proto.Marshal(&entity.Notification{Code: code, Message: "failed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestReceiverErrorRepliesToConnect(t *testing.T) {
+	for name, c := range map[string]struct {
+		data []byte
+		rep  byte
+	}{
+		"no payload":     {nil, base.Socks5RepGeneralFailure},
+		"no code":        {notification(t, base.ErrCodeNone), base.Socks5RepGeneralFailure},
+		"broken payload": {[]byte{0xFF, 0xFF}, base.Socks5RepGeneralFailure},
+		"refused":        {notification(t, base.ErrCodeDialRefused), base.Socks5RepConnectionRefused},
+		"unknown code":   {notification(t, 0x7F), base.Socks5RepGeneralFailure},
+	} {
+		read := receiveAll(t, sentFrame{_type: base.MsgTypeError, data: c.data})
+		if !bytes.Equal(read, base.Socks5CmdConnectReply(c.rep)) {
+			t.Fatalf("%s, client read: %v", name, read)
+		}
+	}
+}
+
+func TestReceiverErrorAfterConnectAckRepliesOnce(t *testing.T) {
+	// a successful ConnectAck carries an empty Notification, which marshals to no data at all
+	empty, err := proto.Marshal(&entity.Notification{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := receiveAll(t,
+		sentFrame{_type: base.MsgTypeConnectAck, data: empty},
+		sentFrame{_type: base.MsgTypeError, data: notification(t, base.ErrCodeTimeout)})
+	if !bytes.Equal(read, base.Socks5CmdConnectSuccess()) {
+		t.Fatalf("connected, client read: %v", read)
+	}
+
+	read = receiveAll(t,
+		sentFrame{_type: base.MsgTypeConnectAck, data: notification(t, base.ErrCodeTimeout)},
+		sentFrame{_type: base.MsgTypeError, data: notification(t, base.ErrCodeDialRefused)})
+	if !bytes.Equal(read, base.Socks5CmdConnectReply(base.Socks5RepTTLExpired)) {
+		t.Fatalf("refused, client read: %v", read)
+	}
+}
@@ -13,22 +13,12 @@ type _Sock5ConnManager struct {
 	conns map[string]*Socks5Conn
 }
 
-var (
-	sock5ConnManagerCreateMutex sync.Mutex
-	sock5ConnManagerInstance    *_Sock5ConnManager
-)
-
-func Sock5ConnManager() base.ConnManager[*Socks5Conn] {
-	if sock5ConnManagerInstance == nil {
-		sock5ConnManagerCreateMutex.Lock()
-		defer sock5ConnManagerCreateMutex.Unlock()
-		if sock5ConnManagerInstance == nil {
-			sock5ConnManagerInstance = &_Sock5ConnManager{
-				conns: make(map[string]*Socks5Conn),
-			}
-		}
+// NewSock5ConnManager creates the conn manager of one client profile, it is shared by the
+// ClientLocalSocks5Server and the ClientReceiver of the profile and nothing else.
+func NewSock5ConnManager() base.ConnManager[*Socks5Conn] {
+	return &_Sock5ConnManager{
+		conns: make(map[string]*Socks5Conn),
 	}
-	return sock5ConnManagerInstance
 }
 
 func (s *_Sock5ConnManager) Add(connID string, conn *Socks5Conn) {
@@ -51,11 +41,15 @@ func (s *_Sock5ConnManager) RemoveAndClose(connID string) {
 }
 
 func (s *_Sock5ConnManager) Get(connID string) (*Socks5Conn, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	conn, ok := s.conns[connID]
 	return conn, ok && conn != nil
 }
 
 func (s *_Sock5ConnManager) IsExist(connID string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	sk5Conns, ok := s.conns[connID]
 	return ok && sk5Conns != nil
 }
@@ -84,6 +78,8 @@ func (s *_Sock5ConnManager) Close() {
 }
 
 func (s *_Sock5ConnManager) Len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	return len(s.conns)
 }
 
@@ -0,0 +1,172 @@
+package socks5
+
+import (
+	"fmt"
+	"sync"
+)
+
+// streamFlow holds the credit-based flow control state of one proxied connID.
+// send is the credit granted by the remote side for our upstream data, recv
+// buffers downstream data until the local socks5 client has consumed it.
+type streamFlow struct {
+	send        *sendWindow
+	recv        *recvBuffer
+	mutex       sync.Mutex
+	closeReason string
+	closeDetail string
+}
+
+func newStreamFlow(window int) *streamFlow {
+	return &streamFlow{
+		send: newSendWindow(window),
+		recv: newRecvBuffer(window),
+	}
+}
+
+// setCloseReason records why the stream is going away, the first reason wins.
+func (f *streamFlow) setCloseReason(reason, detail string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.closeReason == "" {
+		f.closeReason = reason
+		f.closeDetail = detail
+	}
+}
+
+func (f *streamFlow) getCloseReason() (string, string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.closeReason, f.closeDetail
+}
+
+func (f *streamFlow) close() {
+	f.send.close()
+	f.recv.close()
+}
+
+type sendWindow struct {
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	credit int
+	closed bool
+}
+
+func newSendWindow(initial int) *sendWindow {
+	w := &sendWindow{credit: initial}
+	w.cond = sync.NewCond(&w.mutex)
+	return w
+}
+
+// acquire blocks until there is credit available and takes at most max bytes of it.
+func (w *sendWindow) acquire(max int) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for w.credit <= 0 && !w.closed {
+		w.cond.Wait()
+	}
+	if w.closed {
+		return 0, fmt.Errorf("send window closed")
+	}
+	n := min(max, w.credit)
+	w.credit -= n
+	return n, nil
+}
+
+func (w *sendWindow) grant(n int) {
+	if n <= 0 {
+		return
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.credit += n
+	w.cond.Broadcast()
+}
+
+func (w *sendWindow) available() int {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.credit
+}
+
+func (w *sendWindow) close() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.closed = true
+	w.cond.Broadcast()
+}
+
+type recvBuffer struct {
+	mutex    sync.Mutex
+	cond     *sync.Cond
+	frames   [][]byte
+	buffered int
+	window   int
+	eof      bool
+	closed   bool
+}
+
+func newRecvBuffer(window int) *recvBuffer {
+	b := &recvBuffer{window: window}
+	b.cond = sync.NewCond(&b.mutex)
+	return b
+}
+
+// push queues data without blocking, the remote side must never send more than the window it was granted.
+func (b *recvBuffer) push(data []byte) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.closed {
+		return fmt.Errorf("recv buffer closed")
+	}
+	if b.eof {
+		return fmt.Errorf("recv buffer already half closed")
+	}
+	if b.buffered+len(data) > b.window {
+		return fmt.Errorf("recv window exceeded, buffered: %d, incoming: %d, window: %d", b.buffered, len(data), b.window)
+	}
+	b.frames = append(b.frames, data)
+	b.buffered += len(data)
+	b.cond.Broadcast()
+	return nil
+}
+
+// pushEOF marks the end of the downstream data, pop reports it once everything queued before it is consumed.
+func (b *recvBuffer) pushEOF() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.closed {
+		return fmt.Errorf("recv buffer closed")
+	}
+	b.eof = true
+	b.cond.Broadcast()
+	return nil
+}
+
+// pop blocks until data or EOF is available, ok is false once the buffer is closed.
+func (b *recvBuffer) pop() (data []byte, eof bool, ok bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for len(b.frames) == 0 && !b.eof && !b.closed {
+		b.cond.Wait()
+	}
+	if b.closed {
+		return nil, false, false
+	}
+	if len(b.frames) == 0 {
+		return nil, true, true
+	}
+	data = b.frames[0]
+	b.frames[0] = nil
+	b.frames = b.frames[1:]
+	b.buffered -= len(data)
+	return data, false, true
+}
+
+func (b *recvBuffer) close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.closed = true
+	b.frames = nil
+	b.buffered = 0
+	b.cond.Broadcast()
+}
@@ -19,10 +19,12 @@ type Socks5Conn struct {
 	targetPort     int
 	targetAddrType byte
 	isConnected    bool
+	isReplied      bool
 	isProxy        bool
 	attrs          map[string]interface{}
 	isClosed       atomic.Bool
 	CloseChan      chan struct{}
+	flow           *streamFlow
 }
 
 func NewSocks5Conn(conn net.Conn) *Socks5Conn {
@@ -60,10 +62,12 @@ func (s *Socks5Conn) SetTarget(targetAddr string, targetPort int, targetAddrType
 		return fmt.Errorf("SOCKS5[%s] invalid port: %d", s.shortID, targetPort)
 	}
 
+	s.mutex.Lock()
 	s.targetAddr = targetAddr
 	s.targetPort = targetPort
 	s.targetAddrType = targetAddrType
 	s.isProxy = isProxy
+	s.mutex.Unlock()
 	logger.Debug("SOCKS5[%s] set target --- %s:%d %d, proxy: %v", s.shortID, targetAddr, targetPort, targetAddrType, isProxy)
 	return nil
 }
@@ -74,15 +78,31 @@ func (s *Socks5Conn) SetConnected(isConnected bool) {
 		return
 	}
 
+	s.mutex.Lock()
 	s.isConnected = isConnected
+	s.mutex.Unlock()
 	logger.Debug("SOCKS5[%s] set connected: %v", s.shortID, isConnected)
 }
 
+// MarkReplied marks the CONNECT as answered, it returns false when it already was so the client never
+// gets a second reply.
+func (s *Socks5Conn) MarkReplied() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	replied := s.isReplied
+	s.isReplied = true
+	return !replied
+}
+
 func (s *Socks5Conn) IsConnected() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
 	return !s.isClosed.Load() && s.isConnected && s.targetAddr != "" && s.targetPort > 0 && s.targetPort <= 65535
 }
 
 func (s *Socks5Conn) GetTarget() (string, int, byte, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
 	return s.targetAddr, s.targetPort, s.targetAddrType, s.isProxy
 }
 
@@ -129,8 +149,10 @@ func (s *Socks5Conn) Close() error {
 	if s.isClosed.CompareAndSwap(false, true) {
 		s.mutex.Lock()
 		defer s.mutex.Unlock()
-		<-s.CloseChan
 		close(s.CloseChan)
+		if s.flow != nil {
+			s.flow.close()
+		}
 		s.targetAddr = ""
 		s.targetPort = -1
 		s.targetAddrType = 0
@@ -152,6 +174,8 @@ func (s *Socks5Conn) ShortID() string {
 }
 
 func (s *Socks5Conn) IsProxy() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
 	return s.isProxy
 }
 
@@ -9,8 +9,11 @@ import (
 	"github.com/yangxm/gecko/whitlist"
 	"io"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -19,18 +22,65 @@ const (
 	serverStatusClosing = 2
 )
 
+// DirectRule tells whether a target is dialed directly instead of through the bridge.
+type DirectRule func(host string, checkSubDomain bool) bool
+
 type ClientLocalSocks5Server struct {
 	clientID        string
 	bindAddr        string
 	bindPort        int
 	bridgeTransport base.BridgeTransport
+	connManager     base.ConnManager[*Socks5Conn]
+	bridgeWait      atomic.Int64
+	directRule      atomic.Pointer[DirectRule]
+	forwarders      map[string]*ProxyForwarder
+	forwardersMutex sync.Mutex
 	wg              sync.WaitGroup
 	mu              sync.Mutex
 	isClosing       bool
 }
 
-func NewClientLocalSocks5Server(clientID string, bindAddr string, bindPort int, bridgeTransport base.BridgeTransport) *ClientLocalSocks5Server {
-	return &ClientLocalSocks5Server{clientID: clientID, bindAddr: bindAddr, bindPort: bindPort, bridgeTransport: bridgeTransport}
+// NewClientLocalSocks5Server creates the local server of a client profile. connManager is shared with
+// the ClientReceiver of bridgeTransport only, it must not be nil: the replies of the bridge reach the
+// server through it.
+func NewClientLocalSocks5Server(clientID string, bindAddr string, bindPort int, bridgeTransport base.BridgeTransport,
+	connManager base.ConnManager[*Socks5Conn]) (*ClientLocalSocks5Server, error) {
+	if connManager == nil {
+		return nil, fmt.Errorf("connManager is nil")
+	}
+	s := &ClientLocalSocks5Server{clientID: clientID, bindAddr: bindAddr, bindPort: bindPort, bridgeTransport: bridgeTransport,
+		connManager: connManager, forwarders: make(map[string]*ProxyForwarder)}
+	if lost, ok := bridgeTransport.(base.BridgeLinkLost); ok {
+		lost.OnLinkLost(s.closeForwarders)
+	}
+	return s, nil
+}
+
+// ConnManager is the manager the ClientReceiver of this profile must be created with.
+func (s *ClientLocalSocks5Server) ConnManager() base.ConnManager[*Socks5Conn] {
+	return s.connManager
+}
+
+// SetDirectRule replaces the whitelist of this server, a nil rule goes back to it.
+func (s *ClientLocalSocks5Server) SetDirectRule(rule DirectRule) {
+	if rule == nil {
+		s.directRule.Store(nil)
+		return
+	}
+	s.directRule.Store(&rule)
+}
+
+func (s *ClientLocalSocks5Server) isDirect(host string, checkSubDomain bool) bool {
+	if rule := s.directRule.Load(); rule != nil {
+		return (*rule)(host, checkSubDomain)
+	}
+	return whitlist.Contains(host, checkSubDomain)
+}
+
+// SetBridgeWait makes new proxy requests wait up to timeout for the bridge to come back,
+// instead of being rejected right away while it is down.
+func (s *ClientLocalSocks5Server) SetBridgeWait(timeout time.Duration) {
+	s.bridgeWait.Store(int64(timeout))
 }
 
 func (s *ClientLocalSocks5Server) Start() error {
@@ -84,7 +134,7 @@ func (s *ClientLocalSocks5Server) Close() error {
 	}
 
 	s.isClosing = true
-	Sock5ConnManager().Close()
+	s.connManager.Close()
 	if s.bridgeTransport != nil {
 		_ = s.bridgeTransport.Close()
 	}
@@ -224,7 +274,7 @@ func (s *ClientLocalSocks5Server) handleRequest(sk5Conn *Socks5Conn) error {
 	logger.Debug("SOCKS5[%s] handle request, target: %s:%d", shortConn, addr, port)
 
 	// 连接目标
-	if whitlist.Contains(addr, atyp == base.AddrTypeDomain) {
+	if s.isDirect(addr, atyp == base.AddrTypeDomain) {
 		return s.handleDirect(sk5Conn, addr, port, atyp)
 	} else {
 		return s.handleProxy(sk5Conn, addr, port, atyp)
@@ -233,7 +283,7 @@ func (s *ClientLocalSocks5Server) handleRequest(sk5Conn *Socks5Conn) error {
 
 func (s *ClientLocalSocks5Server) handleDirect(sk5Conn *Socks5Conn, addr string, port int, atyp byte) error {
 	shortConn := util.ShortConnID(sk5Conn.connID)
-	targetAddr := fmt.Sprintf("%s:%d", addr, port)
+	targetAddr := net.JoinHostPort(addr, strconv.Itoa(port))
 	logger.Debug("SOCKS5[%s] handle direct start --> %s", shortConn, targetAddr)
 
 	if err := sk5Conn.SetTarget(addr, port, atyp, false); err != nil {
@@ -295,19 +345,46 @@ func (s *ClientLocalSocks5Server) handleProxy(sk5Conn *Socks5Conn, addr string,
 		return fmt.Errorf("[handle proxy] set conn target info failed: %v", err)
 	}
 
+	if !s.isBridgeAvailable() {
+		logger.Error("SOCKS5[%s] handle proxy, bridge is not available", shortConn)
+		if _, err := sk5Conn.Write(base.Socks5CmdConnectReply(base.Socks5RepNetworkUnreachable)); err != nil {
+			logger.Warn("SOCKS5[%s] handle proxy, write Socks5RepNetworkUnreachable failed: %v", shortConn, err)
+		}
+		return fmt.Errorf("[handle proxy] bridge is not available")
+	}
+
 	logger.Debug("SOCKS5[%s] handle proxy, connect to %s", shortConn, targetAddr)
-	Sock5ConnManager().Add(sk5Conn.connID, sk5Conn)
+	sk5Conn.flow = newStreamFlow(base.StreamInitialWindow)
+	s.connManager.Add(sk5Conn.connID, sk5Conn)
 	forwarder, err := NewProxyForwarder(sk5Conn, s.bridgeTransport, s.clientID)
 	if err != nil {
 		logger.Error("SOCKS5[%s] handle proxy, create proxy forward failed: %v", shortConn, err)
+		s.connManager.RemoveAndClose(sk5Conn.connID)
 		return fmt.Errorf("[handle proxy] create proxy forward failed: %v", err)
 	}
 
+	if err := forwarder.Connect(); err != nil {
+		logger.Error("SOCKS5[%s] handle proxy, connect failed: %v", shortConn, err)
+		if !sk5Conn.MarkReplied() {
+			logger.Debug("SOCKS5[%s] handle proxy, CONNECT already answered", shortConn)
+		} else if _, err := sk5Conn.Write(base.Socks5CmdConnectFailed()); err != nil {
+			logger.Warn("SOCKS5[%s] handle proxy, write Socks5CmdConnectFailed failed: %v", shortConn, err)
+		}
+		s.connManager.RemoveAndClose(sk5Conn.connID)
+		return fmt.Errorf("[handle proxy] connect failed: %v", err)
+	}
+
 	logger.Info("SOCKS5[%s] handle proxy, L:%v --> R:%s", shortConn, sk5Conn.RemoteAddr(), targetAddr)
 	forwarder.Start()
+	s.forwardersMutex.Lock()
+	s.forwarders[sk5Conn.connID] = forwarder
+	s.forwardersMutex.Unlock()
 	doneMessage := <-forwarder.Done
-	Sock5ConnManager().RemoveAndClose(sk5Conn.connID)
-	if doneMessage == "" || strings.Contains(doneMessage, "EOF") || strings.Contains(doneMessage, "SkConn closed") {
+	s.forwardersMutex.Lock()
+	delete(s.forwarders, sk5Conn.connID)
+	s.forwardersMutex.Unlock()
+	s.connManager.RemoveAndClose(sk5Conn.connID)
+	if isProxyDoneNormally(doneMessage) {
 		logger.Info("SOCKS5[%s] handle proxy, L:%v ××> R:%s", shortConn, sk5Conn.RemoteAddr(), targetAddr)
 		logger.Debug("SOCKS5[%s] handle proxy, done with %s", shortConn, doneMessage)
 		return nil
@@ -316,3 +393,37 @@ func (s *ClientLocalSocks5Server) handleProxy(sk5Conn *Socks5Conn, addr string,
 		return fmt.Errorf("[handle proxy] done with error: %s", doneMessage)
 	}
 }
+
+// closeForwarders ends every proxied session once the bridge declared its link lost, without waiting for
+// the remote side to close them.
+func (s *ClientLocalSocks5Server) closeForwarders(reason string) {
+	s.forwardersMutex.Lock()
+	forwarders := make([]*ProxyForwarder, 0, len(s.forwarders))
+	for _, forwarder := range s.forwarders {
+		forwarders = append(forwarders, forwarder)
+	}
+	s.forwardersMutex.Unlock()
+
+	if len(forwarders) > 0 {
+		logger.Warn("Socks5 server [%s] bridge lost, close %d proxied sessions: %s", s.clientID, len(forwarders), reason)
+	}
+	for _, forwarder := range forwarders {
+		forwarder.finish(proxyDoneBridgeLost, reason)
+	}
+}
+
+func (s *ClientLocalSocks5Server) isBridgeAvailable() bool {
+	health, ok := s.bridgeTransport.(base.BridgeHealth)
+	if !ok {
+		return s.bridgeTransport != nil
+	}
+	if health.IsAvailable() {
+		return true
+	}
+
+	wait := time.Duration(s.bridgeWait.Load())
+	if wait <= 0 {
+		return false
+	}
+	return health.WaitAvailable(wait)
+}
@@ -0,0 +1,181 @@
+package socks5
+
+import (
+	"bytes"
+	"github.com/yangxm/gecko/base"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lostRemote is a fakeRemote that declares its link lost on demand, like the bridge transports do.
+type lostRemote struct {
+	*fakeRemote
+	mutex     sync.Mutex
+	listeners []func(reason string)
+}
+
+func (r *lostRemote) OnLinkLost(listener func(reason string)) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.listeners = append(r.listeners, listener)
+}
+
+func (r *lostRemote) loseLink(reason string) {
+	r.mutex.Lock()
+	listeners := r.listeners
+	r.mutex.Unlock()
+	for _, listener := range listeners {
+		listener(reason)
+	}
+}
+
+func freePort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// startServer runs a local server of clientID whose bridge is remote, every target goes through the bridge.
+func startServer(t *testing.T, clientID string, remote base.BridgeTransport, manager base.ConnManager[*Socks5Conn]) string {
+	port := freePort(t)
+	server, err := NewClientLocalSocks5Server(clientID, "127.0.0.1", port, remote, manager)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.ConnManager() != manager {
+		t.Fatal("ConnManager is not the one given")
+	}
+	server.SetDirectRule(func(string, bool) bool { return false })
+	go func() {
+		_ = server.Start()
+	}()
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			_ = conn.Close()
+			return addr
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("server not listening: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// socksConnect opens a SOCKS5 session to example.com:80 through addr and returns it after the reply.
+func socksConnect(t *testing.T, addr string) (net.Conn, []byte) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte{base.Socks5Version, 1, 0x00}); err != nil {
+		t.Fatal(err)
+	}
+	auth := make([]byte, 2)
+	if _, err := io.ReadFull(conn, auth); err != nil {
+		t.Fatal(err)
+	}
+	host := "example.com"
+	request := append([]byte{base.Socks5Version, base.Socks5CmdConnect, 0x00, base.AddrTypeDomain, byte(len(host))}, host...)
+	request = append(request, 0, 80)
+	if _, err := conn.Write(request); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, reply
+}
+
+func TestServerClosesProxiedSessionsWhenBridgeLost(t *testing.T) {
+	manager := NewSock5ConnManager()
+	remote := &lostRemote{fakeRemote: newFakeRemote("c1", newReceiver(t, "c1", manager))}
+	remote.echo = true
+	remote.start()
+	t.Cleanup(func() { _ = remote.Close() })
+	addr := startServer(t, "c1", remote, manager)
+
+	conn, reply := socksConnect(t, addr)
+	if reply[1] != base.Socks5RepSuccess {
+		t.Fatalf("connect reply %v", reply)
+	}
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	echoed := make([]byte, 4)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, echoed); err != nil || !bytes.Equal(echoed, []byte("ping")) {
+		t.Fatalf("echo %q, %v", echoed, err)
+	}
+
+	remote.loseLink("bridge link lost for 1s")
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if n, err := conn.Read(echoed); err == nil {
+		t.Fatalf("session still open after the bridge was lost, read %d", n)
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("session still open after the bridge was lost")
+	}
+	for _, _type := range remote.sentTypes() {
+		if _type == base.MsgTypeError || _type == base.MsgTypeClose {
+			t.Fatalf("notified the lost bridge with 0x%02x", _type)
+		}
+	}
+}
+
+func TestServerAndReceiverPerProfile(t *testing.T) {
+	managers := make([]base.ConnManager[*Socks5Conn], 0, 2)
+	addrs := make([]string, 0, 2)
+	for _, clientID := range []string{"c1", "c2"} {
+		// one manager per profile, shared by its receiver and its server only
+		manager := NewSock5ConnManager()
+		remote := newFakeRemote(clientID, newReceiver(t, clientID, manager))
+		remote.echo = true
+		remote.start()
+		t.Cleanup(func() { _ = remote.Close() })
+		managers = append(managers, manager)
+		addrs = append(addrs, startServer(t, clientID, remote, manager))
+	}
+
+	for i, addr := range addrs {
+		conn, reply := socksConnect(t, addr)
+		if reply[1] != base.Socks5RepSuccess {
+			t.Fatalf("profile %d, connect reply %v", i, reply)
+		}
+		payload := []byte("profile " + strconv.Itoa(i))
+		if _, err := conn.Write(payload); err != nil {
+			t.Fatal(err)
+		}
+		echoed := make([]byte, len(payload))
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(conn, echoed); err != nil || !bytes.Equal(echoed, payload) {
+			t.Fatalf("profile %d, echo %q, %v", i, echoed, err)
+		}
+	}
+	for i, manager := range managers {
+		if manager.Len() != 1 {
+			t.Fatalf("profile %d, conns: %d", i, manager.Len())
+		}
+	}
+}
+
+func TestServerRefusesNilConnManager(t *testing.T) {
+	if server, err := NewClientLocalSocks5Server("c1", "127.0.0.1", 0, nil, nil); err == nil || server != nil {
+		t.Fatalf("server with a nil connManager: %v", err)
+	}
+	if receiver, err := NewClientReceiver("c1", nil); err == nil || receiver != nil {
+		t.Fatalf("receiver with a nil connManager: %v", err)
+	}
+}
@@ -3,8 +3,12 @@ package socks5
 import (
 	"fmt"
 	"github.com/yangxm/gecko/base"
+	"github.com/yangxm/gecko/entity"
 	"github.com/yangxm/gecko/logger"
+	"google.golang.org/protobuf/proto"
 	"io"
+	"strings"
+	"sync"
 	"sync/atomic"
 )
 
@@ -13,13 +17,37 @@ type ProxyForwarder struct {
 	sk5Conn         *Socks5Conn
 	bridgeTransport base.BridgeTransport
 	clientID        string
-	retries         atomic.Uint32
+	addr            string
+	port            int
+	atyp            byte
+	isProxy         bool
+	doneOnce        sync.Once
+	localEOF        atomic.Bool
+	remoteEOF       atomic.Bool
 }
 
 const (
-	proxyMaxRetry = 3
+	proxyDoneNotProxy     = "SkConn not a proxy"
+	proxyDoneLocalEOF     = "Read EOF"
+	proxyDoneLocalClosed  = "SkConn closed"
+	proxyDoneHalfClosed   = "Both half closed"
+	proxyDoneReadError    = "Read error"
+	proxyDoneWriteError   = "Write to local error"
+	proxyDoneSendError    = "Send error"
+	proxyDoneRemoteClosed = "Remote closed"
+	proxyDoneRemoteError  = "Remote error"
+	proxyDoneBridgeLost   = "Bridge lost"
 )
 
+func isProxyDoneNormally(doneMessage string) bool {
+	for _, reason := range []string{proxyDoneLocalEOF, proxyDoneLocalClosed, proxyDoneHalfClosed, proxyDoneRemoteClosed} {
+		if strings.HasPrefix(doneMessage, reason) {
+			return true
+		}
+	}
+	return false
+}
+
 func NewProxyForwarder(sk5Conn *Socks5Conn, bridgeTransport base.BridgeTransport, clientID string) (*ProxyForwarder, error) {
 	if sk5Conn == nil {
 		return nil, fmt.Errorf("sk5Conn is nil")
@@ -29,77 +57,231 @@ func NewProxyForwarder(sk5Conn *Socks5Conn, bridgeTransport base.BridgeTransport
 		return nil, fmt.Errorf("bridgeTransport is nil")
 	}
 
+	if sk5Conn.flow == nil {
+		return nil, fmt.Errorf("sk5Conn flow control is nil")
+	}
+
 	p := &ProxyForwarder{
 		Done:            make(chan string),
 		sk5Conn:         sk5Conn,
 		bridgeTransport: bridgeTransport,
 		clientID:        clientID,
 	}
+	// the target is taken now, Socks5Conn.Close clears it while the pipes may still be reporting
+	p.addr, p.port, p.atyp, p.isProxy = sk5Conn.GetTarget()
 
 	logger.Debug("PROXY[%s] forward created", p.sk5Conn.ShortID())
 	return p, nil
 }
 
+func (p *ProxyForwarder) Connect() error {
+	shortConn := p.sk5Conn.ShortID()
+	addr, port, atyp := p.addr, p.port, p.atyp
+	data, err := p.notification("")
+	if err != nil {
+		logger.Error("PROXY[%s] connect, marshal notification failed: %v", shortConn, err)
+		return fmt.Errorf("marshal notification failed: %v", err)
+	}
+	if _, err := p.bridgeTransport.Send(base.MsgTypeConnect, base.MsgFlagToServer, p.clientID, p.sk5Conn.ConnID(), 0x00, data); err != nil {
+		logger.Error("PROXY[%s] connect, send Connect failed: %v", shortConn, err)
+		return fmt.Errorf("send Connect failed: %v", err)
+	}
+	logger.Debug("PROXY[%s] connect, send Connect --> %s:%d %v", shortConn, addr, port, atyp)
+	return nil
+}
+
 func (p *ProxyForwarder) Start() {
 	logger.Debug("PROXY[%s] forward start", p.sk5Conn.ShortID())
 	go p.pipe()
+	go p.drain()
+}
+
+// finish reports the first close reason of the stream on Done and tells the remote side about it,
+// unless the remote side is the one that closed the stream or is gone with the bridge.
+func (p *ProxyForwarder) finish(reason, detail string) {
+	p.doneOnce.Do(func() {
+		p.sk5Conn.flow.setCloseReason(reason, detail)
+		reason, detail = p.sk5Conn.flow.getCloseReason()
+		doneMessage := reason
+		if detail != "" {
+			doneMessage = reason + ": " + detail
+		}
+
+		switch reason {
+		case proxyDoneRemoteClosed, proxyDoneRemoteError, proxyDoneBridgeLost:
+		case proxyDoneLocalEOF, proxyDoneLocalClosed, proxyDoneHalfClosed:
+			p.notifyRemote(base.MsgTypeClose, doneMessage)
+		default:
+			p.notifyRemote(base.MsgTypeError, doneMessage)
+		}
+		p.Done <- doneMessage
+	})
+}
+
+func (p *ProxyForwarder) notification(message string) ([]byte, error) {
+	return proto.Marshal(&entity.Notification{
+		Message: message,
+		Atyp:    []byte{p.atyp},
+		Addr:    p.addr,
+		Port:    int32(p.port),
+	})
+}
+
+func (p *ProxyForwarder) notifyRemote(_type byte, message string) {
+	shortConn := p.sk5Conn.ShortID()
+	data, err := p.notification(message)
+	if err != nil {
+		logger.Error("PROXY[%s] notify remote, marshal notification failed: %v", shortConn, err)
+		return
+	}
+	if _, err := p.bridgeTransport.Send(_type, base.MsgFlagToServer, p.clientID, p.sk5Conn.ConnID(), 0x00, data); err != nil {
+		logger.Warn("PROXY[%s] notify remote, send %v failed: %v", shortConn, _type, err)
+		return
+	}
+	logger.Debug("PROXY[%s] notify remote, send %v: %s", shortConn, _type, message)
 }
 
 func (p *ProxyForwarder) pipe() {
 	buf := make([]byte, 32*1024)
 	shortConn := p.sk5Conn.ShortID()
-	addr, port, _, isProxy := p.sk5Conn.GetTarget()
-	if !isProxy {
+	addr, port := p.addr, p.port
+	if !p.isProxy {
 		logger.Error("PROXY[%s] not a proxy", shortConn)
-		p.Done <- "SkConn not a proxy"
+		p.finish(proxyDoneNotProxy, "")
 		return
 	}
 	src := p.sk5Conn.RemoteAddr().String()
 	dst := fmt.Sprintf("%s:%d", addr, port)
+	window := p.sk5Conn.flow.send
 
 	for {
 		n, rerr := p.sk5Conn.Read(buf)
-		if n > 0 {
-			written := 0
-			isBreak := false
-			for written < n {
-				wn, werr := p.bridgeTransport.Send(base.MsgTypeData, base.MsgFlagToServer, p.clientID, p.sk5Conn.ConnID(), 0x00, buf[written:n])
-				if werr != nil {
-					logger.Error("PROXY[%s] F:%v --> T:%v  write error: %v", shortConn, src, dst, werr)
-					p.retries.Add(1)
-					if p.retries.Load() >= proxyMaxRetry {
-						p.Done <- "Write error: " + werr.Error()
-						isBreak = true
-						break
-					}
-				} else {
-					logger.Debug("PROXY[%s] F:%v --> T:%v  write  %d", shortConn, src, dst, wn)
-					p.retries.Store(0)
-				}
-				written += wn
+		written := 0
+		for written < n {
+			credit, err := window.acquire(n - written)
+			if err != nil {
+				logger.Debug("PROXY[%s] F:%v --> T:%v  acquire credit failed: %v", shortConn, src, dst, err)
+				p.finish(proxyDoneLocalClosed, "")
+				return
 			}
 
-			if isBreak {
-				break
+			// Send blocks until the frame is queued or the transport deadline expires, a failed chunk is never
+			// skipped, the stream is torn down instead so the remote side never sees a gap.
+			wn, werr := p.bridgeTransport.Send(base.MsgTypeData, base.MsgFlagToServer, p.clientID, p.sk5Conn.ConnID(), 0x00, buf[written:written+credit])
+			if werr != nil {
+				logger.Error("PROXY[%s] F:%v --> T:%v  write error: %v", shortConn, src, dst, werr)
+				p.finish(proxyDoneSendError, werr.Error())
+				return
 			}
+			logger.Debug("PROXY[%s] F:%v --> T:%v  write  %d -> %d, credit: %d", shortConn, src, dst, credit, wn, window.available())
+			written += credit
 		}
+
 		if rerr != nil {
-			if rerr != io.EOF {
-				logger.Error("PROXY[%s] F:%v --> T:%v  read error: %v", shortConn, src, dst, rerr)
-				p.Done <- "Read error: " + rerr.Error()
-			} else {
+			if rerr == io.EOF {
 				logger.Debug("PROXY[%s] F:%v --> T:%v  read EOF", shortConn, src, dst)
-				p.Done <- "Read EOF"
+				p.halfCloseRemote()
+			} else if p.sk5Conn.isClosed.Load() {
+				logger.Debug("PROXY[%s] F:%v --> T:%v  skConn closed", shortConn, src, dst)
+				p.finish(proxyDoneLocalClosed, "")
+			} else {
+				logger.Error("PROXY[%s] F:%v --> T:%v  read error: %v", shortConn, src, dst, rerr)
+				p.finish(proxyDoneReadError, rerr.Error())
 			}
-			break
+			return
 		}
+	}
+}
 
-		select {
-		case <-p.sk5Conn.CloseChan:
-			logger.Debug("PROXY[%s] F:%v --> T:%v  skConn closed", shortConn, src, dst)
-			p.Done <- "SkConn closed"
-			break
-		default:
+// drain writes the downstream data buffered by the ClientReceiver to the socks5 client,
+// and hands the consumed bytes back to the remote side as window updates.
+func (p *ProxyForwarder) drain() {
+	shortConn := p.sk5Conn.ShortID()
+	buffer := p.sk5Conn.flow.recv
+	consumed := 0
+
+	for {
+		data, eof, ok := buffer.pop()
+		if !ok {
+			logger.Debug("PROXY[%s] drain, recv buffer closed", shortConn)
+			return
+		}
+		if eof {
+			p.halfCloseLocal()
+			return
+		}
+
+		if wn, err := p.sk5Conn.WriteIfConnected(data); err != nil {
+			logger.Error("PROXY[%s] drain, write data to client failed: %v", shortConn, err)
+			p.finish(proxyDoneWriteError, err.Error())
+			return
+		} else {
+			logger.Debug("PROXY[%s] drain, write data to client success, %d", shortConn, wn)
 		}
+
+		consumed += len(data)
+		if consumed >= base.StreamWindowUpdateThreshold {
+			if err := p.sendWindowUpdate(consumed); err != nil {
+				logger.Error("PROXY[%s] drain, send WindowUpdate failed: %v", shortConn, err)
+				p.finish(proxyDoneSendError, err.Error())
+				return
+			}
+			consumed = 0
+		}
+	}
+}
+
+// halfCloseRemote forwards the EOF of the socks5 client as MsgTypeHalfClose, the downstream keeps flowing
+// until the remote side half closes as well.
+func (p *ProxyForwarder) halfCloseRemote() {
+	shortConn := p.sk5Conn.ShortID()
+	data, err := p.notification(proxyDoneLocalEOF)
+	if err != nil {
+		logger.Error("PROXY[%s] half close remote, marshal notification failed: %v", shortConn, err)
+		p.finish(proxyDoneSendError, err.Error())
+		return
+	}
+	if _, err := p.bridgeTransport.Send(base.MsgTypeHalfClose, base.MsgFlagToServer, p.clientID, p.sk5Conn.ConnID(), 0x00, data); err != nil {
+		logger.Error("PROXY[%s] half close remote, send HalfClose failed: %v", shortConn, err)
+		p.finish(proxyDoneSendError, err.Error())
+		return
+	}
+	logger.Debug("PROXY[%s] half close remote, send HalfClose", shortConn)
+	p.localEOF.Store(true)
+	if p.remoteEOF.Load() {
+		p.finish(proxyDoneHalfClosed, "")
+	}
+}
+
+// halfCloseLocal shuts down the write side of the socks5 client once the remote side has sent all of its data.
+func (p *ProxyForwarder) halfCloseLocal() {
+	shortConn := p.sk5Conn.ShortID()
+	closeWriter, ok := p.sk5Conn.Conn.(interface{ CloseWrite() error })
+	if !ok {
+		logger.Warn("PROXY[%s] half close local, sk5Conn does not support half close", shortConn)
+		p.finish(proxyDoneRemoteClosed, "half close not supported")
+		return
+	}
+	if err := closeWriter.CloseWrite(); err != nil {
+		logger.Error("PROXY[%s] half close local, close write failed: %v", shortConn, err)
+		p.finish(proxyDoneWriteError, err.Error())
+		return
+	}
+	logger.Debug("PROXY[%s] half close local, closed write for sk5Conn", shortConn)
+	p.remoteEOF.Store(true)
+	if p.localEOF.Load() {
+		p.finish(proxyDoneHalfClosed, "")
+	}
+}
+
+func (p *ProxyForwarder) sendWindowUpdate(increment int) error {
+	data, err := proto.Marshal(&entity.WindowUpdate{Increment: uint32(increment)})
+	if err != nil {
+		return fmt.Errorf("marshal WindowUpdate failed: %v", err)
+	}
+	if _, err := p.bridgeTransport.Send(base.MsgTypeWindowUpdate, base.MsgFlagToServer, p.clientID, p.sk5Conn.ConnID(), 0x00, data); err != nil {
+		return err
 	}
+	logger.Debug("PROXY[%s] send WindowUpdate, increment: %d", p.sk5Conn.ShortID(), increment)
+	return nil
 }
@@ -0,0 +1,440 @@
+package socks5
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"github.com/yangxm/gecko/base"
+	"github.com/yangxm/gecko/coder"
+	"github.com/yangxm/gecko/entity"
+	"github.com/yangxm/gecko/logger"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "socks5-test")
+	if err != nil {
+		panic(err)
+	}
+	config := filepath.Join(dir, "log.yaml")
+	if err := os.WriteFile(config, []byte("log:\n  level: fatal\n  format: console\n  output: [stdout]\n"), 0o600); err != nil {
+		panic(err)
+	}
+	if err := logger.InitLogger(config); err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+type sentFrame struct {
+	_type  byte
+	connID string
+	data   []byte
+}
+
+// fakeRemote is the far end of the bridge. Frames queue up in a small channel drained by one slow
+// goroutine, so the transport saturates, and it keeps to the windows the way a remote side must.
+type fakeRemote struct {
+	clientID string
+	receiver *ClientReceiver
+	frames   chan sentFrame
+	delay    time.Duration
+	sendWait time.Duration
+	echo     bool
+	failData bool
+	stall    atomic.Bool
+
+	mutex    sync.Mutex
+	cond     *sync.Cond
+	types    []byte
+	upstream map[string]*bytes.Buffer
+	down     []sentFrame
+	credit   map[string]int
+	closed   bool
+}
+
+func newFakeRemote(clientID string, receiver *ClientReceiver) *fakeRemote {
+	r := &fakeRemote{
+		clientID: clientID,
+		receiver: receiver,
+		frames:   make(chan sentFrame, 1),
+		sendWait: 5 * time.Second,
+		upstream: make(map[string]*bytes.Buffer),
+		credit:   make(map[string]int),
+	}
+	r.cond = sync.NewCond(&r.mutex)
+	return r
+}
+
+func (r *fakeRemote) start() {
+	go r.readLoop()
+	go r.writeLoop()
+}
+
+func (r *fakeRemote) Send(_type, _ byte, _, connID string, _ byte, data []byte) (int, error) {
+	if r.failData && _type == base.MsgTypeData {
+		return 0, errors.New("transport broken")
+	}
+	timer := time.NewTimer(r.sendWait)
+	defer timer.Stop()
+	select {
+	case r.frames <- sentFrame{_type: _type, connID: connID, data: bytes.Clone(data)}:
+		return len(data), nil
+	case <-timer.C:
+		return 0, fmt.Errorf("send timeout after %v", r.sendWait)
+	}
+}
+
+func (r *fakeRemote) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.closed = true
+	r.cond.Broadcast()
+	return nil
+}
+
+func (r *fakeRemote) sentTypes() []byte {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return bytes.Clone(r.types)
+}
+
+func (r *fakeRemote) received(connID string) []byte {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if buf, ok := r.upstream[connID]; ok {
+		return bytes.Clone(buf.Bytes())
+	}
+	return nil
+}
+
+func (r *fakeRemote) readLoop() {
+	for f := range r.frames {
+		time.Sleep(r.delay)
+		for r.stall.Load() {
+			time.Sleep(10 * time.Millisecond)
+		}
+		r.mutex.Lock()
+		r.types = append(r.types, f._type)
+		r.mutex.Unlock()
+
+		switch f._type {
+		case base.MsgTypeConnect:
+			r.mutex.Lock()
+			r.credit[f.connID] = base.StreamInitialWindow
+			r.mutex.Unlock()
+			data, _ := proto.Marshal(&entity.Notification{})
+			r.toClient(base.MsgTypeConnectAck, f.connID, data)
+		case base.MsgTypeData:
+			r.mutex.Lock()
+			buf, ok := r.upstream[f.connID]
+			if !ok {
+				buf = &bytes.Buffer{}
+				r.upstream[f.connID] = buf
+			}
+			buf.Write(f.data)
+			r.mutex.Unlock()
+			if r.echo {
+				r.toClient(base.MsgTypeData, f.connID, f.data)
+			}
+			data, _ := proto.Marshal(&entity.WindowUpdate{Increment: uint32(len(f.data))})
+			r.toClient(base.MsgTypeWindowUpdate, f.connID, data)
+		case base.MsgTypeWindowUpdate:
+			var update entity.WindowUpdate
+			_ = proto.Unmarshal(f.data, &update)
+			r.mutex.Lock()
+			r.credit[f.connID] += int(update.Increment)
+			r.cond.Broadcast()
+			r.mutex.Unlock()
+		case base.MsgTypeHalfClose:
+			data, _ := proto.Marshal(&entity.Notification{Message: "EOF"})
+			r.toClient(base.MsgTypeHalfClose, f.connID, data)
+		}
+	}
+}
+
+func (r *fakeRemote) toClient(_type byte, connID string, data []byte) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.down = append(r.down, sentFrame{_type: _type, connID: connID, data: data})
+	r.cond.Broadcast()
+}
+
+// writeLoop hands the frames for the client to the receiver in order, a Data frame waits for window.
+func (r *fakeRemote) writeLoop() {
+	for {
+		r.mutex.Lock()
+		for !r.closed && (len(r.down) == 0 || r.down[0]._type == base.MsgTypeData && r.credit[r.down[0].connID] < len(r.down[0].data)) {
+			r.cond.Wait()
+		}
+		if r.closed {
+			r.mutex.Unlock()
+			return
+		}
+		f := r.down[0]
+		r.down = r.down[1:]
+		if f._type == base.MsgTypeData {
+			r.credit[f.connID] -= len(f.data)
+		}
+		r.mutex.Unlock()
+
+		frame, err := coder.Encode(f._type, base.MsgFlagToClient, r.clientID, f.connID, 0x00, f.data)
+		if err != nil {
+			panic(err)
+		}
+		r.receiver.OnReceived(frame)
+	}
+}
+
+func newReceiver(t *testing.T, clientID string, manager base.ConnManager[*Socks5Conn]) *ClientReceiver {
+	receiver, err := NewClientReceiver(clientID, manager)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return receiver
+}
+
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := listener.Accept()
+		accepted <- conn
+	}()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := <-accepted
+	if server == nil {
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+	return client, server
+}
+
+type proxyStream struct {
+	client    net.Conn
+	sk5Conn   *Socks5Conn
+	forwarder *ProxyForwarder
+	remote    *fakeRemote
+	manager   base.ConnManager[*Socks5Conn]
+}
+
+// newProxyStream wires a ProxyForwarder to remote the way handleProxy does, the client side is a real TCP conn.
+func newProxyStream(t *testing.T, configure func(remote *fakeRemote)) *proxyStream {
+	client, server := tcpPair(t)
+	manager := NewSock5ConnManager()
+	remote := newFakeRemote("c1", newReceiver(t, "c1", manager))
+	if configure != nil {
+		configure(remote)
+	}
+	remote.start()
+	t.Cleanup(func() { _ = remote.Close() })
+
+	sk5Conn := NewSocks5Conn(server)
+	if err := sk5Conn.SetTarget("example.com", 80, base.AddrTypeDomain, true); err != nil {
+		t.Fatal(err)
+	}
+	sk5Conn.flow = newStreamFlow(base.StreamInitialWindow)
+	manager.Add(sk5Conn.ConnID(), sk5Conn)
+	t.Cleanup(func() { manager.RemoveAndClose(sk5Conn.ConnID()) })
+
+	forwarder, err := NewProxyForwarder(sk5Conn, remote, "c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &proxyStream{client: client, sk5Conn: sk5Conn, forwarder: forwarder, remote: remote, manager: manager}
+}
+
+// connect sends the Connect and reads the SOCKS5 reply of the ConnectAck.
+func (s *proxyStream) connect(t *testing.T) {
+	if err := s.forwarder.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 10)
+	_ = s.client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(s.client, reply); err != nil {
+		t.Fatal(err)
+	}
+	_ = s.client.SetReadDeadline(time.Time{})
+	if reply[1] != base.Socks5RepSuccess {
+		t.Fatalf("connect reply %v", reply)
+	}
+	s.forwarder.Start()
+}
+
+func (s *proxyStream) done(t *testing.T) string {
+	select {
+	case message := <-s.forwarder.Done:
+		return message
+	case <-time.After(10 * time.Second):
+		t.Fatal("forwarder not done")
+		return ""
+	}
+}
+
+func TestProxyForwarderDeliversBytesExactly(t *testing.T) {
+	s := newProxyStream(t, func(remote *fakeRemote) {
+		remote.echo = true
+		remote.delay = 50 * time.Microsecond
+	})
+	s.connect(t)
+
+	payload := make([]byte, 6<<20)
+	if _, err := rand.Read(payload); err != nil {
+		t.Fatal(err)
+	}
+	writeErr := make(chan error, 1)
+	go func() {
+		_, err := s.client.Write(payload)
+		if err == nil {
+			err = s.client.(*net.TCPConn).CloseWrite()
+		}
+		writeErr <- err
+	}()
+
+	echoed, err := io.ReadAll(s.client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-writeErr; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(s.remote.received(s.sk5Conn.ConnID()), payload) {
+		t.Fatal("upstream bytes differ")
+	}
+	if !bytes.Equal(echoed, payload) {
+		t.Fatalf("downstream bytes differ, got %d of %d", len(echoed), len(payload))
+	}
+	if message := s.done(t); message != proxyDoneHalfClosed {
+		t.Fatalf("done with %q", message)
+	}
+}
+
+func TestProxyForwarderCloseReasons(t *testing.T) {
+	notification := func(code int32, message string) []byte {
+		data, _ := proto.Marshal(&entity.Notification{Code: code, Message: message})
+		return data
+	}
+	cases := []struct {
+		name      string
+		configure func(remote *fakeRemote)
+		trigger   func(s *proxyStream)
+		reason    string
+		notified  byte
+	}{
+		{
+			name: "remote close",
+			trigger: func(s *proxyStream) {
+				s.remote.toClient(base.MsgTypeClose, s.sk5Conn.ConnID(), notification(0, "bye"))
+			},
+			reason: proxyDoneRemoteClosed + ": bye",
+		},
+		{
+			name: "remote error",
+			trigger: func(s *proxyStream) {
+				s.remote.toClient(base.MsgTypeError, s.sk5Conn.ConnID(), notification(base.ErrCodeOverload, "busy"))
+			},
+			reason: proxyDoneRemoteError + ": overload, busy",
+		},
+		{
+			name: "local close",
+			trigger: func(s *proxyStream) {
+				_ = s.sk5Conn.Close()
+			},
+			reason:   proxyDoneLocalClosed,
+			notified: base.MsgTypeClose,
+		},
+		{
+			name:      "send error",
+			configure: func(remote *fakeRemote) { remote.failData = true },
+			trigger: func(s *proxyStream) {
+				_, _ = s.client.Write([]byte("hello"))
+			},
+			reason:   proxyDoneSendError + ": transport broken",
+			notified: base.MsgTypeError,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := newProxyStream(t, c.configure)
+			s.connect(t)
+			c.trigger(s)
+			if message := s.done(t); message != c.reason {
+				t.Fatalf("done with %q, expected %q", message, c.reason)
+			}
+
+			// the remote side hears about a close it did not initiate, and only about that
+			deadline := time.Now().Add(time.Second)
+			for c.notified != 0 && !bytes.Contains(s.remote.sentTypes(), []byte{c.notified}) && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			types := s.remote.sentTypes()
+			for _, _type := range []byte{base.MsgTypeClose, base.MsgTypeError} {
+				if sent := bytes.Contains(types, []byte{_type}); sent != (_type == c.notified) {
+					t.Fatalf("sent %v, notified %v", types, c.notified)
+				}
+			}
+		})
+	}
+}
+
+func TestProxyForwarderFirstCloseReasonWins(t *testing.T) {
+	s := newProxyStream(t, nil)
+	go s.forwarder.finish(proxyDoneReadError, "boom")
+	if message := s.done(t); message != proxyDoneReadError+": boom" {
+		t.Fatalf("done with %q", message)
+	}
+	finished := make(chan struct{})
+	go func() {
+		s.forwarder.finish(proxyDoneLocalClosed, "")
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case message := <-s.forwarder.Done:
+		t.Fatalf("done twice, with %q", message)
+	}
+	if reason, detail := s.sk5Conn.flow.getCloseReason(); reason != proxyDoneReadError || detail != "boom" {
+		t.Fatalf("close reason %q, %q", reason, detail)
+	}
+}
+
+func TestProxyForwarderSendDeadline(t *testing.T) {
+	sendWait := 200 * time.Millisecond
+	s := newProxyStream(t, func(remote *fakeRemote) { remote.sendWait = sendWait })
+	s.connect(t)
+
+	// the remote side stops reading, so the queue stays full and every Send runs into its deadline
+	s.remote.stall.Store(true)
+
+	start := time.Now()
+	go func() { _, _ = s.client.Write(make([]byte, base.StreamInitialWindow)) }()
+	message := s.done(t)
+	if !strings.HasPrefix(message, proxyDoneSendError+": send timeout") {
+		t.Fatalf("done with %q", message)
+	}
+	if elapsed := time.Since(start); elapsed < sendWait {
+		t.Fatalf("done after %v, before the send deadline", elapsed)
+	}
+}